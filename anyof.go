@@ -0,0 +1,160 @@
+package macaroon
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// An any-of third party caveat can be discharged by any one
+// of several third parties. Its caveat id is encoded as:
+//
+// - the bytes of anyOfPrefix.
+//
+// - a single byte holding the version of the encoding
+// (anyOfVersion).
+//
+// - for each alternative, a varint holding the length of
+// the location, the location, a varint holding the length
+// of the caveat id and the caveat id.
+//
+// All the alternatives share the same root key, so a
+// discharge macaroon whose id is the caveat id of any
+// of the alternatives discharges the caveat.
+//
+// AddThirdPartyCaveat rejects caveat ids that start with
+// anyOfPrefix, so the id of an ordinary third party caveat
+// is never mistaken for that of an any-of caveat.
+
+// anyOfPrefix is the prefix of the id of every
+// any-of third party caveat.
+const anyOfPrefix = "\x00macaroon-any-of\x00"
+
+// anyOfVersion holds the version of the any-of caveat id
+// encoding. Ids with other versions are not treated as
+// any-of caveats.
+const anyOfVersion = 1
+
+// Alternative holds one of the third parties that may
+// discharge an any-of third party caveat.
+type Alternative struct {
+	// Location holds the location hint of the third party.
+	Location string
+
+	// Id holds the caveat id to be sent to the third party.
+	// A discharge macaroon from the third party must have
+	// this id.
+	Id []byte
+}
+
+// AddAnyOfThirdPartyCaveat adds a third party caveat to the
+// macaroon that can be discharged by any one of the given
+// alternative third parties, using the given shared root key.
+// Each caveat id should encode the root key for its third party
+// as for AddThirdPartyCaveat.
+//
+// At least one alternative must be given and every alternative
+// must have a location. The location of the caveat itself is that
+// of the first alternative; use Caveat.Alternatives to find
+// all of them.
+func (m *Macaroon) AddAnyOfThirdPartyCaveat(rootKey []byte, alts []Alternative) error {
+	return m.AddAnyOfThirdPartyCaveatWithRand(rootKey, alts, rand.Reader)
+}
+
+// AddAnyOfThirdPartyCaveatWithRand is like AddAnyOfThirdPartyCaveat
+// except that the given source of randomness is used instead
+// of crypto/rand.Reader when encrypting the root key.
+func (m *Macaroon) AddAnyOfThirdPartyCaveatWithRand(rootKey []byte, alts []Alternative, r io.Reader) error {
+	caveatId, err := encodeAlternatives(alts)
+	if err != nil {
+		return err
+	}
+	return m.addThirdPartyCaveat(rootKey, caveatId, alts[0].Location, r)
+}
+
+// Alternatives returns the alternative third parties of
+// an any-of third party caveat added with
+// Macaroon.AddAnyOfThirdPartyCaveat. It returns nil
+// if the caveat is not an any-of caveat.
+func (cav Caveat) Alternatives() []Alternative {
+	if cav.Location == "" {
+		return nil
+	}
+	return decodeAlternatives([]byte(cav.Id))
+}
+
+// encodeAlternatives returns the caveat id of an
+// any-of caveat with the given alternatives.
+func encodeAlternatives(alts []Alternative) ([]byte, error) {
+	if len(alts) == 0 {
+		return nil, fmt.Errorf("no alternatives in any-of caveat")
+	}
+	size := len(anyOfPrefix) + 1
+	for i, alt := range alts {
+		if alt.Location == "" {
+			return nil, fmt.Errorf("alternative %d in any-of caveat has no location", i)
+		}
+		size += 2*binary.MaxVarintLen64 + len(alt.Location) + len(alt.Id)
+	}
+	data := make([]byte, 0, size)
+	data = append(data, anyOfPrefix...)
+	data = append(data, anyOfVersion)
+	var buf [binary.MaxVarintLen64]byte
+	for _, alt := range alts {
+		data = append(data, buf[0:binary.PutUvarint(buf[:], uint64(len(alt.Location)))]...)
+		data = append(data, alt.Location...)
+		data = append(data, buf[0:binary.PutUvarint(buf[:], uint64(len(alt.Id)))]...)
+		data = append(data, alt.Id...)
+	}
+	return data, nil
+}
+
+// decodeAlternatives returns the alternatives encoded
+// in the given third party caveat id, or nil if it
+// is not the id of an any-of caveat.
+func decodeAlternatives(caveatId []byte) []Alternative {
+	if !isAnyOf(caveatId) {
+		return nil
+	}
+	data := caveatId[len(anyOfPrefix):]
+	if len(data) < 2 || data[0] != anyOfVersion {
+		return nil
+	}
+	var alts []Alternative
+	data = data[1:]
+	for len(data) > 0 {
+		loc, rest, ok := decodeAlternativeField(data)
+		if !ok || len(loc) == 0 {
+			return nil
+		}
+		id, rest, ok := decodeAlternativeField(rest)
+		if !ok {
+			return nil
+		}
+		alts = append(alts, Alternative{
+			Location: string(loc),
+			Id:       id,
+		})
+		data = rest
+	}
+	return alts
+}
+
+// isAnyOf reports whether the given third party
+// caveat id has the prefix reserved for any-of caveats.
+func isAnyOf(caveatId []byte) bool {
+	return len(caveatId) >= len(anyOfPrefix) && string(caveatId[0:len(anyOfPrefix)]) == anyOfPrefix
+}
+
+// decodeAlternativeField decodes a length-prefixed field
+// from the start of data and returns it along with
+// the remaining data.
+func decodeAlternativeField(data []byte) (field, rest []byte, ok bool) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || size > uint64(len(data)-n) {
+		return nil, nil, false
+	}
+	data = data[n:]
+	return data[0:size], data[size:], true
+}
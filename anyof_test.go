@@ -0,0 +1,180 @@
+package macaroon_test
+
+import (
+	gc "gopkg.in/check.v1"
+
+	"github.com/rogpeppe/macaroon"
+)
+
+type anyOfSuite struct{}
+
+var _ = gc.Suite(&anyOfSuite{})
+
+var anyOfAlternatives = []macaroon.Alternative{{
+	Location: "corp-idp",
+	Id:       []byte("corp caveat"),
+}, {
+	Location: "partner-idp",
+	Id:       []byte("\x01partner caveat"),
+}}
+
+func newAnyOfMacaroon(c *gc.C, rootKey []byte, vers macaroon.Version) *macaroon.Macaroon {
+	m, err := macaroon.NewWithParams(macaroon.NewParams{
+		RootKey:  rootKey,
+		Id:       []byte("some id"),
+		Location: "a location",
+		Version:  vers,
+	})
+	c.Assert(err, gc.IsNil)
+	err = m.AddAnyOfThirdPartyCaveat([]byte("shared key"), anyOfAlternatives)
+	c.Assert(err, gc.IsNil)
+	return m
+}
+
+func (*anyOfSuite) TestAlternatives(c *gc.C) {
+	m := newAnyOfMacaroon(c, []byte("secret"), macaroon.V1)
+	err := m.AddThirdPartyCaveat([]byte("other key"), "plain caveat", "elsewhere")
+	c.Assert(err, gc.IsNil)
+	cavs := m.Caveats()
+	c.Assert(cavs, gc.HasLen, 2)
+	c.Assert(cavs[0].Location, gc.Equals, "corp-idp")
+	c.Assert(cavs[0].Alternatives(), gc.DeepEquals, anyOfAlternatives)
+	c.Assert(cavs[1].Alternatives(), gc.IsNil)
+}
+
+func (*anyOfSuite) TestVerifyWithAnyAlternative(c *gc.C) {
+	rootKey := []byte("secret")
+	for i, alt := range anyOfAlternatives {
+		c.Logf("alternative %d", i)
+		m := newAnyOfMacaroon(c, rootKey, macaroon.V1)
+		dm := boundDischarge(m, []byte("shared key"), string(alt.Id))
+		err := m.Verify(rootKey, alwaysOK, []*macaroon.Macaroon{dm})
+		c.Assert(err, gc.IsNil)
+	}
+}
+
+func (*anyOfSuite) TestVerifyTriesAlternativesInOrder(c *gc.C) {
+	// The discharge for the first alternative fails its
+	// check, so the discharge for the second is used.
+	rootKey := []byte("secret")
+	m := newAnyOfMacaroon(c, rootKey, macaroon.V1)
+	dm0 := MustNew([]byte("shared key"), "corp caveat", "")
+	err := dm0.AddFirstPartyCaveat("bad")
+	c.Assert(err, gc.IsNil)
+	dm0.Bind(m.Signature())
+	dm1 := boundDischarge(m, []byte("shared key"), "\x01partner caveat")
+	err = m.Verify(rootKey, rejectCondition("bad"), []*macaroon.Macaroon{dm0, dm1})
+	c.Assert(err, gc.IsNil)
+}
+
+func (*anyOfSuite) TestVerifyWithoutDischarge(c *gc.C) {
+	rootKey := []byte("secret")
+	m := newAnyOfMacaroon(c, rootKey, macaroon.V1)
+	dm := boundDischarge(m, []byte("shared key"), "other caveat")
+	err := m.Verify(rootKey, alwaysOK, []*macaroon.Macaroon{dm})
+	c.Assert(err, gc.ErrorMatches, `cannot find discharge macaroon for any of caveats \["corp caveat" "\\x01partner caveat"\]`)
+	c.Assert(err.(*macaroon.VerificationError).Kind, gc.Equals, macaroon.MissingDischarge)
+}
+
+func (*anyOfSuite) TestVerifyWithWrongKey(c *gc.C) {
+	rootKey := []byte("secret")
+	m := newAnyOfMacaroon(c, rootKey, macaroon.V1)
+	dm := boundDischarge(m, []byte("other key"), "corp caveat")
+	err := m.Verify(rootKey, alwaysOK, []*macaroon.Macaroon{dm})
+	c.Assert(err, gc.ErrorMatches, `signature mismatch after caveat verification`)
+}
+
+func (*anyOfSuite) TestSerializationRoundTrip(c *gc.C) {
+	for _, vers := range []macaroon.Version{macaroon.V1, macaroon.V2} {
+		c.Logf("version %v", vers)
+		rootKey := []byte("secret")
+		m := newAnyOfMacaroon(c, rootKey, vers)
+		dm := boundDischarge(m, []byte("shared key"), "\x01partner caveat")
+		str, err := macaroon.SerializeSlice(macaroon.Slice{m, dm})
+		c.Assert(err, gc.IsNil)
+		s, err := macaroon.DeserializeSlice(str)
+		c.Assert(err, gc.IsNil)
+		c.Assert(s[0].Caveats()[0].Alternatives(), gc.DeepEquals, anyOfAlternatives)
+		err = s[0].Verify(rootKey, alwaysOK, s[1:])
+		c.Assert(err, gc.IsNil)
+	}
+}
+
+var addAnyOfErrorTests = []struct {
+	about     string
+	alts      []macaroon.Alternative
+	expectErr string
+}{{
+	about:     "no alternatives",
+	expectErr: `no alternatives in any-of caveat`,
+}, {
+	about: "empty location",
+	alts: []macaroon.Alternative{{
+		Location: "somewhere",
+		Id:       []byte("id0"),
+	}, {
+		Id: []byte("id1"),
+	}},
+	expectErr: `alternative 1 in any-of caveat has no location`,
+}}
+
+func (*anyOfSuite) TestAddAnyOfError(c *gc.C) {
+	for i, test := range addAnyOfErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		m := MustNew([]byte("secret"), "some id", "a location")
+		err := m.AddAnyOfThirdPartyCaveat([]byte("shared key"), test.alts)
+		c.Assert(err, gc.ErrorMatches, test.expectErr)
+		c.Assert(m.Caveats(), gc.HasLen, 0)
+	}
+}
+
+func (*anyOfSuite) TestOrdinaryIdNotMistakenForAnyOf(c *gc.C) {
+	// This id would have been a valid any-of caveat id in an
+	// earlier encoding, with a single alternative whose id
+	// is "id".
+	caveatId := []byte("\x00\x05other\x02id")
+	rootKey := []byte("secret")
+	m := MustNew(rootKey, "some id", "a location")
+	err := m.AddThirdPartyCaveatBytes([]byte("shared key"), caveatId, "elsewhere")
+	c.Assert(err, gc.IsNil)
+	c.Assert(m.Caveats()[0].Alternatives(), gc.IsNil)
+
+	dm := MustNew([]byte("shared key"), "id", "other")
+	dm.Bind(m.Signature())
+	err = m.Verify(rootKey, alwaysOK, []*macaroon.Macaroon{dm})
+	c.Assert(err, gc.ErrorMatches, `cannot find discharge macaroon for caveat "\\x00\\x05other\\x02id"`)
+
+	dm, err = macaroon.NewWithParams(macaroon.NewParams{
+		RootKey: []byte("shared key"),
+		Id:      caveatId,
+	})
+	c.Assert(err, gc.IsNil)
+	dm.Bind(m.Signature())
+	err = m.Verify(rootKey, alwaysOK, []*macaroon.Macaroon{dm})
+	c.Assert(err, gc.IsNil)
+}
+
+func (*anyOfSuite) TestReservedPrefixRejected(c *gc.C) {
+	m := newAnyOfMacaroon(c, []byte("secret"), macaroon.V1)
+	anyOfId := m.Caveats()[0].IdBytes()
+
+	// An ordinary third party caveat cannot be made
+	// to look like an any-of caveat.
+	m = MustNew([]byte("secret"), "some id", "a location")
+	err := m.AddThirdPartyCaveatBytes([]byte("shared key"), anyOfId, "elsewhere")
+	c.Assert(err, gc.ErrorMatches, `third party caveat id has prefix reserved for any-of caveats`)
+	c.Assert(m.Caveats(), gc.HasLen, 0)
+
+	// An id with an unknown encoding version
+	// is not decoded.
+	c.Assert(macaroon.Caveat{
+		Id:       string(anyOfId),
+		Location: "elsewhere",
+	}.Alternatives(), gc.DeepEquals, anyOfAlternatives)
+	badVersion := []byte(string(anyOfId))
+	badVersion[len("\x00macaroon-any-of\x00")]++
+	c.Assert(macaroon.Caveat{
+		Id:       string(badVersion),
+		Location: "elsewhere",
+	}.Alternatives(), gc.IsNil)
+}
@@ -0,0 +1,159 @@
+package bakery
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"gopkg.in/macaroon.v1"
+)
+
+// VerificationCache remembers the results of successful
+// cryptographic verification of sets of macaroons, so that
+// Request.Check need not recalculate the signatures of a
+// long-lived macaroon and its discharges each time they
+// are presented. It is safe to use a VerificationCache
+// concurrently, and to share one between services.
+//
+// Only the signature verification is cached: the first party
+// caveats of the macaroons are checked by every call to
+// Request.Check, because their results may change over time
+// (for example, time-before caveats).
+type VerificationCache struct {
+	maxEntries int
+	ttl        time.Duration
+
+	// now returns the current time. It is
+	// replaced in tests.
+	now func() time.Time
+
+	// mu guards the fields following it.
+	mu sync.Mutex
+
+	// entries maps from cache key to the
+	// element in lru holding the entry.
+	entries map[[sha256.Size]byte]*list.Element
+
+	// lru holds all the entries, most recently
+	// used first.
+	lru *list.List
+}
+
+// cacheEntry holds an entry in a VerificationCache.
+type cacheEntry struct {
+	key [sha256.Size]byte
+
+	// conditions holds the first party caveat conditions
+	// that must be satisfied for the verification to succeed.
+	conditions []string
+
+	// expires holds the time that the entry expires.
+	expires time.Time
+}
+
+// NewVerificationCache returns a cache that holds at most
+// maxEntries verification results, each of which is
+// forgotten after the given duration.
+func NewVerificationCache(maxEntries int, ttl time.Duration) *VerificationCache {
+	return &VerificationCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		now:        time.Now,
+		entries:    make(map[[sha256.Size]byte]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Len returns the number of entries in the cache,
+// including any that have expired but have not
+// yet been removed.
+func (c *VerificationCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// get returns the conditions recorded for the given
+// key and reports whether there was an unexpired entry.
+func (c *VerificationCache) get(key [sha256.Size]byte) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[key]
+	if e == nil {
+		return nil, false
+	}
+	entry := e.Value.(*cacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.remove(e)
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return entry.conditions, true
+}
+
+// add records that the macaroons with the given key
+// verified successfully, subject to the given conditions.
+func (c *VerificationCache) add(key [sha256.Size]byte, conditions []string) {
+	if c.maxEntries <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := c.now().Add(c.ttl)
+	if e := c.entries[key]; e != nil {
+		entry := e.Value.(*cacheEntry)
+		entry.conditions = conditions
+		entry.expires = expires
+		c.lru.MoveToFront(e)
+		return
+	}
+	for c.lru.Len() >= c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{
+		key:        key,
+		conditions: conditions,
+		expires:    expires,
+	})
+}
+
+// remove removes the given element from the cache.
+// Called with c.mu held.
+func (c *VerificationCache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*cacheEntry).key)
+}
+
+// verificationCacheKey returns the cache key for the verification
+// of the primary macaroon at index primary in ms with the given root
+// key and scheme, using all of ms as discharges. It reports whether
+// a key could be made.
+//
+// The key is made from the complete binary encoding of each
+// macaroon, not just its signature: the cached result is only
+// valid for exactly the macaroons that were verified, and a
+// client could otherwise present altered caveats alongside the
+// signature of an authentic macaroon.
+func verificationCacheKey(rootKey []byte, scheme macaroon.Scheme, ms []*macaroon.Macaroon, primary int) ([sha256.Size]byte, bool) {
+	var key [sha256.Size]byte
+	h := sha256.New()
+	var buf [binary.MaxVarintLen64]byte
+	writeField := func(data []byte) {
+		h.Write(buf[0:binary.PutUvarint(buf[:], uint64(len(data)))])
+		h.Write(data)
+	}
+	writeField(rootKey)
+	writeField([]byte(scheme.String()))
+	h.Write(buf[0:binary.PutUvarint(buf[:], uint64(primary))])
+	for _, m := range ms {
+		data, err := m.MarshalBinary()
+		if err != nil {
+			return key, false
+		}
+		writeField(data)
+	}
+	h.Sum(key[:0])
+	return key, true
+}
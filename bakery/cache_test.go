@@ -0,0 +1,221 @@
+package bakery_test
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/macaroon.v1"
+
+	"github.com/rogpeppe/macaroon/bakery"
+	"github.com/rogpeppe/macaroon/bakery/checkers"
+)
+
+type CacheSuite struct{}
+
+var _ = gc.Suite(&CacheSuite{})
+
+// countingVerifier is a SignatureVerifier that counts
+// the number of times the macaroon signatures are verified.
+type countingVerifier struct {
+	macaroon.SignatureVerifier
+	count *int
+}
+
+func (v countingVerifier) Verify(m *macaroon.Macaroon, rootKey []byte) error {
+	*v.count++
+	return v.SignatureVerifier.Verify(m, rootKey)
+}
+
+func (v countingVerifier) VerifySignature(m *macaroon.Macaroon, rootKey []byte) ([]string, error) {
+	*v.count++
+	return v.SignatureVerifier.VerifySignature(m, rootKey)
+}
+
+type cacheFixture struct {
+	ts, as  *bakery.Service
+	cache   *bakery.VerificationCache
+	now     time.Time
+	count   int
+	m, dm   *macaroon.Macaroon
+	checked []string
+}
+
+func newCacheFixture(c *gc.C, maxEntries int) *cacheFixture {
+	f := &cacheFixture{
+		cache: bakery.NewVerificationCache(maxEntries, time.Minute),
+		now:   time.Now(),
+	}
+	bakery.SetCacheClock(f.cache, func() time.Time {
+		return f.now
+	})
+	asKey, err := bakery.GenerateKey()
+	c.Assert(err, gc.IsNil)
+	f.as, err = bakery.NewService(bakery.NewServiceParams{
+		Location: "as-loc",
+		Key:      asKey,
+	})
+	c.Assert(err, gc.IsNil)
+	f.ts, err = bakery.NewService(bakery.NewServiceParams{
+		Location: "ts-loc",
+		Locator: bakery.PublicKeyLocatorMap{
+			"as-loc": &asKey.Public,
+		},
+		NewVerifier: func(p macaroon.VerifierParams) macaroon.Verifier {
+			return countingVerifier{
+				SignatureVerifier: macaroon.NewVerifier(p).(macaroon.SignatureVerifier),
+				count:             &f.count,
+			}
+		},
+		VerificationCache: f.cache,
+	})
+	c.Assert(err, gc.IsNil)
+	f.m, f.dm = f.newMacaroons(c)
+	return f
+}
+
+// newMacaroons returns a new macaroon minted by the
+// target service and a discharge macaroon for it.
+func (f *cacheFixture) newMacaroons(c *gc.C) (m, dm *macaroon.Macaroon) {
+	m, err := f.ts.NewMacaroon("", nil, []bakery.Caveat{
+		checkers.FirstParty("primary-cond"),
+		checkers.ThirdParty("as-loc", "something"),
+	})
+	c.Assert(err, gc.IsNil)
+	dm, err = f.as.Discharge(bakery.ThirdPartyCheckerFunc(func(string, string) ([]bakery.Caveat, error) {
+		return []bakery.Caveat{checkers.FirstParty("discharge-cond")}, nil
+	}), m.Caveats()[1].Id)
+	c.Assert(err, gc.IsNil)
+	dm.Bind(m.Signature())
+	return m, dm
+}
+
+// check checks the given macaroons with a checker that records
+// the conditions it sees and rejects the given condition.
+func (f *cacheFixture) check(reject string, ms ...*macaroon.Macaroon) error {
+	f.checked = nil
+	req := f.ts.NewRequest(bakery.FirstPartyCheckerFunc(func(cond string) error {
+		f.checked = append(f.checked, cond)
+		if cond == reject {
+			return fmt.Errorf("%s rejected", cond)
+		}
+		return nil
+	}))
+	for _, m := range ms {
+		req.AddClientMacaroon(m)
+	}
+	return req.Check()
+}
+
+func (*CacheSuite) TestCacheAvoidsVerification(c *gc.C) {
+	f := newCacheFixture(c, 10)
+	err := f.check("", f.m, f.dm)
+	c.Assert(err, gc.IsNil)
+	c.Assert(f.count, gc.Equals, 1)
+	c.Assert(f.cache.Len(), gc.Equals, 1)
+
+	// The signatures are not verified again, but the
+	// first party caveats are checked every time.
+	for i := 0; i < 3; i++ {
+		err = f.check("", f.m, f.dm)
+		c.Assert(err, gc.IsNil)
+		c.Assert(f.count, gc.Equals, 1)
+		c.Assert(f.checked, gc.DeepEquals, []string{"primary-cond", "discharge-cond"})
+	}
+}
+
+func (*CacheSuite) TestCachedConditionFails(c *gc.C) {
+	f := newCacheFixture(c, 10)
+	err := f.check("", f.m, f.dm)
+	c.Assert(err, gc.IsNil)
+
+	// When a cached condition is rejected, the macaroons
+	// are verified in full to find the reason.
+	err = f.check("discharge-cond", f.m, f.dm)
+	c.Assert(err, gc.ErrorMatches, `verification failed: discharge-cond rejected`)
+	verr := err.(*bakery.VerificationError).Reason.(*macaroon.VerificationError)
+	c.Assert(verr.Kind, gc.Equals, macaroon.CheckFailed)
+	c.Assert(verr.DischargeIndex, gc.Equals, 1)
+	c.Assert(f.count, gc.Equals, 2)
+
+	// The entry is still in the cache.
+	err = f.check("", f.m, f.dm)
+	c.Assert(err, gc.IsNil)
+	c.Assert(f.count, gc.Equals, 2)
+}
+
+func (*CacheSuite) TestCacheExpiry(c *gc.C) {
+	f := newCacheFixture(c, 10)
+	err := f.check("", f.m, f.dm)
+	c.Assert(err, gc.IsNil)
+	c.Assert(f.count, gc.Equals, 1)
+
+	f.now = f.now.Add(59 * time.Second)
+	err = f.check("", f.m, f.dm)
+	c.Assert(err, gc.IsNil)
+	c.Assert(f.count, gc.Equals, 1)
+
+	f.now = f.now.Add(time.Second)
+	err = f.check("", f.m, f.dm)
+	c.Assert(err, gc.IsNil)
+	c.Assert(f.count, gc.Equals, 2)
+}
+
+func (*CacheSuite) TestCacheBound(c *gc.C) {
+	f := newCacheFixture(c, 2)
+	m1, dm1 := f.newMacaroons(c)
+	m2, dm2 := f.newMacaroons(c)
+	for _, ms := range [][]*macaroon.Macaroon{{f.m, f.dm}, {m1, dm1}, {m2, dm2}} {
+		err := f.check("", ms...)
+		c.Assert(err, gc.IsNil)
+	}
+	c.Assert(f.count, gc.Equals, 3)
+	c.Assert(f.cache.Len(), gc.Equals, 2)
+
+	// The least recently used entry has been evicted.
+	err := f.check("", m2, dm2)
+	c.Assert(err, gc.IsNil)
+	c.Assert(f.count, gc.Equals, 3)
+	err = f.check("", f.m, f.dm)
+	c.Assert(err, gc.IsNil)
+	c.Assert(f.count, gc.Equals, 4)
+}
+
+func (*CacheSuite) TestCacheDoesNotAcceptBadSignature(c *gc.C) {
+	f := newCacheFixture(c, 10)
+	err := f.check("", f.m, f.dm)
+	c.Assert(err, gc.IsNil)
+
+	// A discharge that is not bound to the primary
+	// macaroon has a different signature, so it
+	// is verified in full and fails.
+	dm, err := f.as.Discharge(alwaysOKThirdParty, f.m.Caveats()[1].Id)
+	c.Assert(err, gc.IsNil)
+	err = f.check("", f.m, dm)
+	c.Assert(err, gc.ErrorMatches, `verification failed: signature mismatch after caveat verification`)
+	c.Assert(f.cache.Len(), gc.Equals, 1)
+}
+
+func (*CacheSuite) TestCacheDoesNotAcceptAlteredCaveats(c *gc.C) {
+	f := newCacheFixture(c, 10)
+	err := f.check("", f.m, f.dm)
+	c.Assert(err, gc.IsNil)
+	c.Assert(f.count, gc.Equals, 1)
+
+	// A macaroon with an altered caveat but the signature of
+	// the authentic macaroon does not match the cache entry,
+	// so it is verified in full and fails.
+	data, err := f.m.MarshalJSON()
+	c.Assert(err, gc.IsNil)
+	data = bytes.Replace(data, []byte("primary-cond"), []byte("altered-cond"), 1)
+	var m macaroon.Macaroon
+	err = m.UnmarshalJSON(data)
+	c.Assert(err, gc.IsNil)
+	c.Assert(m.Signature(), gc.DeepEquals, f.m.Signature())
+
+	err = f.check("", &m, f.dm)
+	c.Assert(err, gc.ErrorMatches, `verification failed: failed to decrypt caveat 1 signature: decryption failure`)
+	c.Assert(f.count, gc.Equals, 3)
+	c.Assert(f.cache.Len(), gc.Equals, 1)
+}
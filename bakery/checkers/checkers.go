@@ -23,10 +23,30 @@ func ThirdParty(location, condition string) bakery.Caveat {
 	}
 }
 
+// Confidential returns a copy of the given first party
+// caveat with its condition marked as confidential,
+// so that the condition is encrypted in the macaroon.
+func Confidential(cav bakery.Caveat) bakery.Caveat {
+	cav.Confidential = true
+	return cav
+}
+
+// AnyOf returns a third party caveat that can be discharged
+// by the third party of any of the given third party caveats.
+func AnyOf(caveats ...bakery.Caveat) bakery.Caveat {
+	return bakery.Caveat{
+		AnyOf: caveats,
+	}
+}
+
 var Std = Map{
 	"time-before": bakery.FirstPartyCheckerFunc(timeBefore),
 }
 
+// TimeBefore returns a caveat that is satisfied only before
+// the given time. The bakery recognizes such caveats when
+// minting a macaroon, and stores its root key with a
+// corresponding expiry time.
 func TimeBefore(t time.Time) bakery.Caveat {
 	return bakery.Caveat{
 		Condition: "time-before " + t.Format(time.RFC3339),
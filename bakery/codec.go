@@ -2,10 +2,10 @@ package bakery
 
 import (
 	"bytes"
-	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 
 	"code.google.com/p/go.crypto/nacl/box"
 )
@@ -15,7 +15,9 @@ type caveatIdRecord struct {
 	Condition string
 }
 
-// caveatId defines the format of a third party caveat id.
+// caveatId defines the legacy JSON format of a third party caveat id.
+// Ids in this format are base64-encoded JSON. They are
+// still accepted by boxDecoder but are no longer created.
 type caveatId struct {
 	ThirdPartyPublicKey []byte
 	FirstPartyPublicKey []byte
@@ -23,44 +25,52 @@ type caveatId struct {
 	Id                  string
 }
 
+// The binary format of a third party caveat id is as follows:
+//
+//	version byte (caveatIdVersion)
+//	third party public key [KeyLen]byte
+//	first party public key [KeyLen]byte
+//	nonce [NonceLen]byte
+//	encrypted caveatIdRecord (the rest of the id)
+//
+// The version byte can never be the first byte
+// of a legacy base64-encoded caveat id.
+const caveatIdVersion = 1
+
+const caveatIdHeaderLen = 1 + KeyLen + KeyLen + NonceLen
+
 // boxEncoder encodes caveat ids confidentially to a third-party service using
 // authenticated public key encryption compatible with NaCl box.
 type boxEncoder struct {
 	locator PublicKeyLocator
 	key     *KeyPair
+	rand    io.Reader
 }
 
 // newBoxEncoder creates a new boxEncoder with the given public key pair and
-// third-party public key locator function.
-func newBoxEncoder(locator PublicKeyLocator, key *KeyPair) *boxEncoder {
+// third-party public key locator function. Nonces are read from r.
+func newBoxEncoder(locator PublicKeyLocator, key *KeyPair, r io.Reader) *boxEncoder {
 	return &boxEncoder{
 		key:     key,
 		locator: locator,
+		rand:    r,
 	}
 }
 
-func (enc *boxEncoder) encodeCaveatId(cav Caveat, rootKey []byte) (string, error) {
+func (enc *boxEncoder) encodeCaveatId(cav Caveat, rootKey []byte) ([]byte, error) {
 	if cav.Location == "" {
-		return "", fmt.Errorf("cannot make caveat id for first party caveat")
+		return nil, fmt.Errorf("cannot make caveat id for first party caveat")
 	}
 	thirdPartyPub, err := enc.locator.PublicKeyForLocation(cav.Location)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	id, err := enc.newCaveatId(cav, rootKey, thirdPartyPub)
-	if err != nil {
-		return "", err
-	}
-	data, err := json.Marshal(id)
-	if err != nil {
-		return "", fmt.Errorf("cannot marshal %#v: %v", id, err)
-	}
-	return base64.StdEncoding.EncodeToString(data), nil
+	return enc.newCaveatId(cav, rootKey, thirdPartyPub)
 }
 
-func (enc *boxEncoder) newCaveatId(cav Caveat, rootKey []byte, thirdPartyPub *PublicKey) (*caveatId, error) {
+func (enc *boxEncoder) newCaveatId(cav Caveat, rootKey []byte, thirdPartyPub *PublicKey) ([]byte, error) {
 	var nonce [NonceLen]byte
-	if _, err := rand.Read(nonce[:]); err != nil {
+	if _, err := io.ReadFull(enc.rand, nonce[:]); err != nil {
 		return nil, fmt.Errorf("cannot generate random number for nonce: %v", err)
 	}
 	plain := caveatIdRecord{
@@ -71,13 +81,12 @@ func (enc *boxEncoder) newCaveatId(cav Caveat, rootKey []byte, thirdPartyPub *Pu
 	if err != nil {
 		return nil, fmt.Errorf("cannot marshal %#v: %v", &plain, err)
 	}
-	sealed := box.Seal(nil, plainData, &nonce, (*[32]byte)(thirdPartyPub), (*[32]byte)(&enc.key.Private))
-	return &caveatId{
-		ThirdPartyPublicKey: thirdPartyPub[:],
-		FirstPartyPublicKey: enc.key.Public[:],
-		Nonce:               nonce[:],
-		Id:                  base64.StdEncoding.EncodeToString(sealed),
-	}, nil
+	id := make([]byte, caveatIdHeaderLen, caveatIdHeaderLen+len(plainData)+box.Overhead)
+	id[0] = caveatIdVersion
+	copy(id[1:], thirdPartyPub[:])
+	copy(id[1+KeyLen:], enc.key.Public[:])
+	copy(id[1+2*KeyLen:], nonce[:])
+	return box.Seal(id, plainData, &nonce, (*[KeyLen]byte)(thirdPartyPub), (*[KeyLen]byte)(&enc.key.Private)), nil
 }
 
 // boxDecoder decodes caveat ids for third-party service that were encoded to
@@ -94,18 +103,13 @@ func newBoxDecoder(key *KeyPair) *boxDecoder {
 	}
 }
 
-func (d *boxDecoder) decodeCaveatId(id string) (rootKey []byte, condition string, err error) {
-	data, err := base64.StdEncoding.DecodeString(id)
-	if err != nil {
-		return nil, "", fmt.Errorf("cannot base64-decode caveat id: %v", err)
-	}
-	var tpid caveatId
-	if err := json.Unmarshal(data, &tpid); err != nil {
-		return nil, "", fmt.Errorf("cannot unmarshal caveat id %q: %v", data, err)
-	}
+func (d *boxDecoder) decodeCaveatId(id []byte) (rootKey []byte, condition string, err error) {
 	var recordData []byte
-
-	recordData, err = d.encryptedCaveatId(tpid)
+	if len(id) > 0 && id[0] == caveatIdVersion {
+		recordData, err = d.decodeBinaryCaveatId(id)
+	} else {
+		recordData, err = d.decodeLegacyCaveatId(id)
+	}
 	if err != nil {
 		return nil, "", err
 	}
@@ -116,32 +120,56 @@ func (d *boxDecoder) decodeCaveatId(id string) (rootKey []byte, condition string
 	return record.RootKey, record.Condition, nil
 }
 
-func (d *boxDecoder) encryptedCaveatId(id caveatId) ([]byte, error) {
-	if d.key == nil {
-		return nil, fmt.Errorf("no public key for caveat id decryption")
+// decodeBinaryCaveatId decrypts the given binary-format
+// caveat id and returns the encoded caveatIdRecord.
+func (d *boxDecoder) decodeBinaryCaveatId(id []byte) ([]byte, error) {
+	if len(id) < caveatIdHeaderLen {
+		return nil, fmt.Errorf("caveat id too short")
 	}
-	if !bytes.Equal(d.key.Public[:], id.ThirdPartyPublicKey) {
-		return nil, fmt.Errorf("public key mismatch")
+	var nonce [NonceLen]byte
+	copy(nonce[:], id[1+2*KeyLen:])
+	return d.open(id[1:1+KeyLen], id[1+KeyLen:1+2*KeyLen], &nonce, id[caveatIdHeaderLen:])
+}
+
+// decodeLegacyCaveatId decrypts the given caveat id in the legacy
+// JSON format and returns the encoded caveatIdRecord.
+func (d *boxDecoder) decodeLegacyCaveatId(id []byte) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(string(id))
+	if err != nil {
+		return nil, fmt.Errorf("cannot base64-decode caveat id: %v", err)
+	}
+	var tpid caveatId
+	if err := json.Unmarshal(data, &tpid); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal caveat id %q: %v", data, err)
 	}
 	var nonce [NonceLen]byte
-	if len(id.Nonce) != len(nonce) {
+	if len(tpid.Nonce) != len(nonce) {
 		return nil, fmt.Errorf("bad nonce length")
 	}
-	copy(nonce[:], id.Nonce)
+	copy(nonce[:], tpid.Nonce)
+	sealed, err := base64.StdEncoding.DecodeString(tpid.Id)
+	if err != nil {
+		return nil, fmt.Errorf("cannot base64-decode encrypted caveat id: %v", err)
+	}
+	return d.open(tpid.ThirdPartyPublicKey, tpid.FirstPartyPublicKey, &nonce, sealed)
+}
 
+// open decrypts the given sealed caveat id record.
+func (d *boxDecoder) open(thirdPartyPub, firstPartyPub []byte, nonce *[NonceLen]byte, sealed []byte) ([]byte, error) {
+	if d.key == nil {
+		return nil, fmt.Errorf("no public key for caveat id decryption")
+	}
+	if !bytes.Equal(d.key.Public[:], thirdPartyPub) {
+		return nil, fmt.Errorf("public key mismatch")
+	}
 	var firstPartyPublicKey [KeyLen]byte
-	if len(id.FirstPartyPublicKey) != len(firstPartyPublicKey) {
+	if len(firstPartyPub) != len(firstPartyPublicKey) {
 		return nil, fmt.Errorf("bad public key length")
 	}
-	copy(firstPartyPublicKey[:], id.FirstPartyPublicKey)
-
-	sealed, err := base64.StdEncoding.DecodeString(id.Id)
-	if err != nil {
-		return nil, fmt.Errorf("cannot base64-decode encrypted caveat id: %v", err)
-	}
-	out, ok := box.Open(nil, sealed, &nonce, (*[KeyLen]byte)(&firstPartyPublicKey), (*[KeyLen]byte)(&d.key.Private))
+	copy(firstPartyPublicKey[:], firstPartyPub)
+	out, ok := box.Open(nil, sealed, nonce, &firstPartyPublicKey, (*[KeyLen]byte)(&d.key.Private))
 	if !ok {
-		return nil, fmt.Errorf("decryption of public-key encrypted caveat id %#v failed", id)
+		return nil, fmt.Errorf("decryption of public-key encrypted caveat id failed")
 	}
 	return out, nil
 }
@@ -10,6 +10,10 @@ import (
 // DischargeAll gathers discharge macaroons for all the third party caveats
 // in m (and any subsequent caveats required by those) using getDischarge to
 // acquire each discharge macaroon.
+//
+// For a caveat that may be discharged by any of several third parties (see
+// macaroon.Caveat.Alternatives), getDischarge is called with a caveat for
+// each alternative in turn until one of them succeeds.
 func DischargeAll(
 	m *macaroon.Macaroon,
 	getDischarge func(firstPartyLocation string, cav macaroon.Caveat) (*macaroon.Macaroon, error),
@@ -29,12 +33,47 @@ func DischargeAll(
 	for len(need) > 0 {
 		cav := need[0]
 		need = need[1:]
-		dm, err := getDischarge(firstPartyLocation, cav)
+		var dm *macaroon.Macaroon
+		var err error
+		if alts := cav.Alternatives(); alts != nil {
+			dm, err = dischargeAnyOf(firstPartyLocation, alts, getDischarge)
+		} else {
+			dm, err = getDischarge(firstPartyLocation, cav)
+			if err != nil {
+				err = errgo.NoteMask(err, fmt.Sprintf("cannot get discharge from %q", cav.Location), errgo.Any)
+			}
+		}
 		if err != nil {
-			return nil, errgo.NoteMask(err, fmt.Sprintf("cannot get discharge from %q", cav.Location), errgo.Any)
+			return nil, err
 		}
 		discharges = append(discharges, dm)
 		addCaveats(dm)
 	}
 	return discharges, nil
 }
+
+// dischargeAnyOf tries to acquire a discharge macaroon
+// from each of the given alternatives in order, returning
+// the first one obtained. If none can be obtained, the
+// error from the last alternative is returned.
+func dischargeAnyOf(
+	firstPartyLocation string,
+	alts []macaroon.Alternative,
+	getDischarge func(firstPartyLocation string, cav macaroon.Caveat) (*macaroon.Macaroon, error),
+) (*macaroon.Macaroon, error) {
+	var err error
+	locations := make([]string, len(alts))
+	for i, alt := range alts {
+		locations[i] = alt.Location
+		var dm *macaroon.Macaroon
+		dm, err = getDischarge(firstPartyLocation, macaroon.Caveat{
+			Id:       string(alt.Id),
+			Location: alt.Location,
+		})
+		if err == nil {
+			return dm, nil
+		}
+		logf("cannot get discharge from %q: %v", alt.Location, err)
+	}
+	return nil, errgo.NoteMask(err, fmt.Sprintf("cannot get discharge from any of %q", locations), errgo.Any)
+}
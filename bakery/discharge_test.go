@@ -70,3 +70,56 @@ func (*DischargeSuite) TestDischargeAllManyDischarges(c *gc.C) {
 	err = m0.Verify(rootKey, alwaysOK, ms)
 	c.Assert(err, gc.IsNil)
 }
+
+func (*DischargeSuite) TestDischargeAllAnyOf(c *gc.C) {
+	rootKey := []byte("root key")
+	m0, err := macaroon.New(rootKey, "id0", "location0")
+	c.Assert(err, gc.IsNil)
+	err = m0.AddAnyOfThirdPartyCaveat([]byte("shared key"), []macaroon.Alternative{{
+		Location: "loc1",
+		Id:       []byte("id1"),
+	}, {
+		Location: "loc2",
+		Id:       []byte("id2"),
+	}, {
+		Location: "loc3",
+		Id:       []byte("id3"),
+	}})
+	c.Assert(err, gc.IsNil)
+
+	var tried []string
+	getDischarge := func(_ string, cav macaroon.Caveat) (*macaroon.Macaroon, error) {
+		tried = append(tried, cav.Location)
+		if cav.Location == "loc1" {
+			return nil, fmt.Errorf("loc1 unavailable")
+		}
+		c.Assert(cav.Id, gc.Equals, "id2")
+		return macaroon.New([]byte("shared key"), cav.Id, "")
+	}
+	ms, err := bakery.DischargeAll(m0, getDischarge)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ms, gc.HasLen, 1)
+	c.Assert(tried, gc.DeepEquals, []string{"loc1", "loc2"})
+
+	ms[0].Bind(m0.Signature())
+	err = m0.Verify(rootKey, alwaysOK, ms)
+	c.Assert(err, gc.IsNil)
+}
+
+func (*DischargeSuite) TestDischargeAllAnyOfFails(c *gc.C) {
+	m0, err := macaroon.New([]byte("root key"), "id0", "location0")
+	c.Assert(err, gc.IsNil)
+	err = m0.AddAnyOfThirdPartyCaveat([]byte("shared key"), []macaroon.Alternative{{
+		Location: "loc1",
+		Id:       []byte("id1"),
+	}, {
+		Location: "loc2",
+		Id:       []byte("id2"),
+	}})
+	c.Assert(err, gc.IsNil)
+	getDischarge := func(_ string, cav macaroon.Caveat) (*macaroon.Macaroon, error) {
+		return nil, fmt.Errorf("%s unavailable", cav.Location)
+	}
+	_, err = bakery.DischargeAll(m0, getDischarge)
+	c.Assert(err, gc.ErrorMatches, `cannot get discharge from any of \["loc1" "loc2"\]: loc2 unavailable`)
+}
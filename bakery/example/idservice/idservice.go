@@ -1,7 +1,6 @@
 package idservice
 
 import (
-	"encoding/base64"
 	"fmt"
 	"html/template"
 	"log"
@@ -189,14 +188,14 @@ func (h *handler) loginAttemptHandler(w http.ResponseWriter, req *http.Request)
 }
 
 func addMacaroonAsCookie(w http.ResponseWriter, m *macaroon.Macaroon) error {
-	data, err := m.MarshalJSON()
+	value, err := macaroon.Serialize(m)
 	if err != nil {
 		return err
 	}
 	http.SetCookie(w, &http.Cookie{
 		Path:  "/",
 		Name:  fmt.Sprintf("macaroon-%x", m.Signature()),
-		Value: base64.StdEncoding.EncodeToString(data),
+		Value: value,
 		// TODO(rog) other fields
 	})
 	return nil
@@ -243,7 +242,7 @@ func (h *handler) needLogin(cavId string, caveat string, why string) error {
 	// we should perhaps just return an error here.
 	log.Printf("login required")
 	waitId, err := h.place.NewRendezvous(&thirdPartyCaveatInfo{
-		CaveatId: cavId,
+		CaveatId: []byte(cavId),
 		Caveat:   caveat,
 	})
 	if err != nil {
@@ -287,7 +286,7 @@ func (h *handler) waitHandler(_ http.Header, req *http.Request) (interface{}, er
 	}
 	// Now that we've verified the user, we can check again to see
 	// if we can discharge the original caveat.
-	macaroon, err := h.svc.Discharge(ctxt, caveat.CaveatId)
+	macaroon, err := h.svc.Discharge(ctxt, string(caveat.CaveatId))
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
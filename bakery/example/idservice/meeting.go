@@ -8,7 +8,9 @@ import (
 )
 
 type thirdPartyCaveatInfo struct {
-	CaveatId string
+	// CaveatId holds the caveat id, which
+	// may not be valid UTF-8.
+	CaveatId []byte
 	Caveat   string
 }
 
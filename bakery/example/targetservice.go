@@ -118,7 +118,7 @@ func (srv *targetServiceHandler) writeError(w http.ResponseWriter, operation str
 		http.Error(w, fmt.Sprintf(msg, args...), code)
 	}
 
-	if _, ok := verr.(*bakery.VerificationError); !ok {
+	if !httpbakery.ShouldMintMacaroon(verr) {
 		fail(http.StatusForbidden, "%v", verr)
 		return
 	}
@@ -0,0 +1,15 @@
+package bakery
+
+import "time"
+
+// SetCacheClock sets the function used by c
+// to find the current time.
+func SetCacheClock(c *VerificationCache, now func() time.Time) {
+	c.now = now
+}
+
+// SetServiceClock sets the function used by svc
+// to find the current time.
+func SetServiceClock(svc *Service, now func() time.Time) {
+	svc.now = now
+}
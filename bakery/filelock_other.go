@@ -0,0 +1,19 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package bakery
+
+import "os"
+
+// lockFile does nothing on this platform, so
+// updates are only serialized within a process
+// and a file storage directory must not be shared
+// between processes (see NewFileStorage).
+func lockFile(f *os.File) error {
+	return nil
+}
+
+// unlockFile does nothing on this platform.
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,276 @@
+package bakery
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileStorage is the Storage implementation returned
+// by NewFileStorage.
+//
+// Each item is stored in its own file in the directory, named
+// by the hex-encoded SHA-256 hash of its location, so that
+// any location, including binary ones, can be used. The file
+// holds the location as well as the item, so that
+// the mapping can be checked.
+//
+// Files are written to a temporary file first, then renamed
+// into place, so that a reader never sees a partially written
+// item and a crash leaves either the old or the new item
+// in place.
+type fileStorage struct {
+	dir string
+
+	// mu serializes updates within the process. Updates
+	// from other processes are serialized by the lock file
+	// on systems that support it (see filelock_unix.go).
+	mu sync.Mutex
+}
+
+// fileItem is the format of an item file. The location
+// and item are held as byte slices so that they are
+// base64-encoded and survive JSON encoding even
+// when they are not valid UTF-8.
+type fileItem struct {
+	Location []byte
+	Item     []byte
+	Expiry   *time.Time `json:",omitempty"`
+}
+
+const (
+	// lockFileName holds the name of the lock file
+	// in the storage directory.
+	lockFileName = ".lock"
+
+	// tempFilePrefix holds the prefix of the names of
+	// temporary files in the storage directory.
+	tempFilePrefix = ".tmp-"
+
+	// staleTempFileAge holds the age after which a temporary
+	// file is assumed to have been left behind by a crash.
+	staleTempFileAge = time.Hour
+)
+
+// NewFileStorage returns an implementation of Storage that stores
+// each item in a file in the given directory, creating the
+// directory if it does not exist. Items survive restarts of
+// the process.
+//
+// On Unix-like systems, updates are serialized with a lock
+// file, so the directory may be shared between processes on
+// the same host. On other systems, updates are only serialized
+// within a process, so the directory must not be shared.
+//
+// Expired items are only removed when RemoveExpired is called.
+func NewFileStorage(dir string) (ExpiryStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create storage directory: %v", err)
+	}
+	return &fileStorage{
+		dir: dir,
+	}, nil
+}
+
+// path returns the path of the file holding
+// the item at the given location.
+func (s *fileStorage) path(location string) string {
+	sum := sha256.Sum256([]byte(location))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+func (s *fileStorage) Put(location, item string) error {
+	return s.put(location, item, nil)
+}
+
+func (s *fileStorage) PutWithExpiry(location, item string, expiry time.Time) error {
+	return s.put(location, item, &expiry)
+}
+
+func (s *fileStorage) put(location, item string, expiry *time.Time) error {
+	logf("storage.Put[%q] %q (expiry %v)", location, item, expiry)
+	data, err := json.Marshal(fileItem{
+		Location: []byte(location),
+		Item:     []byte(item),
+		Expiry:   expiry,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot marshal item: %v", err)
+	}
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.writeFile(s.path(location), data)
+}
+
+// writeFile atomically replaces the file at the given path
+// with one holding the given data. It does not return until
+// the data has been written to stable storage.
+func (s *fileStorage) writeFile(path string, data []byte) error {
+	f, err := ioutil.TempFile(s.dir, tempFilePrefix)
+	if err != nil {
+		return fmt.Errorf("cannot create temporary file: %v", err)
+	}
+	tempPath := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("cannot write item: %v", err)
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("cannot write item: %v", err)
+	}
+	return s.syncDir()
+}
+
+// syncDir flushes the storage directory to stable storage,
+// so that a rename or removal in it survives a crash.
+func (s *fileStorage) syncDir() error {
+	d, err := os.Open(s.dir)
+	if err != nil {
+		return fmt.Errorf("cannot open storage directory: %v", err)
+	}
+	defer d.Close()
+	// Some platforms do not support syncing directories,
+	// so ignore any error.
+	d.Sync()
+	return nil
+}
+
+func (s *fileStorage) Get(location string) (string, error) {
+	item, err := s.readFile(s.path(location))
+	if err != nil {
+		return "", err
+	}
+	if string(item.Location) != location || item.expired(time.Now()) {
+		logf("storage.Get[%q] -> not found", location)
+		return "", ErrNotFound
+	}
+	logf("storage.Get[%q] -> %q", location, item.Item)
+	return string(item.Item), nil
+}
+
+// readFile reads the item file at the given path. It returns
+// ErrNotFound if the file does not exist.
+func (s *fileStorage) readFile(path string) (*fileItem, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read item: %v", err)
+	}
+	var item fileItem
+	if err := json.Unmarshal(data, &item); err != nil {
+		return nil, fmt.Errorf("badly formatted item file %q: %v", path, err)
+	}
+	return &item, nil
+}
+
+// expired reports whether the item has expired at the given time.
+func (item *fileItem) expired(now time.Time) bool {
+	return item.Expiry != nil && !now.Before(*item.Expiry)
+}
+
+func (s *fileStorage) Del(location string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := os.Remove(s.path(location)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot delete item: %v", err)
+	}
+	return s.syncDir()
+}
+
+// RemoveExpired implements ExpiryStorage.RemoveExpired. It also
+// removes any temporary files left behind by a crash.
+//
+// Item files that cannot be read or are badly formatted are
+// logged and left in place. If an expired item cannot be
+// removed, the other items are still checked and the first
+// such error is returned.
+func (s *fileStorage) RemoveExpired(now time.Time) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("cannot read storage directory: %v", err)
+	}
+	var removeErr error
+	for _, info := range infos {
+		name := info.Name()
+		path := filepath.Join(s.dir, name)
+		if strings.HasPrefix(name, tempFilePrefix) {
+			if now.Sub(info.ModTime()) > staleTempFileAge {
+				os.Remove(path)
+			}
+			continue
+		}
+		if len(name) != 2*sha256.Size {
+			continue
+		}
+		item, err := s.readFile(path)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			// Leave the file alone, so that it can be
+			// inspected, and carry on with the other items.
+			log.Printf("warning: cannot check item for expiry: %v", err)
+			continue
+		}
+		if item.expired(now) {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) && removeErr == nil {
+				removeErr = fmt.Errorf("cannot delete item: %v", err)
+			}
+		}
+	}
+	if err := s.syncDir(); err != nil {
+		return err
+	}
+	return removeErr
+}
+
+// lock acquires the storage lock, which excludes updates
+// by other goroutines and other processes, and returns
+// a function that releases it.
+func (s *fileStorage) lock() (unlock func(), err error) {
+	s.mu.Lock()
+	f, err := os.OpenFile(filepath.Join(s.dir, lockFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("cannot open lock file: %v", err)
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		s.mu.Unlock()
+		return nil, fmt.Errorf("cannot lock storage: %v", err)
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+		s.mu.Unlock()
+	}, nil
+}
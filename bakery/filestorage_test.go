@@ -0,0 +1,171 @@
+package bakery_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/rogpeppe/macaroon/bakery"
+)
+
+type FileStorageSuite struct{}
+
+var _ = gc.Suite(&FileStorageSuite{})
+
+func (*FileStorageSuite) newStorage(c *gc.C, dir string) bakery.ExpiryStorage {
+	store, err := bakery.NewFileStorage(dir)
+	c.Assert(err, gc.IsNil)
+	return store
+}
+
+func (s *FileStorageSuite) TestFileStorage(c *gc.C) {
+	testStorage(c, s.newStorage(c, c.MkDir()))
+}
+
+func (s *FileStorageSuite) TestConcurrentFileStorage(c *gc.C) {
+	testConcurrentStorage(c, s.newStorage(c, c.MkDir()))
+}
+
+func (s *FileStorageSuite) TestFileStorageExpiry(c *gc.C) {
+	testStorageExpiry(c, s.newStorage(c, c.MkDir()))
+}
+
+func (s *FileStorageSuite) TestCreatesDirectory(c *gc.C) {
+	dir := filepath.Join(c.MkDir(), "a", "b")
+	store := s.newStorage(c, dir)
+	err := store.Put("foo", "bar")
+	c.Assert(err, gc.IsNil)
+	item, err := store.Get("foo")
+	c.Assert(err, gc.IsNil)
+	c.Assert(item, gc.Equals, "bar")
+}
+
+func (s *FileStorageSuite) TestItemsSurviveReopen(c *gc.C) {
+	dir := c.MkDir()
+	store := s.newStorage(c, dir)
+	err := store.Put("foo", "bar")
+	c.Assert(err, gc.IsNil)
+	err = store.PutWithExpiry("old", "x", time.Now().Add(-time.Second))
+	c.Assert(err, gc.IsNil)
+
+	store = s.newStorage(c, dir)
+	item, err := store.Get("foo")
+	c.Assert(err, gc.IsNil)
+	c.Assert(item, gc.Equals, "bar")
+	_, err = store.Get("old")
+	c.Assert(err, gc.Equals, bakery.ErrNotFound)
+}
+
+func (s *FileStorageSuite) TestSharedDirectory(c *gc.C) {
+	dir := c.MkDir()
+	store0 := s.newStorage(c, dir)
+	store1 := s.newStorage(c, dir)
+	err := store0.Put("foo", "bar")
+	c.Assert(err, gc.IsNil)
+	item, err := store1.Get("foo")
+	c.Assert(err, gc.IsNil)
+	c.Assert(item, gc.Equals, "bar")
+
+	err = store1.Del("foo")
+	c.Assert(err, gc.IsNil)
+	_, err = store0.Get("foo")
+	c.Assert(err, gc.Equals, bakery.ErrNotFound)
+}
+
+var awkwardLocations = []string{
+	"",
+	".",
+	"..",
+	"../foo",
+	"a/b",
+	".lock",
+	"\x00\xff binary \n",
+	string(make([]byte, 1000)),
+}
+
+func (s *FileStorageSuite) TestAwkwardLocations(c *gc.C) {
+	dir := c.MkDir()
+	store := s.newStorage(c, dir)
+	for i, loc := range awkwardLocations {
+		err := store.Put(loc, awkwardLocations[(i+1)%len(awkwardLocations)])
+		c.Assert(err, gc.IsNil, gc.Commentf("location %q", loc))
+	}
+	for i, loc := range awkwardLocations {
+		item, err := store.Get(loc)
+		c.Assert(err, gc.IsNil, gc.Commentf("location %q", loc))
+		c.Assert(item, gc.Equals, awkwardLocations[(i+1)%len(awkwardLocations)])
+	}
+	// All the items are in the storage directory itself.
+	infos, err := ioutil.ReadDir(filepath.Dir(dir))
+	c.Assert(err, gc.IsNil)
+	c.Assert(infos, gc.HasLen, 1)
+}
+
+func (s *FileStorageSuite) TestNoTemporaryFilesLeft(c *gc.C) {
+	dir := c.MkDir()
+	store := s.newStorage(c, dir)
+	err := store.Put("foo", "bar")
+	c.Assert(err, gc.IsNil)
+	err = store.Put("foo", "baz")
+	c.Assert(err, gc.IsNil)
+	err = store.Put("bletch", "blat")
+	c.Assert(err, gc.IsNil)
+	err = store.Del("bletch")
+	c.Assert(err, gc.IsNil)
+
+	infos, err := ioutil.ReadDir(dir)
+	c.Assert(err, gc.IsNil)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	// Only the lock file and the item remain.
+	c.Assert(names, gc.HasLen, 2, gc.Commentf("names %q", names))
+}
+
+func (s *FileStorageSuite) TestRemoveExpiredRemovesStaleTemporaryFiles(c *gc.C) {
+	dir := c.MkDir()
+	store := s.newStorage(c, dir)
+	err := ioutil.WriteFile(filepath.Join(dir, ".tmp-123"), []byte("partial"), 0600)
+	c.Assert(err, gc.IsNil)
+
+	err = store.RemoveExpired(time.Now())
+	c.Assert(err, gc.IsNil)
+	_, err = ioutil.ReadFile(filepath.Join(dir, ".tmp-123"))
+	c.Assert(err, gc.IsNil)
+
+	err = store.RemoveExpired(time.Now().Add(2 * time.Hour))
+	c.Assert(err, gc.IsNil)
+	_, err = ioutil.ReadFile(filepath.Join(dir, ".tmp-123"))
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *FileStorageSuite) TestRemoveExpiredSkipsBadItemFiles(c *gc.C) {
+	dir := c.MkDir()
+	store := s.newStorage(c, dir)
+	now := time.Now()
+	err := store.PutWithExpiry("foo", "bar", now)
+	c.Assert(err, gc.IsNil)
+	err = store.Put("bletch", "blat")
+	c.Assert(err, gc.IsNil)
+
+	// A corrupt item file does not prevent the other
+	// items from being checked, and is left in place.
+	badPath := filepath.Join(dir, strings.Repeat("0", 64))
+	err = ioutil.WriteFile(badPath, []byte("not json"), 0600)
+	c.Assert(err, gc.IsNil)
+
+	err = store.RemoveExpired(now)
+	c.Assert(err, gc.IsNil)
+	_, err = store.Get("foo")
+	c.Assert(err, gc.Equals, bakery.ErrNotFound)
+	item, err := store.Get("bletch")
+	c.Assert(err, gc.IsNil)
+	c.Assert(item, gc.Equals, "blat")
+	data, err := ioutil.ReadFile(badPath)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, "not json")
+}
@@ -3,6 +3,7 @@ package bakery
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"io"
 	"strings"
 	"sync"
 
@@ -53,8 +54,14 @@ type KeyPair struct {
 
 // GenerateKey generates a new key pair.
 func GenerateKey() (*KeyPair, error) {
+	return generateKey(rand.Reader)
+}
+
+// generateKey is like GenerateKey except that
+// it reads random bytes from r.
+func generateKey(r io.Reader) (*KeyPair, error) {
 	var key KeyPair
-	pub, priv, err := box.GenerateKey(rand.Reader)
+	pub, priv, err := box.GenerateKey(r)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,195 @@
+package bakery
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// RootKeyPolicy holds the policy for the shared root keys of a
+// service that uses them. See NewServiceParams.RootKeyPolicy.
+type RootKeyPolicy struct {
+	// GenerateInterval holds the length of time for which a
+	// root key is used to mint new macaroons before a new
+	// one is generated.
+	GenerateInterval time.Duration
+
+	// MaxAge holds the length of time after its creation that
+	// a root key is retired. Macaroons minted with a retired
+	// key no longer verify. It must be longer than
+	// GenerateInterval.
+	MaxAge time.Duration
+}
+
+const (
+	// rootKeyLocationPrefix holds the prefix of the
+	// storage location of a shared root key. The rest
+	// of the location holds the key's id.
+	rootKeyLocationPrefix = "root-key-"
+
+	// currentRootKeyLocation holds the storage location
+	// of the reference to the shared root key currently
+	// used to mint new macaroons.
+	currentRootKeyLocation = "root-key-current"
+)
+
+// rootKeyMacaroonId matches the id of a macaroon minted with
+// a shared root key, which holds the hex-encoded root key id
+// followed by a hyphen and a hex-encoded random nonce.
+var rootKeyMacaroonId = regexp.MustCompile(`^([0-9a-f]{16})-[0-9a-f]+$`)
+
+// rootKeys manages the shared root keys of a service.
+//
+// The keys are held in the service's store, so that services
+// sharing a store can share root keys: when the current key
+// is due to be replaced, a service first checks whether
+// another service has already replaced it. If two services
+// replace it at once, both keys remain valid.
+type rootKeys struct {
+	policy RootKeyPolicy
+	store  storage
+	rand   io.Reader
+
+	// mu guards the field following it.
+	mu sync.Mutex
+
+	// current holds the key currently used to mint
+	// new macaroons, or nil if there is none.
+	current *rootKey
+}
+
+// rootKey holds a shared root key.
+type rootKey struct {
+	id      string
+	rootKey []byte
+	created time.Time
+}
+
+// rootKeyRef is the format of the item held at
+// currentRootKeyLocation.
+type rootKeyRef struct {
+	Id      string
+	Created time.Time
+}
+
+// newMacaroonId returns a new macaroon id and the root key
+// that should be used to mint the macaroon at the given time.
+func (k *rootKeys) newMacaroonId(now time.Time) (id string, rootKey []byte, err error) {
+	key, err := k.currentKey(now)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce, err := randomBytes(k.rand, 12)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot generate id for new macaroon: %v", err)
+	}
+	return fmt.Sprintf("%s-%x", key.id, nonce), key.rootKey, nil
+}
+
+// currentKey returns the key that should be used
+// to mint new macaroons at the given time.
+func (k *rootKeys) currentKey(now time.Time) (*rootKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.current != nil && k.usable(k.current, now) {
+		return k.current, nil
+	}
+	// Another service sharing the store may already
+	// have generated a new key.
+	if key := k.storedCurrentKey(now); key != nil {
+		k.current = key
+		return key, nil
+	}
+	key, err := k.generate(now)
+	if err != nil {
+		return nil, err
+	}
+	k.current = key
+	return key, nil
+}
+
+// usable reports whether the given key may
+// be used to mint new macaroons at the given time.
+func (k *rootKeys) usable(key *rootKey, now time.Time) bool {
+	return !now.Before(key.created) && now.Sub(key.created) < k.policy.GenerateInterval
+}
+
+// storedCurrentKey returns the current key recorded in the
+// store, or nil if there is none that can be used at the
+// given time.
+func (k *rootKeys) storedCurrentKey(now time.Time) *rootKey {
+	data, err := k.store.store.Get(currentRootKeyLocation)
+	if err != nil {
+		return nil
+	}
+	var ref rootKeyRef
+	if err := json.Unmarshal([]byte(data), &ref); err != nil {
+		logf("badly formatted current root key reference: %v", err)
+		return nil
+	}
+	item, err := k.store.Get(rootKeyLocationPrefix + ref.Id)
+	if err != nil {
+		return nil
+	}
+	key := &rootKey{
+		id:      ref.Id,
+		rootKey: item.RootKey,
+		created: ref.Created,
+	}
+	if !k.usable(key, now) {
+		return nil
+	}
+	return key
+}
+
+// generate generates a new root key, created at
+// the given time, and makes it the current key
+// in the store.
+func (k *rootKeys) generate(now time.Time) (*rootKey, error) {
+	idBytes, err := randomBytes(k.rand, 8)
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate root key id: %v", err)
+	}
+	rootKeyBytes, err := randomBytes(k.rand, 24)
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate root key: %v", err)
+	}
+	key := &rootKey{
+		id:      hex.EncodeToString(idBytes),
+		rootKey: rootKeyBytes,
+		created: now,
+	}
+	expiry := now.Add(k.policy.MaxAge)
+	if err := k.store.Put(rootKeyLocationPrefix+key.id, &storageItem{
+		RootKey: key.rootKey,
+		Expiry:  &expiry,
+	}); err != nil {
+		return nil, fmt.Errorf("cannot save root key: %v", err)
+	}
+	data, err := json.Marshal(rootKeyRef{
+		Id:      key.id,
+		Created: key.created,
+	})
+	if err != nil {
+		panic(fmt.Errorf("cannot marshal root key reference: %v", err))
+	}
+	if err := k.store.store.Put(currentRootKeyLocation, string(data)); err != nil {
+		return nil, fmt.Errorf("cannot save current root key: %v", err)
+	}
+	return key, nil
+}
+
+// rootKeyLocation returns the storage location of the shared
+// root key of the macaroon with the given id, and reports
+// whether the macaroon was minted with a shared root key.
+func rootKeyLocation(macaroonId string) (string, bool) {
+	m := rootKeyMacaroonId.FindStringSubmatch(macaroonId)
+	if m == nil {
+		return "", false
+	}
+	return rootKeyLocationPrefix + m[1], true
+}
@@ -0,0 +1,243 @@
+package bakery_test
+
+import (
+	"strings"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/macaroon.v1"
+
+	"github.com/rogpeppe/macaroon/bakery"
+	"github.com/rogpeppe/macaroon/bakery/checkers"
+)
+
+type RootKeySuite struct{}
+
+var _ = gc.Suite(&RootKeySuite{})
+
+var testRootKeyPolicy = bakery.RootKeyPolicy{
+	GenerateInterval: time.Hour,
+	MaxAge:           24 * time.Hour,
+}
+
+// newRootKeyService returns a service using testRootKeyPolicy
+// with the given store and a clock that returns *now.
+func newRootKeyService(c *gc.C, store bakery.Storage, now *time.Time) *bakery.Service {
+	policy := testRootKeyPolicy
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location:      "loc",
+		Store:         store,
+		RootKeyPolicy: &policy,
+	})
+	c.Assert(err, gc.IsNil)
+	bakery.SetServiceClock(svc, func() time.Time {
+		return *now
+	})
+	return svc
+}
+
+func checkMacaroon(svc *bakery.Service, m *macaroon.Macaroon) error {
+	req := svc.NewRequest(bakery.FirstPartyCheckerFunc(alwaysOK))
+	req.AddClientMacaroon(m)
+	return req.Check()
+}
+
+// rootKeyId returns the root key id encoded in
+// the id of a macaroon minted with a shared root key.
+func rootKeyId(c *gc.C, m *macaroon.Macaroon) string {
+	i := strings.Index(m.Id(), "-")
+	c.Assert(i, gc.Equals, 16, gc.Commentf("id %q", m.Id()))
+	return m.Id()[0:i]
+}
+
+func (*RootKeySuite) TestSharedRootKey(c *gc.C) {
+	store := bakery.NewMemStorage()
+	now := time.Now()
+	svc := newRootKeyService(c, store, &now)
+	m0, err := svc.NewMacaroon("", nil, nil)
+	c.Assert(err, gc.IsNil)
+	m1, err := svc.NewMacaroon("", nil, []bakery.Caveat{
+		checkers.FirstParty("something"),
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(m0.Id(), gc.Not(gc.Equals), m1.Id())
+	c.Assert(rootKeyId(c, m0), gc.Equals, rootKeyId(c, m1))
+
+	// The macaroons themselves are not stored.
+	_, err = store.Get(m0.Id())
+	c.Assert(err, gc.Equals, bakery.ErrNotFound)
+
+	c.Assert(checkMacaroon(svc, m0), gc.IsNil)
+	c.Assert(checkMacaroon(svc, m1), gc.IsNil)
+}
+
+func (*RootKeySuite) TestRootKeyRotation(c *gc.C) {
+	now := time.Now()
+	svc := newRootKeyService(c, bakery.NewMemStorage(), &now)
+	m0, err := svc.NewMacaroon("", nil, nil)
+	c.Assert(err, gc.IsNil)
+
+	now = now.Add(30 * time.Minute)
+	m1, err := svc.NewMacaroon("", nil, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rootKeyId(c, m1), gc.Equals, rootKeyId(c, m0))
+
+	// After the generate interval, a new key is used
+	// but the old one still verifies.
+	now = now.Add(time.Hour)
+	m2, err := svc.NewMacaroon("", nil, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rootKeyId(c, m2), gc.Not(gc.Equals), rootKeyId(c, m0))
+	c.Assert(checkMacaroon(svc, m0), gc.IsNil)
+	c.Assert(checkMacaroon(svc, m2), gc.IsNil)
+
+	// After the maximum age, the old key is retired
+	// even though the store has not removed it.
+	now = now.Add(23 * time.Hour)
+	err = checkMacaroon(svc, m0)
+	c.Assert(err, gc.FitsTypeOf, (*bakery.VerificationError)(nil))
+	c.Assert(checkMacaroon(svc, m2), gc.IsNil)
+}
+
+func (*RootKeySuite) TestSharedBetweenServices(c *gc.C) {
+	store := bakery.NewMemStorage()
+	now := time.Now()
+	svc0 := newRootKeyService(c, store, &now)
+	svc1 := newRootKeyService(c, store, &now)
+	m0, err := svc0.NewMacaroon("", nil, nil)
+	c.Assert(err, gc.IsNil)
+	m1, err := svc1.NewMacaroon("", nil, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rootKeyId(c, m1), gc.Equals, rootKeyId(c, m0))
+	c.Assert(checkMacaroon(svc1, m0), gc.IsNil)
+	c.Assert(checkMacaroon(svc0, m1), gc.IsNil)
+
+	// When the key is due to be replaced, the first
+	// service to notice replaces it for both.
+	now = now.Add(2 * time.Hour)
+	m0, err = svc0.NewMacaroon("", nil, nil)
+	c.Assert(err, gc.IsNil)
+	m1, err = svc1.NewMacaroon("", nil, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rootKeyId(c, m1), gc.Equals, rootKeyId(c, m0))
+}
+
+func (*RootKeySuite) TestExplicitIdUsesOwnRootKey(c *gc.C) {
+	store := bakery.NewMemStorage()
+	now := time.Now()
+	svc := newRootKeyService(c, store, &now)
+	m, err := svc.NewMacaroon("explicit", nil, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(m.Id(), gc.Equals, "explicit")
+	_, err = store.Get("explicit")
+	c.Assert(err, gc.IsNil)
+	c.Assert(checkMacaroon(svc, m), gc.IsNil)
+}
+
+func (*RootKeySuite) TestDischargeNotStored(c *gc.C) {
+	asStore := bakery.NewMemStorage()
+	now := time.Now()
+	as := newRootKeyService(c, asStore, &now)
+	ts, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "ts-loc",
+		Locator: bakery.PublicKeyLocatorMap{
+			"as-loc": as.PublicKey(),
+		},
+		RootKeyPolicy: &testRootKeyPolicy,
+	})
+	c.Assert(err, gc.IsNil)
+	m, err := ts.NewMacaroon("", nil, []bakery.Caveat{
+		checkers.ThirdParty("as-loc", "something"),
+	})
+	c.Assert(err, gc.IsNil)
+	dm, err := as.Discharge(bakery.ThirdPartyCheckerFunc(func(_, _ string) ([]bakery.Caveat, error) {
+		return []bakery.Caveat{
+			checkers.Confidential(checkers.FirstParty("secret")),
+		}, nil
+	}), m.Caveats()[0].Id)
+	c.Assert(err, gc.IsNil)
+	_, err = asStore.Get(dm.Id())
+	c.Assert(err, gc.Equals, bakery.ErrNotFound)
+	dm.Bind(m.Signature())
+
+	req := ts.NewRequest(bakery.FirstPartyCheckerFunc(alwaysOK))
+	req.AddClientMacaroon(m)
+	req.AddClientMacaroon(dm)
+	err = req.Check()
+	c.Assert(err, gc.IsNil)
+}
+
+func (*RootKeySuite) TestConfidentialCaveat(c *gc.C) {
+	now := time.Now()
+	svc := newRootKeyService(c, bakery.NewMemStorage(), &now)
+	m, err := svc.NewMacaroon("", nil, []bakery.Caveat{
+		checkers.Confidential(checkers.FirstParty("secret0")),
+	})
+	c.Assert(err, gc.IsNil)
+	// The root key of a macaroon minted with a shared
+	// root key is found for caveats added later.
+	err = svc.AddCaveat(m, checkers.Confidential(checkers.FirstParty("secret1")))
+	c.Assert(err, gc.IsNil)
+
+	var checked []string
+	req := svc.NewRequest(bakery.FirstPartyCheckerFunc(func(cond string) error {
+		checked = append(checked, cond)
+		return nil
+	}))
+	req.AddClientMacaroon(m)
+	err = req.Check()
+	c.Assert(err, gc.IsNil)
+	c.Assert(checked, gc.DeepEquals, []string{"secret0", "secret1"})
+}
+
+func (*RootKeySuite) TestInvalidPolicy(c *gc.C) {
+	_, err := bakery.NewService(bakery.NewServiceParams{
+		RootKeyPolicy: &bakery.RootKeyPolicy{},
+	})
+	c.Assert(err, gc.ErrorMatches, `root key generate interval must be positive`)
+	_, err = bakery.NewService(bakery.NewServiceParams{
+		RootKeyPolicy: &bakery.RootKeyPolicy{
+			GenerateInterval: time.Hour,
+			MaxAge:           time.Hour,
+		},
+	})
+	c.Assert(err, gc.ErrorMatches, `root key maximum age must be longer than generate interval`)
+}
+
+func (*RootKeySuite) TestForgedRootKeyReference(c *gc.C) {
+	now := time.Now()
+	svc := newRootKeyService(c, bakery.NewMemStorage(), &now)
+	// Mint a macaroon so that the current root key
+	// reference is in the store.
+	_, err := svc.NewMacaroon("", nil, nil)
+	c.Assert(err, gc.IsNil)
+
+	// A macaroon whose id names the reference, and so would be
+	// verified with a nil root key, must not be accepted.
+	m, err := macaroon.New(nil, "root-key-current", "loc")
+	c.Assert(err, gc.IsNil)
+	err = checkMacaroon(svc, m)
+	c.Assert(err, gc.FitsTypeOf, (*bakery.VerificationError)(nil))
+}
+
+func (*RootKeySuite) TestReservedIdPrefix(c *gc.C) {
+	svc, err := bakery.NewService(bakery.NewServiceParams{})
+	c.Assert(err, gc.IsNil)
+	_, err = svc.NewMacaroon("root-key-foo", nil, nil)
+	c.Assert(err, gc.ErrorMatches, `cannot mint macaroon with reserved id "root-key-foo"`)
+}
+
+func (*RootKeySuite) TestItemWithoutRootKeyIgnored(c *gc.C) {
+	store := bakery.NewMemStorage()
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "loc",
+		Store:    store,
+	})
+	c.Assert(err, gc.IsNil)
+	err = store.Put("noroot", "{}")
+	c.Assert(err, gc.IsNil)
+	m, err := macaroon.New(nil, "noroot", "loc")
+	c.Assert(err, gc.IsNil)
+	err = checkMacaroon(svc, m)
+	c.Assert(err, gc.FitsTypeOf, (*bakery.VerificationError)(nil))
+}
@@ -7,8 +7,11 @@ package bakery
 import (
 	"crypto/rand"
 	"fmt"
+	"io"
 	"log"
+	"strings"
 	"sync"
+	"time"
 
 	"gopkg.in/macaroon.v1"
 )
@@ -28,6 +31,18 @@ type Service struct {
 	store    storage
 	checker  FirstPartyChecker
 	encoder  *boxEncoder
+	version  macaroon.Version
+	scheme   macaroon.Scheme
+	rand     io.Reader
+	cache    *VerificationCache
+	limits   macaroon.DecodeLimits
+	rootKeys *rootKeys
+
+	// now returns the current time. It is
+	// replaced in tests.
+	now func() time.Time
+
+	newVerifier func(macaroon.VerifierParams) macaroon.Verifier
 }
 
 // NewServiceParams holds the parameters for a NewService call.
@@ -49,6 +64,70 @@ type NewServiceParams struct {
 	// adding a third-party caveat.
 	// It may be nil, in which case, no third-party caveats can be created.
 	Locator PublicKeyLocator
+
+	// Version holds the binary format version of macaroons
+	// minted by the service. Third party caveat ids are
+	// large, so services that add many third party caveats
+	// may wish to use macaroon.V2.
+	Version macaroon.Version
+
+	// Scheme holds the signature scheme of macaroons minted
+	// by the service. Request.Check verifies all macaroons
+	// sent by clients with it, without changing them; a
+	// macaroon decoded from an encoding that names another
+	// scheme fails to verify. The discharge
+	// macaroons are verified with the same scheme, so third
+	// party services must use the same scheme as the
+	// services that add caveats addressed to them.
+	Scheme macaroon.Scheme
+
+	// Rand is used as the source of randomness for the root keys
+	// and ids of new macaroons, third party caveat ids and the
+	// encryption of third party caveat root keys and confidential
+	// caveat conditions. If the Key
+	// field is nil, it is also used to generate the service's
+	// key pair. If Rand is nil, crypto/rand.Reader will be used.
+	//
+	// Using a predictable source makes it possible to reproduce
+	// a whole mint-discharge-verify flow byte for byte, which
+	// is useful for tests and for producing test vectors. It
+	// should never be done otherwise.
+	Rand io.Reader
+
+	// NewVerifier is used by Request.Check to create the
+	// verifier that checks the request's macaroons. The
+	// parameters passed to it hold the request's first party
+	// checker and macaroons; it may set other parameters,
+	// such as limits, or return an entirely different
+	// implementation. If it is nil, macaroon.NewVerifier
+	// will be used.
+	NewVerifier func(macaroon.VerifierParams) macaroon.Verifier
+
+	// VerificationCache, if non-nil, is used by Request.Check
+	// to avoid verifying the signatures of the same set of
+	// macaroons more than once. It is only used when the
+	// verifier implements macaroon.SignatureVerifier.
+	VerificationCache *VerificationCache
+
+	// DecodeLimits holds the limits applied to macaroons
+	// decoded from client requests by packages such as
+	// httpbakery. If it is nil, macaroon.DefaultDecodeLimits
+	// will be used.
+	DecodeLimits *macaroon.DecodeLimits
+
+	// RootKeyPolicy, if non-nil, causes the service to mint
+	// macaroons with shared root keys held in the store,
+	// rather than storing a new root key for every macaroon.
+	// A new root key is generated every GenerateInterval,
+	// and the id of the key is encoded in the ids of the
+	// macaroons minted with it. Services that share a store
+	// share their root keys.
+	//
+	// Shared root keys are only used by NewMacaroon when
+	// both the id and root key are unspecified. Discharge
+	// macaroons are not stored at all, because they are
+	// verified with the root key in the third party caveat.
+	RootKeyPolicy *RootKeyPolicy
 }
 
 // NewService returns a new service that can mint new
@@ -57,14 +136,45 @@ func NewService(p NewServiceParams) (*Service, error) {
 	if p.Store == nil {
 		p.Store = NewMemStorage()
 	}
+	if p.NewVerifier == nil {
+		p.NewVerifier = macaroon.NewVerifier
+	}
+	if p.Rand == nil {
+		p.Rand = rand.Reader
+	}
+	if p.DecodeLimits == nil {
+		p.DecodeLimits = &macaroon.DefaultDecodeLimits
+	}
+	if p := p.RootKeyPolicy; p != nil {
+		if p.GenerateInterval <= 0 {
+			return nil, fmt.Errorf("root key generate interval must be positive")
+		}
+		if p.MaxAge <= p.GenerateInterval {
+			return nil, fmt.Errorf("root key maximum age must be longer than generate interval")
+		}
+	}
 	svc := &Service{
-		location: p.Location,
-		store:    storage{p.Store},
+		location:    p.Location,
+		store:       storage{p.Store},
+		version:     p.Version,
+		scheme:      p.Scheme,
+		rand:        p.Rand,
+		cache:       p.VerificationCache,
+		limits:      *p.DecodeLimits,
+		now:         time.Now,
+		newVerifier: p.NewVerifier,
+	}
+	if p.RootKeyPolicy != nil {
+		svc.rootKeys = &rootKeys{
+			policy: *p.RootKeyPolicy,
+			store:  svc.store,
+			rand:   p.Rand,
+		}
 	}
 
 	var err error
 	if p.Key == nil {
-		p.Key, err = GenerateKey()
+		p.Key, err = generateKey(p.Rand)
 		if err != nil {
 			return nil, err
 		}
@@ -72,7 +182,7 @@ func NewService(p NewServiceParams) (*Service, error) {
 	if p.Locator == nil {
 		p.Locator = PublicKeyLocatorMap(nil)
 	}
-	svc.encoder = newBoxEncoder(p.Locator, p.Key)
+	svc.encoder = newBoxEncoder(p.Locator, p.Key, p.Rand)
 	return svc, nil
 }
 
@@ -81,6 +191,17 @@ func (svc *Service) Store() Storage {
 	return svc.store.store
 }
 
+// PublicKey returns the service's public key.
+func (svc *Service) PublicKey() *PublicKey {
+	return &svc.encoder.key.Public
+}
+
+// DecodeLimits returns the limits that should be applied to
+// macaroons decoded from client requests to the service.
+func (svc *Service) DecodeLimits() macaroon.DecodeLimits {
+	return svc.limits
+}
+
 // Location returns the service's configured macaroon location.
 func (svc *Service) Location() string {
 	return svc.location
@@ -94,6 +215,23 @@ func (svc *Service) Location() string {
 type Caveat struct {
 	Location  string
 	Condition string
+
+	// Confidential specifies that the condition of a first
+	// party caveat should be encrypted so that it cannot
+	// be read by the client. It is decrypted transparently
+	// by Request.Check, so first party checkers see the
+	// plain condition. Third party caveats cannot be
+	// confidential - their conditions are always encrypted
+	// for the third party.
+	Confidential bool
+
+	// AnyOf holds the alternatives of a third party caveat
+	// that may be discharged by any one of several third
+	// parties. Each alternative must be a third party caveat;
+	// the discharger at each location is asked to check the
+	// condition of its own alternative. When AnyOf is
+	// non-empty, Location and Condition are ignored.
+	AnyOf []Caveat
 }
 
 // Request represents a request made to a service
@@ -114,9 +252,10 @@ type Request struct {
 	// with the request.
 	macaroons []*macaroon.Macaroon
 
-	// inStorage maps from macaroon id
-	// to the storage associated with that macaroon
-	// for all elements in macaroons.
+	// inStorage maps from macaroon to the storage
+	// associated with that macaroon, for all elements in
+	// macaroons that have been looked up in the store.
+	// The entry is nil if the macaroon was not found.
 	inStorage map[*macaroon.Macaroon]*storageItem
 }
 
@@ -132,7 +271,9 @@ func (svc *Service) NewRequest(checker FirstPartyChecker) *Request {
 
 // AddClientMacaroon associates the given macaroon  with
 // the request. The macaroon will be taken into account when req.Check
-// is called.
+// is called. Its root key is not looked up in the service's store
+// until then, so that the root keys of all the request's macaroons
+// can be fetched at once.
 //
 // TODO(rog) provide a way of deleting client macaroons?
 func (req *Request) AddClientMacaroon(m *macaroon.Macaroon) {
@@ -140,59 +281,151 @@ func (req *Request) AddClientMacaroon(m *macaroon.Macaroon) {
 	defer req.mu.Unlock()
 
 	req.macaroons = append(req.macaroons, m)
-	if req.inStorage[m] != nil {
-		return
+}
+
+// lookupMacaroons looks up the root keys of all the request's
+// macaroons that have not been looked up already, with a single
+// call to the store's GetMulti method if it implements
+// BatchStorage.
+//
+// Called with req.mu held.
+func (req *Request) lookupMacaroons() {
+	var locations []string
+	seen := make(map[string]bool)
+	for _, m := range req.macaroons {
+		if _, ok := req.inStorage[m]; ok {
+			continue
+		}
+		location, ok := req.svc.storageLocation(m.Id())
+		if !ok {
+			req.inStorage[m] = nil
+			continue
+		}
+		if seen[location] {
+			continue
+		}
+		seen[location] = true
+		locations = append(locations, location)
 	}
-	// TODO(rog) perhaps defer doing this until Check time,
-	// when we could fetch all the ids at once. We'd
-	// want to change Storage.Get to take a slice of ids.
-	item, err := req.svc.store.Get(m.Id())
-	if err == ErrNotFound {
+	if len(locations) == 0 {
 		return
 	}
+	items, err := req.svc.store.GetMulti(locations)
 	if err != nil {
+		// Leave the macaroons unresolved so that
+		// a later Check can try again.
 		log.Printf("warning: failed to read storage: %v", err)
 		return
 	}
-	req.inStorage[m] = item
+	now := req.svc.now()
+	for _, m := range req.macaroons {
+		if _, ok := req.inStorage[m]; ok {
+			continue
+		}
+		location, _ := req.svc.storageLocation(m.Id())
+		item := items[location]
+		if item != nil && len(item.RootKey) == 0 {
+			// An item without a root key cannot have been
+			// stored for a macaroon; never verify against it.
+			item = nil
+		}
+		if item != nil && item.Expiry != nil && !now.Before(*item.Expiry) {
+			// The store may not remove expired items,
+			// but they must never be used.
+			item = nil
+		}
+		req.inStorage[m] = item
+	}
+}
+
+// storageLocation returns the location in the store of the root
+// key of the macaroon with the given id. It reports false if the
+// id cannot be that of a macaroon minted by the service: ids
+// starting with rootKeyLocationPrefix are reserved for the shared
+// root keys, so that a client cannot present a macaroon whose id
+// names one of those items directly.
+func (svc *Service) storageLocation(id string) (string, bool) {
+	if svc.rootKeys != nil {
+		if location, ok := rootKeyLocation(id); ok {
+			return location, true
+		}
+	}
+	if strings.HasPrefix(id, rootKeyLocationPrefix) {
+		return "", false
+	}
+	return id, true
 }
 
 // NewMacaroon mints a new macaroon with the given id and caveats.
 // If the id is empty, a random id will be used.
 // If rootKey is nil, a random root key will be used.
 // The macaroon will be stored in the service's storage.
+//
+// If the service has a root key policy and both the id and
+// root key are unspecified, the macaroon is minted with the
+// current shared root key instead, and nothing is stored.
 func (svc *Service) NewMacaroon(id string, rootKey []byte, caveats []Caveat) (*macaroon.Macaroon, error) {
+	if svc.rootKeys != nil && id == "" && rootKey == nil {
+		id, rootKey, err := svc.rootKeys.newMacaroonId(svc.now())
+		if err != nil {
+			return nil, fmt.Errorf("cannot get root key for new macaroon: %v", err)
+		}
+		return svc.newMacaroon(id, rootKey, caveats, false)
+	}
+	return svc.newMacaroon(id, rootKey, caveats, true)
+}
+
+// newMacaroon is the internal version of NewMacaroon. The macaroon's
+// root key is only saved in the service's storage if store is true.
+func (svc *Service) newMacaroon(id string, rootKey []byte, caveats []Caveat, store bool) (*macaroon.Macaroon, error) {
+	if store && strings.HasPrefix(id, rootKeyLocationPrefix) {
+		return nil, fmt.Errorf("cannot mint macaroon with reserved id %q", id)
+	}
 	if rootKey == nil {
-		newRootKey, err := randomBytes(24)
+		newRootKey, err := randomBytes(svc.rand, 24)
 		if err != nil {
 			return nil, fmt.Errorf("cannot generate root key for new macaroon: %v", err)
 		}
 		rootKey = newRootKey
 	}
 	if id == "" {
-		idBytes, err := randomBytes(24)
+		idBytes, err := randomBytes(svc.rand, 24)
 		if err != nil {
 			return nil, fmt.Errorf("cannot generate id for new macaroon: %v", err)
 		}
 		id = fmt.Sprintf("%x", idBytes)
 	}
-	m, err := macaroon.New(rootKey, id, svc.location)
+	m, err := macaroon.NewWithParams(macaroon.NewParams{
+		RootKey:  rootKey,
+		Id:       []byte(id),
+		Location: svc.location,
+		Version:  svc.version,
+		Scheme:   svc.scheme,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("cannot bake macaroon: %v", err)
 	}
 
-	// TODO look at the caveats for expiry time and associate
-	// that with the storage item so that the storage can
-	// garbage collect it at an appropriate time.
-	if err := svc.store.Put(m.Id(), &storageItem{
-		RootKey: rootKey,
-	}); err != nil {
-		return nil, fmt.Errorf("cannot save macaroon to store: %v", err)
+	if store {
+		// Associate the expiry time of the macaroon, if any, with
+		// the storage item so that the storage can garbage
+		// collect it at an appropriate time.
+		item := &storageItem{
+			RootKey: rootKey,
+		}
+		if expiry, ok := caveatsExpiry(caveats); ok {
+			item.Expiry = &expiry
+		}
+		if err := svc.store.Put(m.Id(), item); err != nil {
+			return nil, fmt.Errorf("cannot save macaroon to store: %v", err)
+		}
 	}
 	for _, cav := range caveats {
-		if err := svc.AddCaveat(m, cav); err != nil {
-			if err := svc.store.store.Del(m.Id()); err != nil {
-				log.Printf("failed to remove macaroon from storage: %v", err)
+		if err := svc.addCaveat(m, cav, rootKey); err != nil {
+			if store {
+				if err := svc.store.store.Del(m.Id()); err != nil {
+					log.Printf("failed to remove macaroon from storage: %v", err)
+				}
 			}
 			return nil, err
 		}
@@ -200,17 +433,77 @@ func (svc *Service) NewMacaroon(id string, rootKey []byte, caveats []Caveat) (*m
 	return m, nil
 }
 
+// timeBeforePrefix is the prefix of the condition of
+// a time-before caveat (see checkers.TimeBefore).
+const timeBeforePrefix = "time-before "
+
+// caveatsExpiry returns the earliest expiry time of any
+// time-before caveat in the given caveats, and reports
+// whether there was one. A macaroon with those caveats
+// cannot be used after that time.
+func caveatsExpiry(caveats []Caveat) (time.Time, bool) {
+	var expiry time.Time
+	found := false
+	for _, cav := range caveats {
+		if cav.Location != "" || !strings.HasPrefix(cav.Condition, timeBeforePrefix) {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, cav.Condition[len(timeBeforePrefix):])
+		if err != nil {
+			continue
+		}
+		if !found || t.Before(expiry) {
+			expiry, found = t, true
+		}
+	}
+	return expiry, found
+}
+
 // AddCaveat adds a caveat to the given macaroon.
 //
 // If it's a third-party caveat, it uses the service's caveat-id encoder
 // to create the id of the new caveat.
+//
+// If it's a confidential caveat, the macaroon must have been minted
+// by the service, because its condition is encrypted with a key
+// derived from the macaroon's root key in the service's storage.
 func (svc *Service) AddCaveat(m *macaroon.Macaroon, cav Caveat) error {
+	return svc.addCaveat(m, cav, nil)
+}
+
+// addCaveat is the internal version of AddCaveat. If rootKey is
+// non-nil, it holds the root key of m, which is otherwise looked
+// up in the service's storage when needed.
+func (svc *Service) addCaveat(m *macaroon.Macaroon, cav Caveat, rootKey []byte) error {
 	logf("Service.AddCaveat id %q; cav %#v", m.Id(), cav)
+	if cav.Confidential {
+		if cav.Location != "" {
+			return fmt.Errorf("cannot add confidential third party caveat at %q", cav.Location)
+		}
+		if rootKey == nil {
+			location, ok := svc.storageLocation(m.Id())
+			if !ok {
+				return fmt.Errorf("cannot find root key for confidential caveat: %v", ErrNotFound)
+			}
+			item, err := svc.store.Get(location)
+			if err != nil {
+				return fmt.Errorf("cannot find root key for confidential caveat: %v", err)
+			}
+			rootKey = item.RootKey
+		}
+		if err := m.AddConfidentialCaveatWithRand(rootKey, []byte(cav.Condition), svc.rand); err != nil {
+			return fmt.Errorf("cannot add confidential caveat: %v", err)
+		}
+		return nil
+	}
+	if len(cav.AnyOf) > 0 {
+		return svc.addAnyOfCaveat(m, cav.AnyOf)
+	}
 	if cav.Location == "" {
 		m.AddFirstPartyCaveat(cav.Condition)
 		return nil
 	}
-	rootKey, err := randomBytes(24)
+	rootKey, err := randomBytes(svc.rand, 24)
 	if err != nil {
 		return fmt.Errorf("cannot generate third party secret: %v", err)
 	}
@@ -218,12 +511,39 @@ func (svc *Service) AddCaveat(m *macaroon.Macaroon, cav Caveat) error {
 	if err != nil {
 		return fmt.Errorf("cannot create third party caveat id at %q: %v", cav.Location, err)
 	}
-	if err := m.AddThirdPartyCaveat(rootKey, id, cav.Location); err != nil {
+	if err := m.AddThirdPartyCaveatWithRand(rootKey, id, cav.Location, svc.rand); err != nil {
 		return fmt.Errorf("cannot add third party caveat: %v", err)
 	}
 	return nil
 }
 
+// addAnyOfCaveat adds a third party caveat to m that can be
+// discharged by the third party of any of the given caveats.
+func (svc *Service) addAnyOfCaveat(m *macaroon.Macaroon, caveats []Caveat) error {
+	rootKey, err := randomBytes(svc.rand, 24)
+	if err != nil {
+		return fmt.Errorf("cannot generate third party secret: %v", err)
+	}
+	alts := make([]macaroon.Alternative, len(caveats))
+	for i, cav := range caveats {
+		if cav.Location == "" || cav.Confidential || len(cav.AnyOf) > 0 {
+			return fmt.Errorf("any-of caveat alternative %d is not a plain third party caveat", i)
+		}
+		id, err := svc.encoder.encodeCaveatId(cav, rootKey)
+		if err != nil {
+			return fmt.Errorf("cannot create third party caveat id at %q: %v", cav.Location, err)
+		}
+		alts[i] = macaroon.Alternative{
+			Location: cav.Location,
+			Id:       id,
+		}
+	}
+	if err := m.AddAnyOfThirdPartyCaveatWithRand(rootKey, alts, svc.rand); err != nil {
+		return fmt.Errorf("cannot add any-of third party caveat: %v", err)
+	}
+	return nil
+}
+
 // Discharge creates a macaroon that discharges the third party caveat with the
 // given id. The id should have been created earlier by a Service.  The
 // condition implicit in the id is checked for validity using checker, and
@@ -233,7 +553,7 @@ func (svc *Service) Discharge(checker ThirdPartyChecker, id string) (*macaroon.M
 	decoder := newBoxDecoder(svc.encoder.key)
 
 	logf("server attempting to discharge %q", id)
-	rootKey, condition, err := decoder.decodeCaveatId(id)
+	rootKey, condition, err := decoder.decodeCaveatId([]byte(id))
 	if err != nil {
 		return nil, fmt.Errorf("discharger cannot decode caveat id: %v", err)
 	}
@@ -241,12 +561,15 @@ func (svc *Service) Discharge(checker ThirdPartyChecker, id string) (*macaroon.M
 	if err != nil {
 		return nil, err
 	}
-	return svc.NewMacaroon(id, rootKey, caveats)
+	// When the service uses shared root keys, there is no
+	// need to store the root key of the discharge macaroon:
+	// it is verified with the root key in the caveat.
+	return svc.newMacaroon(id, rootKey, caveats, svc.rootKeys == nil)
 }
 
-func randomBytes(n int) ([]byte, error) {
+func randomBytes(r io.Reader, n int) ([]byte, error) {
 	b := make([]byte, n)
-	_, err := rand.Read(b)
+	_, err := io.ReadFull(r, b)
 	if err != nil {
 		return nil, fmt.Errorf("cannot generate %d random bytes: %v", n, err)
 	}
@@ -257,6 +580,11 @@ func randomBytes(n int) ([]byte, error) {
 // correctly. If the verification fails in a way which might be
 // remediable (for example by the addition of additional dicharge
 // macaroons), it returns a VerificationError that describes the error.
+//
+// If any macaroon fails because a first party caveat checker
+// returned an error marked with macaroon.Fatal, that failure
+// is returned in preference to any other, and the returned
+// error's Fatal method reports true.
 func (req *Request) Check() error {
 	req.mu.Lock()
 	defer req.mu.Unlock()
@@ -265,23 +593,81 @@ func (req *Request) Check() error {
 			Reason: fmt.Errorf("no possible macaroons found"),
 		}
 	}
+	logf("Request.Check macaroons:\n%s", macaroon.Slice(req.macaroons))
+	req.lookupMacaroons()
+	verifier := req.svc.newVerifier(macaroon.VerifierParams{
+		Check:      req.checker.CheckFirstPartyCaveat,
+		Scheme:     req.svc.scheme,
+		Discharges: req.macaroons,
+	})
 	var anError error
-	for _, m := range req.macaroons {
+	for i, m := range req.macaroons {
 		item := req.inStorage[m]
 		if item == nil {
 			continue
 		}
-		err := m.Verify(item.RootKey, req.checker.CheckFirstPartyCaveat, req.macaroons)
+		if req.checkCached(verifier, i, item.RootKey) {
+			return nil
+		}
+		err := verifier.Verify(m, item.RootKey)
 		if err == nil {
 			return nil
 		}
-		anError = err
+		if !macaroon.IsFatal(anError) {
+			anError = err
+		}
+	}
+	if anError == nil {
+		// None of the macaroons were minted by this service,
+		// for example because the primary macaroon was
+		// dropped when decoding the request.
+		anError = fmt.Errorf("no recognized macaroons found")
 	}
 	return &VerificationError{
 		Reason: anError,
 	}
 }
 
+// checkCached reports whether the macaroon at index i in req.macaroons
+// verifies using the service's verification cache. If the macaroon's
+// signatures have not been verified recently, they are verified with
+// the given verifier and the result is added to the cache.
+//
+// If checkCached returns false, the macaroon may still be valid:
+// the caller should verify it in full to find out, and to find
+// the reason for the failure if not.
+//
+// Called with req.mu held.
+func (req *Request) checkCached(verifier macaroon.Verifier, i int, rootKey []byte) bool {
+	cache := req.svc.cache
+	if cache == nil {
+		return false
+	}
+	sv, ok := verifier.(macaroon.SignatureVerifier)
+	if !ok {
+		return false
+	}
+	key, ok := verificationCacheKey(rootKey, req.svc.scheme, req.macaroons, i)
+	if !ok {
+		return false
+	}
+	conditions, ok := cache.get(key)
+	if !ok {
+		var err error
+		conditions, err = sv.VerifySignature(req.macaroons[i], rootKey)
+		if err != nil {
+			return false
+		}
+		cache.add(key, conditions)
+	}
+	for _, cond := range conditions {
+		if err := req.checker.CheckFirstPartyCaveat(cond); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
 type CaveatNotRecognizedError struct {
 	Caveat string
 }
@@ -290,7 +676,15 @@ func (e *CaveatNotRecognizedError) Error() string {
 	return fmt.Sprintf("caveat %q not recognized", e.Caveat)
 }
 
+// VerificationError is the type of the error returned
+// by Request.Check when the client's macaroons fail to
+// verify.
 type VerificationError struct {
+	// Reason holds the reason for the failure. When a
+	// macaroon failed to verify, it holds the error returned
+	// by the macaroon verifier, which is a
+	// *macaroon.VerificationError when the verifier was
+	// created by macaroon.NewVerifier.
 	Reason error
 }
 
@@ -298,6 +692,13 @@ func (e *VerificationError) Error() string {
 	return fmt.Sprintf("verification failed: %v", e.Reason)
 }
 
+// Fatal reports whether the verification failure
+// is fatal - that is, obtaining a new macaroon will
+// not allow the request to succeed. See macaroon.IsFatal.
+func (e *VerificationError) Fatal() bool {
+	return macaroon.IsFatal(e.Reason)
+}
+
 // TODO(rog) consider possible options for checkers:
 // - first and third party checkers could be merged, but
 // then there would have to be a runtime check
@@ -0,0 +1,570 @@
+package bakery_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.crypto/nacl/box"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/macaroon.v1"
+
+	"github.com/rogpeppe/macaroon/bakery"
+	"github.com/rogpeppe/macaroon/bakery/checkers"
+)
+
+type ServiceSuite struct{}
+
+var _ = gc.Suite(&ServiceSuite{})
+
+func (*ServiceSuite) TestDischargeWithVersion(c *gc.C) {
+	for _, vers := range []macaroon.Version{macaroon.V1, macaroon.V2} {
+		c.Logf("version %v", vers)
+		ts, as := newTargetAndAuthServices(c, vers)
+		m, err := ts.NewMacaroon("", nil, []bakery.Caveat{
+			checkers.ThirdParty("as-loc", "something"),
+		})
+		c.Assert(err, gc.IsNil)
+		c.Assert(m.Version(), gc.Equals, vers)
+
+		dm, err := as.Discharge(alwaysOKThirdParty, m.Caveats()[0].Id)
+		c.Assert(err, gc.IsNil)
+		c.Assert(dm.Version(), gc.Equals, vers)
+		dm.Bind(m.Signature())
+
+		req := ts.NewRequest(bakery.FirstPartyCheckerFunc(alwaysOK))
+		req.AddClientMacaroon(m)
+		req.AddClientMacaroon(dm)
+		err = req.Check()
+		c.Assert(err, gc.IsNil)
+	}
+}
+
+func (*ServiceSuite) TestDischargeWithScheme(c *gc.C) {
+	for _, scheme := range []macaroon.Scheme{macaroon.SchemeHMACSHA512, macaroon.SchemeAESGCM} {
+		c.Logf("scheme %v", scheme)
+		asKey, err := bakery.GenerateKey()
+		c.Assert(err, gc.IsNil)
+		as, err := bakery.NewService(bakery.NewServiceParams{
+			Location: "as-loc",
+			Key:      asKey,
+			Scheme:   scheme,
+		})
+		c.Assert(err, gc.IsNil)
+		ts, err := bakery.NewService(bakery.NewServiceParams{
+			Location: "ts-loc",
+			Locator: bakery.PublicKeyLocatorMap{
+				"as-loc": &asKey.Public,
+			},
+			Scheme: scheme,
+		})
+		c.Assert(err, gc.IsNil)
+		m, err := ts.NewMacaroon("", nil, []bakery.Caveat{
+			checkers.ThirdParty("as-loc", "something"),
+		})
+		c.Assert(err, gc.IsNil)
+		c.Assert(m.Scheme(), gc.Equals, scheme)
+
+		dm, err := as.Discharge(alwaysOKThirdParty, m.Caveats()[0].Id)
+		c.Assert(err, gc.IsNil)
+		c.Assert(dm.Scheme(), gc.Equals, scheme)
+		dm.Bind(m.Signature())
+
+		// The scheme is lost when the client sends the
+		// macaroons, so the service supplies it.
+		str, err := macaroon.SerializeSlice(macaroon.Slice{m, dm})
+		c.Assert(err, gc.IsNil)
+		ms, err := macaroon.DeserializeSlice(str)
+		c.Assert(err, gc.IsNil)
+
+		req := ts.NewRequest(bakery.FirstPartyCheckerFunc(alwaysOK))
+		for _, m := range ms {
+			req.AddClientMacaroon(m)
+		}
+		err = req.Check()
+		c.Assert(err, gc.IsNil)
+
+		// The client's macaroons are not changed.
+		for _, m := range ms {
+			c.Assert(m.Scheme(), gc.Equals, macaroon.SchemeNative)
+		}
+	}
+}
+
+func (*ServiceSuite) TestCheckRejectsEncodedSchemeMismatch(c *gc.C) {
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "loc",
+		Scheme:   macaroon.SchemeHMACSHA512,
+	})
+	c.Assert(err, gc.IsNil)
+	m, err := svc.NewMacaroon("", nil, nil)
+	c.Assert(err, gc.IsNil)
+
+	// A macaroon that claims to use another scheme is
+	// rejected even though its signature is valid for
+	// the service's scheme.
+	m.SetScheme(macaroon.SchemeAESGCM)
+	data, err := m.MarshalCBOR()
+	c.Assert(err, gc.IsNil)
+	var m1 macaroon.Macaroon
+	err = m1.UnmarshalCBOR(data)
+	c.Assert(err, gc.IsNil)
+
+	req := svc.NewRequest(bakery.FirstPartyCheckerFunc(alwaysOK))
+	req.AddClientMacaroon(&m1)
+	err = req.Check()
+	c.Assert(err, gc.ErrorMatches, `verification failed: macaroon encoded with scheme aes-gcm, not hmac-sha512`)
+}
+
+// mintAndDischarge runs a complete flow with services using
+// randomness from the given seed. It returns the serialized
+// primary and discharge macaroons.
+func mintAndDischarge(c *gc.C, seed int64) string {
+	r := rand.New(rand.NewSource(seed))
+	as, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "as-loc",
+		Rand:     r,
+	})
+	c.Assert(err, gc.IsNil)
+	ts, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "ts-loc",
+		Locator: bakery.PublicKeyLocatorMap{
+			"as-loc": as.PublicKey(),
+		},
+		Rand: r,
+	})
+	c.Assert(err, gc.IsNil)
+	m, err := ts.NewMacaroon("", nil, []bakery.Caveat{
+		checkers.ThirdParty("as-loc", "something"),
+	})
+	c.Assert(err, gc.IsNil)
+	dm, err := as.Discharge(alwaysOKThirdParty, m.Caveats()[0].Id)
+	c.Assert(err, gc.IsNil)
+	dm.Bind(m.Signature())
+
+	req := ts.NewRequest(bakery.FirstPartyCheckerFunc(alwaysOK))
+	req.AddClientMacaroon(m)
+	req.AddClientMacaroon(dm)
+	err = req.Check()
+	c.Assert(err, gc.IsNil)
+
+	str, err := macaroon.SerializeSlice(macaroon.Slice{m, dm})
+	c.Assert(err, gc.IsNil)
+	return str
+}
+
+func (*ServiceSuite) TestDeterministicRand(c *gc.C) {
+	str0 := mintAndDischarge(c, 99)
+	str1 := mintAndDischarge(c, 99)
+	c.Assert(str1, gc.Equals, str0)
+
+	str2 := mintAndDischarge(c, 100)
+	c.Assert(str2, gc.Not(gc.Equals), str0)
+}
+
+func (*ServiceSuite) TestCheckFatalError(c *gc.C) {
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "loc",
+	})
+	c.Assert(err, gc.IsNil)
+	banned, err := svc.NewMacaroon("", nil, []bakery.Caveat{
+		checkers.FirstParty("user bob"),
+	})
+	c.Assert(err, gc.IsNil)
+	expired, err := svc.NewMacaroon("", nil, []bakery.Caveat{
+		checkers.FirstParty("expired"),
+	})
+	c.Assert(err, gc.IsNil)
+	checker := bakery.FirstPartyCheckerFunc(func(cond string) error {
+		if cond == "user bob" {
+			return macaroon.Fatal(fmt.Errorf("bob is banned"))
+		}
+		return fmt.Errorf("macaroon has expired")
+	})
+
+	req := svc.NewRequest(checker)
+	req.AddClientMacaroon(expired)
+	err = req.Check()
+	c.Assert(err, gc.ErrorMatches, `verification failed: macaroon has expired`)
+	c.Assert(err.(*bakery.VerificationError).Fatal(), gc.Equals, false)
+	c.Assert(macaroon.IsFatal(err), gc.Equals, false)
+
+	// The fatal error takes precedence regardless of
+	// the order of the macaroons.
+	for _, ms := range [][]*macaroon.Macaroon{{banned, expired}, {expired, banned}} {
+		req := svc.NewRequest(checker)
+		for _, m := range ms {
+			req.AddClientMacaroon(m)
+		}
+		err = req.Check()
+		c.Assert(err, gc.ErrorMatches, `verification failed: bob is banned`)
+		c.Assert(err.(*bakery.VerificationError).Fatal(), gc.Equals, true)
+		c.Assert(macaroon.IsFatal(err), gc.Equals, true)
+	}
+}
+
+func (*ServiceSuite) TestConfidentialCaveat(c *gc.C) {
+	ts, as := newTargetAndAuthServices(c, macaroon.V1)
+	m, err := ts.NewMacaroon("", nil, []bakery.Caveat{
+		checkers.Confidential(checkers.FirstParty("user alice")),
+		checkers.ThirdParty("as-loc", "something"),
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(m.Caveats()[0].IsConfidential(), gc.Equals, true)
+
+	dm, err := as.Discharge(bakery.ThirdPartyCheckerFunc(func(string, string) ([]bakery.Caveat, error) {
+		return []bakery.Caveat{
+			checkers.Confidential(checkers.FirstParty("account 1234")),
+		}, nil
+	}), m.Caveats()[1].Id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(dm.Caveats()[0].IsConfidential(), gc.Equals, true)
+	dm.Bind(m.Signature())
+
+	str, err := macaroon.SerializeSlice(macaroon.Slice{m, dm})
+	c.Assert(err, gc.IsNil)
+	ms, err := macaroon.DeserializeSlice(str)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ms.String(), gc.Not(gc.Matches), "(?s).*(alice|account).*")
+
+	var checked []string
+	req := ts.NewRequest(bakery.FirstPartyCheckerFunc(func(cond string) error {
+		checked = append(checked, cond)
+		return nil
+	}))
+	for _, m := range ms {
+		req.AddClientMacaroon(m)
+	}
+	err = req.Check()
+	c.Assert(err, gc.IsNil)
+	c.Assert(checked, gc.DeepEquals, []string{"user alice", "account 1234"})
+}
+
+func (*ServiceSuite) TestConfidentialThirdPartyCaveat(c *gc.C) {
+	ts, _ := newTargetAndAuthServices(c, macaroon.V1)
+	_, err := ts.NewMacaroon("", nil, []bakery.Caveat{
+		checkers.Confidential(checkers.ThirdParty("as-loc", "something")),
+	})
+	c.Assert(err, gc.ErrorMatches, `cannot add confidential third party caveat at "as-loc"`)
+}
+
+func (*ServiceSuite) TestAnyOfCaveat(c *gc.C) {
+	corpKey, err := bakery.GenerateKey()
+	c.Assert(err, gc.IsNil)
+	corp, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "corp-loc",
+		Key:      corpKey,
+	})
+	c.Assert(err, gc.IsNil)
+	partnerKey, err := bakery.GenerateKey()
+	c.Assert(err, gc.IsNil)
+	partner, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "partner-loc",
+		Key:      partnerKey,
+	})
+	c.Assert(err, gc.IsNil)
+	ts, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "ts-loc",
+		Locator: bakery.PublicKeyLocatorMap{
+			"corp-loc":    &corpKey.Public,
+			"partner-loc": &partnerKey.Public,
+		},
+	})
+	c.Assert(err, gc.IsNil)
+	dischargers := map[string]*bakery.Service{
+		"corp-loc":    corp,
+		"partner-loc": partner,
+	}
+
+	for _, loc := range []string{"corp-loc", "partner-loc"} {
+		c.Logf("discharging at %s", loc)
+		m, err := ts.NewMacaroon("", nil, []bakery.Caveat{
+			checkers.AnyOf(
+				checkers.ThirdParty("corp-loc", "corp-user"),
+				checkers.ThirdParty("partner-loc", "partner-user"),
+			),
+		})
+		c.Assert(err, gc.IsNil)
+		c.Assert(m.Caveats(), gc.HasLen, 1)
+
+		ms, err := bakery.DischargeAll(m, func(_ string, cav macaroon.Caveat) (*macaroon.Macaroon, error) {
+			if cav.Location != loc {
+				return nil, fmt.Errorf("%s unavailable", cav.Location)
+			}
+			return dischargers[loc].Discharge(bakery.ThirdPartyCheckerFunc(func(_, cond string) ([]bakery.Caveat, error) {
+				c.Check(cond, gc.Equals, map[string]string{
+					"corp-loc":    "corp-user",
+					"partner-loc": "partner-user",
+				}[loc])
+				return nil, nil
+			}), cav.Id)
+		})
+		c.Assert(err, gc.IsNil)
+		c.Assert(ms, gc.HasLen, 1)
+		ms[0].Bind(m.Signature())
+
+		req := ts.NewRequest(bakery.FirstPartyCheckerFunc(alwaysOK))
+		req.AddClientMacaroon(m)
+		req.AddClientMacaroon(ms[0])
+		err = req.Check()
+		c.Assert(err, gc.IsNil)
+	}
+}
+
+func (*ServiceSuite) TestAnyOfCaveatBadAlternative(c *gc.C) {
+	ts, _ := newTargetAndAuthServices(c, macaroon.V1)
+	_, err := ts.NewMacaroon("", nil, []bakery.Caveat{
+		checkers.AnyOf(
+			checkers.ThirdParty("as-loc", "something"),
+			checkers.FirstParty("something else"),
+		),
+	})
+	c.Assert(err, gc.ErrorMatches, `any-of caveat alternative 1 is not a plain third party caveat`)
+}
+
+func (*ServiceSuite) TestDecodeLimits(c *gc.C) {
+	svc, err := bakery.NewService(bakery.NewServiceParams{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(svc.DecodeLimits(), gc.Equals, macaroon.DefaultDecodeLimits)
+
+	limits := macaroon.DecodeLimits{
+		MaxCaveats: 5,
+	}
+	svc, err = bakery.NewService(bakery.NewServiceParams{
+		DecodeLimits: &limits,
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(svc.DecodeLimits(), gc.Equals, limits)
+}
+
+func (*ServiceSuite) TestNewMacaroonStoresExpiry(c *gc.C) {
+	store := bakery.NewMemStorage()
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "loc",
+		Store:    store,
+	})
+	c.Assert(err, gc.IsNil)
+	now := time.Now()
+	expiring, err := svc.NewMacaroon("", nil, []bakery.Caveat{
+		checkers.TimeBefore(now.Add(2 * time.Hour)),
+		checkers.FirstParty("something"),
+		checkers.TimeBefore(now.Add(time.Hour)),
+	})
+	c.Assert(err, gc.IsNil)
+	forever, err := svc.NewMacaroon("", nil, []bakery.Caveat{
+		checkers.FirstParty("something"),
+	})
+	c.Assert(err, gc.IsNil)
+
+	// The earliest time-before caveat determines the expiry time.
+	err = store.RemoveExpired(now.Add(30 * time.Minute))
+	c.Assert(err, gc.IsNil)
+	_, err = store.Get(expiring.Id())
+	c.Assert(err, gc.IsNil)
+
+	err = store.RemoveExpired(now.Add(90 * time.Minute))
+	c.Assert(err, gc.IsNil)
+	_, err = store.Get(expiring.Id())
+	c.Assert(err, gc.Equals, bakery.ErrNotFound)
+	_, err = store.Get(forever.Id())
+	c.Assert(err, gc.IsNil)
+}
+
+func (*ServiceSuite) TestCheckBatchesStorageLookups(c *gc.C) {
+	store := &countingStorage{
+		Storage: bakery.NewMemStorage(),
+	}
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "loc",
+		Store:    &countingBatchStorage{store},
+	})
+	c.Assert(err, gc.IsNil)
+	m, err := svc.NewMacaroon("", nil, nil)
+	c.Assert(err, gc.IsNil)
+	other, err := macaroon.New([]byte("key"), "other", "loc")
+	c.Assert(err, gc.IsNil)
+
+	req := svc.NewRequest(bakery.FirstPartyCheckerFunc(alwaysOK))
+	req.AddClientMacaroon(other)
+	req.AddClientMacaroon(m)
+	req.AddClientMacaroon(m)
+	c.Assert(store.getMultis, gc.HasLen, 0)
+	err = req.Check()
+	c.Assert(err, gc.IsNil)
+	c.Assert(store.gets, gc.HasLen, 0)
+	c.Assert(store.getMultis, gc.DeepEquals, [][]string{{"other", m.Id()}})
+
+	// Macaroons that have already been looked up,
+	// whether found or not, are not looked up again.
+	err = req.Check()
+	c.Assert(err, gc.IsNil)
+	c.Assert(store.getMultis, gc.HasLen, 1)
+}
+
+func (*ServiceSuite) TestCheckFallsBackToGet(c *gc.C) {
+	store := &countingStorage{
+		Storage: bakery.NewMemStorage(),
+	}
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "loc",
+		Store:    store,
+	})
+	c.Assert(err, gc.IsNil)
+	m, err := svc.NewMacaroon("", nil, nil)
+	c.Assert(err, gc.IsNil)
+	other, err := macaroon.New([]byte("key"), "other", "loc")
+	c.Assert(err, gc.IsNil)
+
+	req := svc.NewRequest(bakery.FirstPartyCheckerFunc(alwaysOK))
+	req.AddClientMacaroon(other)
+	req.AddClientMacaroon(m)
+	err = req.Check()
+	c.Assert(err, gc.IsNil)
+	c.Assert(store.gets, gc.DeepEquals, []string{"other", m.Id()})
+}
+
+// countingStorage is a Storage that records
+// the locations looked up in it.
+type countingStorage struct {
+	bakery.Storage
+	mu        sync.Mutex
+	gets      []string
+	getMultis [][]string
+}
+
+func (s *countingStorage) Get(location string) (string, error) {
+	s.mu.Lock()
+	s.gets = append(s.gets, location)
+	s.mu.Unlock()
+	return s.Storage.Get(location)
+}
+
+// countingBatchStorage is a BatchStorage that records
+// the locations looked up in its countingStorage.
+type countingBatchStorage struct {
+	*countingStorage
+}
+
+func (s countingBatchStorage) GetMulti(locations []string) (map[string]string, error) {
+	s.mu.Lock()
+	s.getMultis = append(s.getMultis, locations)
+	s.mu.Unlock()
+	return s.Storage.(bakery.BatchStorage).GetMulti(locations)
+}
+
+func (*ServiceSuite) TestCheckUsesNewVerifier(c *gc.C) {
+	var params []macaroon.VerifierParams
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "loc",
+		NewVerifier: func(p macaroon.VerifierParams) macaroon.Verifier {
+			params = append(params, p)
+			p.MaxCaveats = 1
+			return macaroon.NewVerifier(p)
+		},
+	})
+	c.Assert(err, gc.IsNil)
+	m, err := svc.NewMacaroon("", nil, []bakery.Caveat{{
+		Condition: "something",
+	}})
+	c.Assert(err, gc.IsNil)
+
+	req := svc.NewRequest(bakery.FirstPartyCheckerFunc(alwaysOK))
+	req.AddClientMacaroon(m)
+	err = req.Check()
+	c.Assert(err, gc.IsNil)
+	c.Assert(params, gc.HasLen, 1)
+	c.Assert(params[0].Discharges, gc.DeepEquals, []*macaroon.Macaroon{m})
+
+	// Check that the limit set by NewVerifier is honoured.
+	err = m.AddFirstPartyCaveat("another thing")
+	c.Assert(err, gc.IsNil)
+	err = req.Check()
+	c.Assert(err, gc.ErrorMatches, `verification failed: too many caveats \(max 1\)`)
+}
+
+func (*ServiceSuite) TestCaveatIdsAreBinary(c *gc.C) {
+	ts, _ := newTargetAndAuthServices(c, macaroon.V1)
+	m, err := ts.NewMacaroon("", nil, []bakery.Caveat{
+		checkers.ThirdParty("as-loc", "something"),
+	})
+	c.Assert(err, gc.IsNil)
+	// The caveat id should not be base64 encoded.
+	id := m.Caveats()[0].IdBytes()
+	c.Assert(id[0], gc.Equals, byte(1))
+	_, err = base64.StdEncoding.DecodeString(string(id))
+	c.Assert(err, gc.NotNil)
+}
+
+func (*ServiceSuite) TestDischargeLegacyCaveatId(c *gc.C) {
+	asKey, err := bakery.GenerateKey()
+	c.Assert(err, gc.IsNil)
+	as, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "as-loc",
+		Key:      asKey,
+	})
+	c.Assert(err, gc.IsNil)
+	tsKey, err := bakery.GenerateKey()
+	c.Assert(err, gc.IsNil)
+
+	// Make a caveat id in the legacy format: base64-encoded
+	// JSON holding a base64-encoded encrypted record.
+	var nonce [bakery.NonceLen]byte
+	sealed := box.Seal(nil, []byte(`{"RootKey":"c2hhcmVkIGtleQ==","Condition":"something"}`), &nonce, (*[bakery.KeyLen]byte)(&asKey.Public), (*[bakery.KeyLen]byte)(&tsKey.Private))
+	idData, err := json.Marshal(map[string]interface{}{
+		"ThirdPartyPublicKey": asKey.Public[:],
+		"FirstPartyPublicKey": tsKey.Public[:],
+		"Nonce":               nonce[:],
+		"Id":                  base64.StdEncoding.EncodeToString(sealed),
+	})
+	c.Assert(err, gc.IsNil)
+	id := base64.StdEncoding.EncodeToString(idData)
+
+	var gotCondition string
+	dm, err := as.Discharge(bakery.ThirdPartyCheckerFunc(func(cavId, cond string) ([]bakery.Caveat, error) {
+		c.Check(cavId, gc.Equals, id)
+		gotCondition = cond
+		return nil, nil
+	}), id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(gotCondition, gc.Equals, "something")
+
+	// Check that the discharge was made with the
+	// root key in the id.
+	m, err := macaroon.New([]byte("root key"), "id", "")
+	c.Assert(err, gc.IsNil)
+	err = m.AddThirdPartyCaveat([]byte("shared key"), id, "as-loc")
+	c.Assert(err, gc.IsNil)
+	dm.Bind(m.Signature())
+	err = m.Verify([]byte("root key"), alwaysOK, []*macaroon.Macaroon{dm})
+	c.Assert(err, gc.IsNil)
+}
+
+var alwaysOKThirdParty = bakery.ThirdPartyCheckerFunc(func(string, string) ([]bakery.Caveat, error) {
+	return nil, nil
+})
+
+// newTargetAndAuthServices returns a target service and an
+// authorization service located at "as-loc" that can discharge
+// third party caveats added by the target service.
+func newTargetAndAuthServices(c *gc.C, vers macaroon.Version) (ts, as *bakery.Service) {
+	asKey, err := bakery.GenerateKey()
+	c.Assert(err, gc.IsNil)
+	as, err = bakery.NewService(bakery.NewServiceParams{
+		Location: "as-loc",
+		Key:      asKey,
+		Version:  vers,
+	})
+	c.Assert(err, gc.IsNil)
+	ts, err = bakery.NewService(bakery.NewServiceParams{
+		Location: "ts-loc",
+		Locator: bakery.PublicKeyLocatorMap{
+			"as-loc": &asKey.Public,
+		},
+		Version: vers,
+	})
+	c.Assert(err, gc.IsNil)
+	return ts, as
+}
@@ -0,0 +1,386 @@
+package bakery
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SQLStorageParams holds the parameters for NewSQLStorage.
+type SQLStorageParams struct {
+	// DB holds the database to use. It may be shared
+	// between any number of services, in the same process
+	// or not.
+	DB *sql.DB
+
+	// Table holds the name of the table that holds the
+	// items. If it is empty, "macaroon_storage" is used.
+	// The name of the table that records the schema
+	// version is the same with "_version" appended.
+	Table string
+
+	// Placeholder returns the query placeholder for the nth
+	// argument, counting from 1. If it is nil, "?" is used,
+	// which is suitable for SQLite and MySQL. For PostgreSQL,
+	// use a function that returns "$1", "$2" and so on.
+	Placeholder func(n int) string
+
+	// Dialect holds the SQL dialect understood by
+	// the database. It determines the syntax used to
+	// insert an item or replace an existing one.
+	Dialect SQLDialect
+}
+
+// SQLDialect identifies a variant of SQL.
+type SQLDialect int
+
+const (
+	// SQLDialectDefault is the dialect of SQLite (3.24 or later)
+	// and PostgreSQL (9.5 or later), which both support
+	// INSERT ... ON CONFLICT ... DO UPDATE.
+	SQLDialectDefault SQLDialect = iota
+
+	// SQLDialectMySQL is the dialect of MySQL, which
+	// uses INSERT ... ON DUPLICATE KEY UPDATE instead.
+	SQLDialectMySQL
+)
+
+// upsertStatements holds the statement that inserts an item,
+// replacing any existing item at the same location, for each
+// dialect. Doing this in a single statement means that
+// concurrent puts to the same location cannot conflict.
+var upsertStatements = map[SQLDialect]string{
+	SQLDialectDefault: `INSERT INTO $TABLE (location_hash, location, item, expiry) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (location_hash) DO UPDATE SET
+		location = excluded.location, item = excluded.item, expiry = excluded.expiry`,
+	SQLDialectMySQL: `INSERT INTO $TABLE (location_hash, location, item, expiry) VALUES ($1, $2, $3, $4)
+		ON DUPLICATE KEY UPDATE
+		location = VALUES(location), item = VALUES(item), expiry = VALUES(expiry)`,
+}
+
+// sqlStorage is the Storage implementation returned
+// by NewSQLStorage. It also implements BatchStorage.
+//
+// The items are stored in a table with the following
+// schema, where macaroon_storage is the table name:
+//
+//	CREATE TABLE macaroon_storage (
+//		location_hash VARCHAR(64) NOT NULL PRIMARY KEY,
+//		location TEXT NOT NULL,
+//		item TEXT NOT NULL,
+//		expiry BIGINT
+//	);
+//	CREATE INDEX macaroon_storage_expiry ON macaroon_storage (expiry);
+//
+// The location_hash column holds the hex-encoded SHA-256 hash
+// of the location, and the location and item columns hold the
+// base64-encoded location and item, so that binary data can
+// be stored portably. The expiry column holds the expiry time
+// of the item in nanoseconds since the Unix epoch, or NULL if
+// the item never expires.
+//
+// The schema version is recorded in the single row of the
+// table macaroon_storage_version, whose id column is always 0.
+type sqlStorage struct {
+	db     *sql.DB
+	table  string
+	ph     func(n int) string
+	upsert string
+}
+
+// sqlMigrations holds the statements that bring the schema
+// from each version to the next; the statements in
+// sqlMigrations[i] bring the schema from version i to version
+// i+1. In each statement, $TABLE is replaced by the table name.
+//
+// Existing migrations must never be changed; to change
+// the schema, add a new entry to the end.
+var sqlMigrations = [][]string{{
+	`CREATE TABLE $TABLE (
+		location_hash VARCHAR(64) NOT NULL PRIMARY KEY,
+		location TEXT NOT NULL,
+		item TEXT NOT NULL,
+		expiry BIGINT
+	)`,
+}, {
+	`CREATE INDEX $TABLE_expiry ON $TABLE (expiry)`,
+}}
+
+var validTableName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// NewSQLStorage returns an implementation of Storage that
+// stores items in an SQL database. Items survive restarts
+// of the process, and the database may be shared between
+// several replicas of a service.
+//
+// The tables are created if they do not exist, and the schema
+// is migrated to the latest version if necessary. Migration is
+// done within a transaction, which is retried if it fails, so
+// several replicas may start at once.
+//
+// Expired items are only removed when RemoveExpired is called.
+func NewSQLStorage(p SQLStorageParams) (ExpiryStorage, error) {
+	if p.DB == nil {
+		return nil, fmt.Errorf("no database in SQL storage parameters")
+	}
+	if p.Table == "" {
+		p.Table = "macaroon_storage"
+	}
+	if !validTableName.MatchString(p.Table) {
+		return nil, fmt.Errorf("invalid table name %q", p.Table)
+	}
+	if p.Placeholder == nil {
+		p.Placeholder = func(int) string {
+			return "?"
+		}
+	}
+	upsert, ok := upsertStatements[p.Dialect]
+	if !ok {
+		return nil, fmt.Errorf("unknown SQL dialect %d", p.Dialect)
+	}
+	s := &sqlStorage{
+		db:     p.DB,
+		table:  p.Table,
+		ph:     p.Placeholder,
+		upsert: upsert,
+	}
+	// When several replicas migrate the schema at once, all
+	// but one of their transactions may fail. Trying again
+	// finds the schema already migrated.
+	var err error
+	for i := 0; i < sqlMigrateAttempts; i++ {
+		if err = s.migrate(); err == nil {
+			return s, nil
+		}
+		if _, ok := err.(*schemaVersionError); ok {
+			break
+		}
+		logf("cannot migrate SQL storage schema (attempt %d): %v", i+1, err)
+	}
+	return nil, fmt.Errorf("cannot migrate SQL storage schema: %v", err)
+}
+
+// sqlMigrateAttempts holds the number of times that
+// NewSQLStorage tries to migrate the schema.
+const sqlMigrateAttempts = 5
+
+// schemaVersionError is the error returned by migrate when the
+// schema is newer than this code supports.
+type schemaVersionError struct {
+	version int
+}
+
+func (e *schemaVersionError) Error() string {
+	return fmt.Sprintf("schema version %d is newer than this code supports (%d)", e.version, len(sqlMigrations))
+}
+
+var placeholderPattern = regexp.MustCompile(`\$[0-9]+`)
+
+// query returns the given query with $TABLE replaced by the
+// table name and each $n replaced by the placeholder for the
+// nth argument.
+func (s *sqlStorage) query(q string) string {
+	q = strings.Replace(q, "$TABLE", s.table, -1)
+	return placeholderPattern.ReplaceAllStringFunc(q, func(p string) string {
+		n, _ := strconv.Atoi(p[1:])
+		return s.ph(n)
+	})
+}
+
+// migrate creates the tables or updates their
+// schema to the latest version as necessary.
+func (s *sqlStorage) migrate() (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	// The primary key ensures that there is only ever one
+	// version row, even if several replicas try to create
+	// it at once.
+	if _, err := tx.Exec(s.query(`CREATE TABLE IF NOT EXISTS $TABLE_version (id INTEGER NOT NULL PRIMARY KEY, version INTEGER NOT NULL)`)); err != nil {
+		return err
+	}
+	version := 0
+	err = tx.QueryRow(s.query(`SELECT version FROM $TABLE_version WHERE id = 0`)).Scan(&version)
+	switch {
+	case err == sql.ErrNoRows:
+		if _, err := tx.Exec(s.query(`INSERT INTO $TABLE_version (id, version) VALUES (0, 0)`)); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	}
+	if version > len(sqlMigrations) {
+		return &schemaVersionError{version}
+	}
+	if version == len(sqlMigrations) {
+		return tx.Commit()
+	}
+	for _, m := range sqlMigrations[version:] {
+		for _, stmt := range m {
+			if _, err := tx.Exec(s.query(stmt)); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := tx.Exec(s.query(`UPDATE $TABLE_version SET version = $1 WHERE id = 0`), len(sqlMigrations)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// locationHash returns the key of the row
+// holding the item at the given location.
+func locationHash(location string) string {
+	sum := sha256.Sum256([]byte(location))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *sqlStorage) Put(location, item string) error {
+	return s.put(location, item, sql.NullInt64{})
+}
+
+func (s *sqlStorage) PutWithExpiry(location, item string, expiry time.Time) error {
+	return s.put(location, item, sql.NullInt64{
+		Int64: expiry.UnixNano(),
+		Valid: true,
+	})
+}
+
+func (s *sqlStorage) put(location, item string, expiry sql.NullInt64) error {
+	logf("storage.Put[%q] %q (expiry %v)", location, item, expiry.Int64)
+	_, err := s.db.Exec(
+		s.query(s.upsert),
+		locationHash(location),
+		base64.StdEncoding.EncodeToString([]byte(location)),
+		base64.StdEncoding.EncodeToString([]byte(item)),
+		expiry,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot put item: %v", err)
+	}
+	return nil
+}
+
+func (s *sqlStorage) Get(location string) (string, error) {
+	var encLocation, encItem string
+	var expiry sql.NullInt64
+	err := s.db.QueryRow(
+		s.query(`SELECT location, item, expiry FROM $TABLE WHERE location_hash = $1`),
+		locationHash(location),
+	).Scan(&encLocation, &encItem, &expiry)
+	if err == sql.ErrNoRows {
+		logf("storage.Get[%q] -> not found", location)
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("cannot get item: %v", err)
+	}
+	if encLocation != base64.StdEncoding.EncodeToString([]byte(location)) ||
+		expiry.Valid && time.Now().UnixNano() >= expiry.Int64 {
+		logf("storage.Get[%q] -> not found", location)
+		return "", ErrNotFound
+	}
+	item, err := base64.StdEncoding.DecodeString(encItem)
+	if err != nil {
+		return "", fmt.Errorf("badly formatted item at %q: %v", location, err)
+	}
+	logf("storage.Get[%q] -> %q", location, item)
+	return string(item), nil
+}
+
+// sqlBatchSize holds the maximum number of
+// locations looked up in a single query by GetMulti.
+const sqlBatchSize = 100
+
+// GetMulti implements BatchStorage.GetMulti.
+func (s *sqlStorage) GetMulti(locations []string) (map[string]string, error) {
+	items := make(map[string]string)
+	for i := 0; i < len(locations); i += sqlBatchSize {
+		end := i + sqlBatchSize
+		if end > len(locations) {
+			end = len(locations)
+		}
+		if err := s.getBatch(locations[i:end], items); err != nil {
+			return nil, err
+		}
+	}
+	logf("storage.GetMulti[%q] -> %d items", locations, len(items))
+	return items, nil
+}
+
+// getBatch looks up the items at the given locations with a
+// single query and adds those it finds to items.
+func (s *sqlStorage) getBatch(locations []string, items map[string]string) error {
+	byHash := make(map[string]string)
+	args := make([]interface{}, 0, len(locations))
+	placeholders := make([]string, 0, len(locations))
+	for _, location := range locations {
+		hash := locationHash(location)
+		if _, ok := byHash[hash]; ok {
+			continue
+		}
+		byHash[hash] = location
+		args = append(args, hash)
+		placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+	}
+	rows, err := s.db.Query(
+		s.query(`SELECT location_hash, location, item, expiry FROM $TABLE WHERE location_hash IN (`+strings.Join(placeholders, ", ")+`)`),
+		args...,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot get items: %v", err)
+	}
+	defer rows.Close()
+	now := time.Now().UnixNano()
+	for rows.Next() {
+		var hash, encLocation, encItem string
+		var expiry sql.NullInt64
+		if err := rows.Scan(&hash, &encLocation, &encItem, &expiry); err != nil {
+			return fmt.Errorf("cannot get items: %v", err)
+		}
+		location, ok := byHash[hash]
+		if !ok ||
+			encLocation != base64.StdEncoding.EncodeToString([]byte(location)) ||
+			expiry.Valid && now >= expiry.Int64 {
+			continue
+		}
+		item, err := base64.StdEncoding.DecodeString(encItem)
+		if err != nil {
+			return fmt.Errorf("badly formatted item at %q: %v", location, err)
+		}
+		items[location] = string(item)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("cannot get items: %v", err)
+	}
+	return nil
+}
+
+func (s *sqlStorage) Del(location string) error {
+	_, err := s.db.Exec(s.query(`DELETE FROM $TABLE WHERE location_hash = $1`), locationHash(location))
+	if err != nil {
+		return fmt.Errorf("cannot delete item: %v", err)
+	}
+	return nil
+}
+
+// RemoveExpired implements ExpiryStorage.RemoveExpired.
+func (s *sqlStorage) RemoveExpired(now time.Time) error {
+	_, err := s.db.Exec(s.query(`DELETE FROM $TABLE WHERE expiry IS NOT NULL AND expiry <= $1`), now.UnixNano())
+	if err != nil {
+		return fmt.Errorf("cannot remove expired items: %v", err)
+	}
+	return nil
+}
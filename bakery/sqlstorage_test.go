@@ -0,0 +1,182 @@
+package bakery_test
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	_ "modernc.org/sqlite"
+
+	"github.com/rogpeppe/macaroon/bakery"
+)
+
+// SQLStorageSuite tests the SQL storage with an SQLite database,
+// using the pure-Go driver modernc.org/sqlite.
+type SQLStorageSuite struct {
+	db *sql.DB
+}
+
+var _ = gc.Suite(&SQLStorageSuite{})
+
+func (s *SQLStorageSuite) SetUpTest(c *gc.C) {
+	// Concurrent writers wait for each other rather
+	// than failing immediately.
+	dsn := "file:" + filepath.Join(c.MkDir(), "db") + "?_pragma=busy_timeout(10000)"
+	db, err := sql.Open("sqlite", dsn)
+	c.Assert(err, gc.IsNil)
+	s.db = db
+}
+
+func (s *SQLStorageSuite) TearDownTest(c *gc.C) {
+	s.db.Close()
+}
+
+func (s *SQLStorageSuite) newStorage(c *gc.C, table string) bakery.ExpiryStorage {
+	store, err := bakery.NewSQLStorage(bakery.SQLStorageParams{
+		DB:    s.db,
+		Table: table,
+	})
+	c.Assert(err, gc.IsNil)
+	return store
+}
+
+func (s *SQLStorageSuite) TestSQLStorage(c *gc.C) {
+	testStorage(c, s.newStorage(c, ""))
+}
+
+func (s *SQLStorageSuite) TestConcurrentSQLStorage(c *gc.C) {
+	testConcurrentStorage(c, s.newStorage(c, ""))
+}
+
+func (s *SQLStorageSuite) TestSQLStorageExpiry(c *gc.C) {
+	testStorageExpiry(c, s.newStorage(c, ""))
+}
+
+func (s *SQLStorageSuite) TestSQLStorageGetMulti(c *gc.C) {
+	testStorageGetMulti(c, s.newStorage(c, ""))
+}
+
+func (s *SQLStorageSuite) TestAwkwardLocations(c *gc.C) {
+	store := s.newStorage(c, "")
+	for i, loc := range awkwardLocations {
+		err := store.Put(loc, awkwardLocations[(i+1)%len(awkwardLocations)])
+		c.Assert(err, gc.IsNil, gc.Commentf("location %q", loc))
+	}
+	for i, loc := range awkwardLocations {
+		item, err := store.Get(loc)
+		c.Assert(err, gc.IsNil, gc.Commentf("location %q", loc))
+		c.Assert(item, gc.Equals, awkwardLocations[(i+1)%len(awkwardLocations)])
+	}
+}
+
+func (s *SQLStorageSuite) TestSharedDatabase(c *gc.C) {
+	store0 := s.newStorage(c, "")
+	// Creating the second storage finds the schema
+	// already migrated.
+	store1 := s.newStorage(c, "")
+	err := store0.PutWithExpiry("foo", "bar", time.Now().Add(time.Hour))
+	c.Assert(err, gc.IsNil)
+	item, err := store1.Get("foo")
+	c.Assert(err, gc.IsNil)
+	c.Assert(item, gc.Equals, "bar")
+
+	err = store1.Del("foo")
+	c.Assert(err, gc.IsNil)
+	_, err = store0.Get("foo")
+	c.Assert(err, gc.Equals, bakery.ErrNotFound)
+}
+
+func (s *SQLStorageSuite) TestSchemaVersion(c *gc.C) {
+	s.newStorage(c, "")
+	var version int
+	err := s.db.QueryRow(`SELECT version FROM macaroon_storage_version`).Scan(&version)
+	c.Assert(err, gc.IsNil)
+	c.Assert(version, gc.Equals, 2)
+
+	_, err = s.db.Exec(`UPDATE macaroon_storage_version SET version = 99`)
+	c.Assert(err, gc.IsNil)
+	_, err = bakery.NewSQLStorage(bakery.SQLStorageParams{
+		DB: s.db,
+	})
+	c.Assert(err, gc.ErrorMatches, `cannot migrate SQL storage schema: schema version 99 is newer than this code supports \(2\)`)
+}
+
+func (s *SQLStorageSuite) TestSeparateTables(c *gc.C) {
+	store0 := s.newStorage(c, "store0")
+	store1 := s.newStorage(c, "store1")
+	err := store0.Put("foo", "bar")
+	c.Assert(err, gc.IsNil)
+	_, err = store1.Get("foo")
+	c.Assert(err, gc.Equals, bakery.ErrNotFound)
+}
+
+func (s *SQLStorageSuite) TestInvalidTableName(c *gc.C) {
+	_, err := bakery.NewSQLStorage(bakery.SQLStorageParams{
+		DB:    s.db,
+		Table: "foo; DROP TABLE bar",
+	})
+	c.Assert(err, gc.ErrorMatches, `invalid table name "foo; DROP TABLE bar"`)
+}
+
+func (s *SQLStorageSuite) TestConcurrentPutsToOneLocation(c *gc.C) {
+	store := s.newStorage(c, "")
+	const n = 8
+	done := make(chan struct{})
+	for i := 0; i < n; i++ {
+		i := i
+		go func() {
+			defer func() {
+				done <- struct{}{}
+			}()
+			for j := 0; j < 10; j++ {
+				err := store.Put("foo", fmt.Sprint(i))
+				c.Check(err, gc.IsNil)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		<-done
+	}
+	item, err := store.Get("foo")
+	c.Assert(err, gc.IsNil)
+	c.Assert(item, gc.Matches, "[0-9]")
+	var count int
+	err = s.db.QueryRow(`SELECT COUNT(*) FROM macaroon_storage`).Scan(&count)
+	c.Assert(err, gc.IsNil)
+	c.Assert(count, gc.Equals, 1)
+}
+
+func (s *SQLStorageSuite) TestConcurrentMigration(c *gc.C) {
+	// Several replicas starting at once with an empty
+	// database all succeed.
+	const n = 4
+	done := make(chan struct{})
+	for i := 0; i < n; i++ {
+		go func() {
+			defer func() {
+				done <- struct{}{}
+			}()
+			_, err := bakery.NewSQLStorage(bakery.SQLStorageParams{
+				DB: s.db,
+			})
+			c.Check(err, gc.IsNil)
+		}()
+	}
+	for i := 0; i < n; i++ {
+		<-done
+	}
+	var count int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM macaroon_storage_version`).Scan(&count)
+	c.Assert(err, gc.IsNil)
+	c.Assert(count, gc.Equals, 1)
+}
+
+func (s *SQLStorageSuite) TestUnknownDialect(c *gc.C) {
+	_, err := bakery.NewSQLStorage(bakery.SQLStorageParams{
+		DB:      s.db,
+		Dialect: 99,
+	})
+	c.Assert(err, gc.ErrorMatches, `unknown SQL dialect 99`)
+}
@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"sync"
+	"time"
 )
 
 // Storage defines storage for macaroons.
@@ -26,50 +28,177 @@ type Storage interface {
 
 var ErrNotFound = errors.New("item not found")
 
+// ExpiryStorage is implemented by Storage implementations that
+// can remove items once they have expired. When the service's
+// store implements ExpiryStorage, the root keys of macaroons with
+// time-before caveats are stored with an expiry time, so that
+// they do not stay in the store forever.
+type ExpiryStorage interface {
+	Storage
+
+	// PutWithExpiry is like Put except that the item will
+	// expire at the given time. An expired item may be
+	// removed at any time; Get never returns one.
+	PutWithExpiry(location string, item string, expiry time.Time) error
+
+	// RemoveExpired removes all the items that
+	// expired before the given time.
+	RemoveExpired(now time.Time) error
+}
+
+// BatchStorage is implemented by Storage implementations that
+// can retrieve several items more efficiently than by calling
+// Get for each one - for example because each call to Get
+// needs a round trip to a remote server. When the service's
+// store implements BatchStorage, Request.Check looks up the
+// root keys of all the request's macaroons with a single call
+// to GetMulti.
+type BatchStorage interface {
+	Storage
+
+	// GetMulti retrieves the items at the given locations.
+	// The returned map holds an entry for each location
+	// that holds an item; other locations are omitted.
+	GetMulti(locations []string) (map[string]string, error)
+}
+
+// getMulti retrieves the items at the given locations
+// from store, using GetMulti if store implements
+// BatchStorage and calling Get for each location
+// otherwise.
+func getMulti(store Storage, locations []string) (map[string]string, error) {
+	if store, ok := store.(BatchStorage); ok {
+		return store.GetMulti(locations)
+	}
+	items := make(map[string]string)
+	for _, location := range locations {
+		item, err := store.Get(location)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		items[location] = item
+	}
+	return items, nil
+}
+
+// CollectGarbage calls store.RemoveExpired every interval
+// until stop is closed. It is intended to be run in its
+// own goroutine. Errors are logged.
+func CollectGarbage(store ExpiryStorage, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if err := store.RemoveExpired(now); err != nil {
+				log.Printf("cannot remove expired items from storage: %v", err)
+			}
+		}
+	}
+}
+
 // NewMemStorage returns an implementation of Storage
-// that stores all items in memory.
-func NewMemStorage() Storage {
+// that stores all items in memory. Expired items are
+// only removed when RemoveExpired is called.
+//
+// The returned value also implements BatchStorage.
+func NewMemStorage() ExpiryStorage {
 	return &memStorage{
-		values: make(map[string]string),
+		values: make(map[string]memItem),
 	}
 }
 
 type memStorage struct {
 	mu     sync.Mutex
-	values map[string]string
+	values map[string]memItem
+}
+
+// memItem holds an item stored in a memStorage.
+type memItem struct {
+	item string
+
+	// expiry holds the expiry time of the item,
+	// or the zero time if it never expires.
+	expiry time.Time
+}
+
+// expired reports whether the item has expired at the given time.
+func (item memItem) expired(now time.Time) bool {
+	return !item.expiry.IsZero() && !now.Before(item.expiry)
+}
+
+func (s *memStorage) Put(location, item string) error {
+	return s.PutWithExpiry(location, item, time.Time{})
 }
 
-func (s memStorage) Put(location, item string) error {
-	logf("storage.Put[%q] %q", location, item)
+func (s *memStorage) PutWithExpiry(location, item string, expiry time.Time) error {
+	logf("storage.Put[%q] %q (expiry %v)", location, item, expiry)
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.values[location] = item
+	s.values[location] = memItem{
+		item:   item,
+		expiry: expiry,
+	}
 	return nil
 }
 
-func (s memStorage) Get(location string) (string, error) {
+func (s *memStorage) Get(location string) (string, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	item, ok := s.values[location]
-	if !ok {
+	if !ok || item.expired(time.Now()) {
 		logf("storage.Get[%q] -> not found", location)
 		return "", ErrNotFound
 	}
-	logf("storage.Get[%q] -> %q", location, item)
-	return item, nil
+	logf("storage.Get[%q] -> %q", location, item.item)
+	return item.item, nil
+}
+
+func (s *memStorage) GetMulti(locations []string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	items := make(map[string]string)
+	for _, location := range locations {
+		if item, ok := s.values[location]; ok && !item.expired(now) {
+			items[location] = item.item
+		}
+	}
+	logf("storage.GetMulti[%q] -> %d items", locations, len(items))
+	return items, nil
 }
 
-func (s memStorage) Del(location string) error {
+func (s *memStorage) Del(location string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	delete(s.values, location)
 	return nil
 }
 
+func (s *memStorage) RemoveExpired(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for location, item := range s.values {
+		if item.expired(now) {
+			delete(s.values, location)
+		}
+	}
+	return nil
+}
+
 // storageItem is the format used to store items in
 // the store.
 type storageItem struct {
 	RootKey []byte
+
+	// Expiry holds the time after which the macaroon
+	// can no longer be used, if known.
+	Expiry *time.Time `json:",omitempty"`
 }
 
 // storage is a thin wrapper around Storage that
@@ -91,10 +220,35 @@ func (s storage) Get(location string) (*storageItem, error) {
 	return &item, nil
 }
 
+// GetMulti returns the items at the given locations. An item
+// that cannot be unmarshaled is logged and omitted, so that
+// it does not prevent the others from being used.
+func (s storage) GetMulti(locations []string) (map[string]*storageItem, error) {
+	itemStrs, err := getMulti(s.store, locations)
+	if err != nil {
+		return nil, err
+	}
+	items := make(map[string]*storageItem)
+	for location, itemStr := range itemStrs {
+		var item storageItem
+		if err := json.Unmarshal([]byte(itemStr), &item); err != nil {
+			log.Printf("warning: badly formatted item in store at %q: %v", location, err)
+			continue
+		}
+		items[location] = &item
+	}
+	return items, nil
+}
+
 func (s storage) Put(location string, item *storageItem) error {
 	data, err := json.Marshal(item)
 	if err != nil {
 		panic(fmt.Errorf("cannot marshal storage item: %v", err))
 	}
+	if item.Expiry != nil {
+		if store, ok := s.store.(ExpiryStorage); ok {
+			return store.PutWithExpiry(location, string(data), *item.Expiry)
+		}
+	}
 	return s.store.Put(location, string(data))
 }
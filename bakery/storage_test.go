@@ -2,6 +2,7 @@ package bakery_test
 
 import (
 	"fmt"
+	"time"
 
 	gc "gopkg.in/check.v1"
 
@@ -13,7 +14,22 @@ type StorageSuite struct{}
 var _ = gc.Suite(&StorageSuite{})
 
 func (*StorageSuite) TestMemStorage(c *gc.C) {
-	store := bakery.NewMemStorage()
+	testStorage(c, bakery.NewMemStorage())
+}
+
+func (*StorageSuite) TestConcurrentMemStorage(c *gc.C) {
+	testConcurrentStorage(c, bakery.NewMemStorage())
+}
+
+func (*StorageSuite) TestMemStorageExpiry(c *gc.C) {
+	testStorageExpiry(c, bakery.NewMemStorage())
+}
+
+func (*StorageSuite) TestMemStorageGetMulti(c *gc.C) {
+	testStorageGetMulti(c, bakery.NewMemStorage())
+}
+
+func testStorage(c *gc.C, store bakery.Storage) {
 	err := store.Put("foo", "bar")
 	c.Assert(err, gc.IsNil)
 	item, err := store.Get("foo")
@@ -38,11 +54,10 @@ func (*StorageSuite) TestMemStorage(c *gc.C) {
 	c.Assert(item, gc.Equals, "")
 }
 
-func (*StorageSuite) TestConcurrentMemStorage(c *gc.C) {
+func testConcurrentStorage(c *gc.C, store bakery.Storage) {
 	// If locking is not done right, this test will
 	// definitely trigger the race detector.
 	done := make(chan struct{})
-	store := bakery.NewMemStorage()
 	for i := 0; i < 3; i++ {
 		i := i
 		go func() {
@@ -60,3 +75,103 @@ func (*StorageSuite) TestConcurrentMemStorage(c *gc.C) {
 		<-done
 	}
 }
+
+func testStorageExpiry(c *gc.C, store bakery.ExpiryStorage) {
+	now := time.Now()
+	err := store.PutWithExpiry("past", "a", now.Add(-time.Second))
+	c.Assert(err, gc.IsNil)
+	err = store.PutWithExpiry("future", "b", now.Add(time.Hour))
+	c.Assert(err, gc.IsNil)
+	err = store.Put("forever", "c")
+	c.Assert(err, gc.IsNil)
+
+	// Expired items are never returned.
+	_, err = store.Get("past")
+	c.Assert(err, gc.Equals, bakery.ErrNotFound)
+	item, err := store.Get("future")
+	c.Assert(err, gc.IsNil)
+	c.Assert(item, gc.Equals, "b")
+
+	err = store.RemoveExpired(now.Add(2 * time.Hour))
+	c.Assert(err, gc.IsNil)
+	_, err = store.Get("future")
+	c.Assert(err, gc.Equals, bakery.ErrNotFound)
+	item, err = store.Get("forever")
+	c.Assert(err, gc.IsNil)
+	c.Assert(item, gc.Equals, "c")
+
+	// Putting an item without an expiry time
+	// removes any previous expiry time.
+	err = store.PutWithExpiry("x", "d", now.Add(-time.Second))
+	c.Assert(err, gc.IsNil)
+	err = store.Put("x", "e")
+	c.Assert(err, gc.IsNil)
+	item, err = store.Get("x")
+	c.Assert(err, gc.IsNil)
+	c.Assert(item, gc.Equals, "e")
+}
+
+func testStorageGetMulti(c *gc.C, store bakery.ExpiryStorage) {
+	var locations []string
+	for i := 0; i < 250; i++ {
+		loc := fmt.Sprint("loc", i)
+		locations = append(locations, loc)
+		if i%2 == 0 {
+			err := store.Put(loc, fmt.Sprint("item", i))
+			c.Assert(err, gc.IsNil)
+		}
+	}
+	err := store.PutWithExpiry("expired", "x", time.Now().Add(-time.Second))
+	c.Assert(err, gc.IsNil)
+	locations = append(locations, "expired", "loc0")
+
+	items, err := store.(bakery.BatchStorage).GetMulti(locations)
+	c.Assert(err, gc.IsNil)
+	c.Assert(items, gc.HasLen, 125)
+	for i := 0; i < 250; i += 2 {
+		c.Assert(items[fmt.Sprint("loc", i)], gc.Equals, fmt.Sprint("item", i))
+	}
+
+	items, err = store.(bakery.BatchStorage).GetMulti(nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(items, gc.HasLen, 0)
+}
+
+func (*StorageSuite) TestCollectGarbage(c *gc.C) {
+	store := &removeCountingStorage{
+		ExpiryStorage: bakery.NewMemStorage(),
+		removed:       make(chan time.Time, 10),
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		bakery.CollectGarbage(store, time.Millisecond, stop)
+		close(done)
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-store.removed:
+		case <-time.After(5 * time.Second):
+			c.Fatalf("RemoveExpired not called")
+		}
+	}
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("CollectGarbage did not stop")
+	}
+}
+
+type removeCountingStorage struct {
+	bakery.ExpiryStorage
+	removed chan time.Time
+}
+
+func (s *removeCountingStorage) RemoveExpired(now time.Time) error {
+	select {
+	case s.removed <- now:
+	default:
+	}
+	return s.ExpiryStorage.RemoveExpired(now)
+}
@@ -3,6 +3,7 @@ package macaroon_test
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"fmt"
 	"testing"
 
 	"github.com/rogpeppe/macaroon"
@@ -45,6 +46,7 @@ func benchmarkVerify(b *testing.B, mspecs []macaroonSpec) {
 	check := func(string) error {
 		return nil
 	}
+	b.ReportAllocs()
 	b.ResetTimer()
 	for i := b.N - 1; i >= 0; i-- {
 		err := primary.Verify(rootKey, check, discharges)
@@ -68,6 +70,90 @@ func BenchmarkVerifySmall(b *testing.B) {
 	}})
 }
 
+// manyCaveatSpecs returns a primary macaroon spec
+// with n first party caveats.
+func manyCaveatSpecs(n int) []macaroonSpec {
+	spec := macaroonSpec{
+		rootKey: "root-key",
+		id:      "root-id",
+	}
+	for i := 0; i < n; i++ {
+		spec.caveats = append(spec.caveats, caveat{
+			condition: fmt.Sprintf("condition %d", i),
+		})
+	}
+	return []macaroonSpec{spec}
+}
+
+// manyDischargeSpecs returns specs for a primary macaroon
+// with n third party caveats, each discharged by
+// a discharge macaroon with a first party caveat.
+// The discharges are in reverse order of their caveats
+// so that a linear scan would be slowest.
+func manyDischargeSpecs(n int) []macaroonSpec {
+	specs := []macaroonSpec{{
+		rootKey: "root-key",
+		id:      "root-id",
+	}}
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("discharge %d", i)
+		specs[0].caveats = append(specs[0].caveats, caveat{
+			condition: id,
+			location:  "somewhere",
+			rootKey:   id + " key",
+		})
+	}
+	for i := n - 1; i >= 0; i-- {
+		id := fmt.Sprintf("discharge %d", i)
+		specs = append(specs, macaroonSpec{
+			rootKey:  id + " key",
+			id:       id,
+			location: "somewhere",
+			caveats: []caveat{{
+				condition: id + " condition",
+			}},
+		})
+	}
+	return specs
+}
+
+func BenchmarkVerify100Caveats(b *testing.B) {
+	benchmarkVerify(b, manyCaveatSpecs(100))
+}
+
+func BenchmarkVerify500Caveats(b *testing.B) {
+	benchmarkVerify(b, manyCaveatSpecs(500))
+}
+
+func BenchmarkVerify100Discharges(b *testing.B) {
+	benchmarkVerify(b, manyDischargeSpecs(100))
+}
+
+func BenchmarkVerify500Discharges(b *testing.B) {
+	benchmarkVerify(b, manyDischargeSpecs(500))
+}
+
+// TestVerifyAllocs checks that verification does not allocate
+// for each caveat, other than for the condition string that
+// is passed to the checker.
+func TestVerifyAllocs(t *testing.T) {
+	allocs := func(n int) float64 {
+		rootKey, primary, discharges := makeMacaroons(manyCaveatSpecs(n))
+		check := func(string) error {
+			return nil
+		}
+		return testing.AllocsPerRun(20, func() {
+			if err := primary.Verify(rootKey, check, discharges); err != nil {
+				t.Fatalf("verification failed: %v", err)
+			}
+		})
+	}
+	small, large := allocs(100), allocs(500)
+	if perCaveat := (large - small) / 400; perCaveat > 1 {
+		t.Fatalf("verification makes %.1f allocations per caveat; want at most 1", perCaveat)
+	}
+}
+
 func BenchmarkMarshalJSON(b *testing.B) {
 	rootKey := randomBytes(24)
 	id := base64.StdEncoding.EncodeToString(randomBytes(100))
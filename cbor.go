@@ -0,0 +1,486 @@
+package macaroon
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// The CBOR (RFC 7049) encoding of a macaroon is a map with
+// the following text string keys:
+//
+//	"v": the binary format version of the macaroon (unsigned integer)
+//	"a": the name of the macaroon's scheme (text string; omitted for SchemeNative;
+//	     informational only - see UnmarshalCBOR)
+//	"l": the location (text string; omitted if empty)
+//	"i": the identifier (byte string)
+//	"c": the caveats (array)
+//	"s": the signature (byte string)
+//
+// Each caveat is encoded as a map with the following keys:
+//
+//	"i": the caveat id (byte string)
+//	"v": the verification id (byte string; omitted for first party caveats)
+//	"l": the location (text string; omitted if empty)
+//
+// The encoding of a Slice is an array holding the encoding of
+// each macaroon in turn. Unknown map keys are ignored when
+// decoding, and locations may be byte strings if they are
+// not valid UTF-8.
+
+// CBOR major types.
+const (
+	cborUint  = 0
+	cborBytes = 2
+	cborText  = 3
+	cborArray = 4
+	cborMap   = 5
+	cborTag   = 6
+	cborOther = 7
+)
+
+var cborTypeNames = []string{
+	0: "unsigned integer",
+	1: "negative integer",
+	2: "byte string",
+	3: "text string",
+	4: "array",
+	5: "map",
+	6: "tag",
+	7: "simple value",
+}
+
+// maxCBORDepth holds the maximum nesting depth
+// of values skipped when decoding.
+const maxCBORDepth = 32
+
+// MarshalCBOR returns the CBOR encoding of m.
+func (m *Macaroon) MarshalCBOR() ([]byte, error) {
+	return m.appendCBOR(nil), nil
+}
+
+// appendCBOR appends the CBOR encoding of m to buf.
+func (m *Macaroon) appendCBOR(buf []byte) []byte {
+	loc := m.dataBytes(m.location)
+	nfields := 4
+	if len(loc) > 0 {
+		nfields++
+	}
+	if m.scheme != SchemeNative {
+		nfields++
+	}
+	buf = appendCBORHead(buf, cborMap, uint64(nfields))
+	buf = appendCBORText(buf, "v")
+	buf = appendCBORHead(buf, cborUint, uint64(m.version))
+	if m.scheme != SchemeNative {
+		buf = appendCBORText(buf, "a")
+		buf = appendCBORText(buf, m.scheme.String())
+	}
+	if len(loc) > 0 {
+		buf = appendCBORText(buf, "l")
+		buf = appendCBORString(buf, loc)
+	}
+	buf = appendCBORText(buf, "i")
+	buf = appendCBORBytes(buf, m.dataBytes(m.id))
+	buf = appendCBORText(buf, "c")
+	buf = appendCBORHead(buf, cborArray, uint64(len(m.caveats)))
+	for _, cav := range m.caveats {
+		vid, loc := m.dataBytes(cav.verificationId), m.dataBytes(cav.location)
+		nfields := 1
+		if len(vid) > 0 {
+			nfields++
+		}
+		if len(loc) > 0 {
+			nfields++
+		}
+		buf = appendCBORHead(buf, cborMap, uint64(nfields))
+		buf = appendCBORText(buf, "i")
+		buf = appendCBORBytes(buf, m.dataBytes(cav.caveatId))
+		if len(vid) > 0 {
+			buf = appendCBORText(buf, "v")
+			buf = appendCBORBytes(buf, vid)
+		}
+		if len(loc) > 0 {
+			buf = appendCBORText(buf, "l")
+			buf = appendCBORString(buf, loc)
+		}
+	}
+	buf = appendCBORText(buf, "s")
+	buf = appendCBORBytes(buf, m.sig)
+	return buf
+}
+
+// UnmarshalCBOR unmarshals the CBOR encoding of a macaroon
+// as produced by MarshalCBOR. If the encoding does not
+// specify a version, the macaroon is given version V1
+// unless some of its fields are too big for that format,
+// in which case it has version V2.
+//
+// The scheme of m is retained: a scheme in the encoding is
+// not trusted, so it is only used to make verification fail
+// when it differs from the scheme of the verifier.
+func (m *Macaroon) UnmarshalCBOR(data []byte) error {
+	d := &cborDecoder{data: data}
+	if err := m.decodeCBOR(d); err != nil {
+		return fmt.Errorf("cannot unmarshal CBOR data: %v", err)
+	}
+	if len(d.data) > 0 {
+		return fmt.Errorf("cannot unmarshal CBOR data: unexpected trailing data")
+	}
+	return nil
+}
+
+// cborCaveat holds a caveat decoded from CBOR.
+type cborCaveat struct {
+	id, verificationId []byte
+	location           string
+}
+
+// decodeCBOR decodes a macaroon from d.
+func (m *Macaroon) decodeCBOR(d *cborDecoder) error {
+	n, err := d.expect(cborMap)
+	if err != nil {
+		return err
+	}
+	var (
+		version    Version
+		hasVersion bool
+		scheme     Scheme
+		hasScheme  bool
+		id, sig    []byte
+		hasId      bool
+		location   string
+		caveats    []cborCaveat
+	)
+	for i := uint64(0); i < n; i++ {
+		key, err := d.text()
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "v":
+			v, err := d.expect(cborUint)
+			if err != nil {
+				return err
+			}
+			version = Version(v)
+			if uint64(version) != v || !version.valid() {
+				return fmt.Errorf("unknown macaroon version %d", v)
+			}
+			hasVersion = true
+		case "a":
+			var name string
+			if name, err = d.text(); err == nil {
+				scheme, err = parseScheme(name)
+				hasScheme = true
+			}
+		case "l":
+			location, err = d.location()
+		case "i":
+			id, err = d.bytes()
+			hasId = true
+		case "c":
+			caveats, err = decodeCBORCaveats(d)
+		case "s":
+			sig, err = d.bytes()
+		default:
+			err = d.skip(0)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !hasId {
+		return fmt.Errorf("macaroon identifier not found")
+	}
+	if sig == nil {
+		return fmt.Errorf("macaroon signature not found")
+	}
+	if hasVersion {
+		err = m.initCBOR(version, location, id, caveats, sig)
+	} else if err = m.initCBOR(V1, location, id, caveats, sig); err != nil {
+		if err1 := m.initCBOR(V2, location, id, caveats, sig); err1 == nil {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	// The scheme is recorded so that verification can fail if
+	// it does not match the verifier's, but it is never used
+	// to calculate signatures.
+	m.encodedScheme, m.hasEncodedScheme = scheme, hasScheme
+	return nil
+}
+
+func decodeCBORCaveats(d *cborDecoder) ([]cborCaveat, error) {
+	n, err := d.expect(cborArray)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(d.data)) {
+		// Each caveat takes at least one byte.
+		return nil, errCBORTooShort
+	}
+	caveats := make([]cborCaveat, 0, n)
+	for i := uint64(0); i < n; i++ {
+		nfields, err := d.expect(cborMap)
+		if err != nil {
+			return nil, err
+		}
+		var cav cborCaveat
+		hasId := false
+		for j := uint64(0); j < nfields; j++ {
+			key, err := d.text()
+			if err != nil {
+				return nil, err
+			}
+			switch key {
+			case "i":
+				cav.id, err = d.bytes()
+				hasId = true
+			case "v":
+				cav.verificationId, err = d.bytes()
+			case "l":
+				cav.location, err = d.location()
+			default:
+				err = d.skip(0)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !hasId {
+			return nil, fmt.Errorf("caveat %d has no id", i)
+		}
+		caveats = append(caveats, cav)
+	}
+	return caveats, nil
+}
+
+// initCBOR initializes m from the given decoded fields,
+// using the given binary format version.
+func (m *Macaroon) initCBOR(version Version, loc string, id []byte, caveats []cborCaveat, sig []byte) error {
+	m.version = version
+	if err := m.init(id, loc); err != nil {
+		return err
+	}
+	for _, cav := range caveats {
+		if _, err := m.appendCaveat(cav.id, cav.verificationId, cav.location); err != nil {
+			return err
+		}
+	}
+	m.sig = append([]byte(nil), sig...)
+	return nil
+}
+
+// MarshalCBOR returns the CBOR encoding of s: an array
+// holding the encoding of each macaroon in s.
+func (s Slice) MarshalCBOR() ([]byte, error) {
+	buf := appendCBORHead(nil, cborArray, uint64(len(s)))
+	for _, m := range s {
+		buf = m.appendCBOR(buf)
+	}
+	return buf, nil
+}
+
+// UnmarshalCBOR unmarshals the CBOR encoding of a slice
+// of macaroons as produced by Slice.MarshalCBOR.
+func (s *Slice) UnmarshalCBOR(data []byte) error {
+	d := &cborDecoder{data: data}
+	n, err := d.expect(cborArray)
+	if err != nil {
+		return fmt.Errorf("cannot unmarshal CBOR data: %v", err)
+	}
+	if n > uint64(len(d.data)) {
+		return fmt.Errorf("cannot unmarshal CBOR data: %v", errCBORTooShort)
+	}
+	ms := (*s)[:0]
+	for i := uint64(0); i < n; i++ {
+		var m Macaroon
+		if err := m.decodeCBOR(d); err != nil {
+			return fmt.Errorf("cannot unmarshal macaroon %d: %v", i, err)
+		}
+		ms = append(ms, &m)
+	}
+	if len(d.data) > 0 {
+		return fmt.Errorf("cannot unmarshal CBOR data: unexpected trailing data")
+	}
+	*s = ms
+	return nil
+}
+
+// appendCBORHead appends the head of a CBOR data item
+// with the given major type and argument.
+func appendCBORHead(buf []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(buf, major|byte(n))
+	case n <= 0xff:
+		return append(buf, major|24, byte(n))
+	case n <= 0xffff:
+		return append(buf, major|25, byte(n>>8), byte(n))
+	case n <= 0xffffffff:
+		return append(buf, major|26, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(buf, major|27,
+		byte(n>>56), byte(n>>48), byte(n>>40), byte(n>>32),
+		byte(n>>24), byte(n>>16), byte(n>>8), byte(n),
+	)
+}
+
+func appendCBORBytes(buf []byte, data []byte) []byte {
+	buf = appendCBORHead(buf, cborBytes, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func appendCBORText(buf []byte, s string) []byte {
+	buf = appendCBORHead(buf, cborText, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// appendCBORString appends data as a text string if
+// it is valid UTF-8, or as a byte string otherwise.
+func appendCBORString(buf []byte, data []byte) []byte {
+	major := byte(cborText)
+	if !utf8.Valid(data) {
+		major = cborBytes
+	}
+	buf = appendCBORHead(buf, major, uint64(len(data)))
+	return append(buf, data...)
+}
+
+var errCBORTooShort = fmt.Errorf("unexpected end of data")
+
+// cborDecoder decodes the subset of CBOR used
+// to encode macaroons.
+type cborDecoder struct {
+	// data holds the data remaining to be decoded.
+	data []byte
+}
+
+// head decodes the head of a data item, returning its major
+// type and argument. Indefinite-length items are not
+// supported.
+func (d *cborDecoder) head() (major byte, n uint64, err error) {
+	if len(d.data) == 0 {
+		return 0, 0, errCBORTooShort
+	}
+	major, info := d.data[0]>>5, d.data[0]&0x1f
+	d.data = d.data[1:]
+	if info < 24 {
+		return major, uint64(info), nil
+	}
+	if info > 27 {
+		return 0, 0, fmt.Errorf("unsupported CBOR additional information %d", info)
+	}
+	size := 1 << (info - 24)
+	if len(d.data) < size {
+		return 0, 0, errCBORTooShort
+	}
+	for _, b := range d.data[0:size] {
+		n = n<<8 | uint64(b)
+	}
+	d.data = d.data[size:]
+	return major, n, nil
+}
+
+// expect decodes the head of a data item of the
+// given major type, returning its argument.
+func (d *cborDecoder) expect(major byte) (uint64, error) {
+	got, n, err := d.head()
+	if err != nil {
+		return 0, err
+	}
+	if got != major {
+		return 0, fmt.Errorf("unexpected %s, want %s", cborTypeNames[got], cborTypeNames[major])
+	}
+	return n, nil
+}
+
+// payload returns the next n bytes of data.
+func (d *cborDecoder) payload(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)) {
+		return nil, errCBORTooShort
+	}
+	data := d.data[0:n]
+	d.data = d.data[n:]
+	return data, nil
+}
+
+// bytes decodes a byte string.
+func (d *cborDecoder) bytes() ([]byte, error) {
+	n, err := d.expect(cborBytes)
+	if err != nil {
+		return nil, err
+	}
+	return d.payload(n)
+}
+
+// text decodes a text string.
+func (d *cborDecoder) text() (string, error) {
+	n, err := d.expect(cborText)
+	if err != nil {
+		return "", err
+	}
+	data, err := d.payload(n)
+	if err != nil {
+		return "", err
+	}
+	if !utf8.Valid(data) {
+		return "", fmt.Errorf("invalid UTF-8 in text string")
+	}
+	return string(data), nil
+}
+
+// location decodes a location, which may be
+// either a text string or a byte string.
+func (d *cborDecoder) location() (string, error) {
+	major, n, err := d.head()
+	if err != nil {
+		return "", err
+	}
+	if major != cborText && major != cborBytes {
+		return "", fmt.Errorf("unexpected %s, want %s", cborTypeNames[major], cborTypeNames[cborText])
+	}
+	data, err := d.payload(n)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// skip skips over the next data item, which is
+// at the given nesting depth.
+func (d *cborDecoder) skip(depth int) error {
+	if depth > maxCBORDepth {
+		return fmt.Errorf("CBOR data nested too deeply")
+	}
+	major, n, err := d.head()
+	if err != nil {
+		return err
+	}
+	switch major {
+	case cborBytes, cborText:
+		_, err := d.payload(n)
+		return err
+	case cborArray, cborMap:
+		if major == cborMap {
+			if n > uint64(len(d.data))/2 {
+				return errCBORTooShort
+			}
+			n *= 2
+		}
+		for i := uint64(0); i < n; i++ {
+			if err := d.skip(depth + 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case cborTag:
+		return d.skip(depth + 1)
+	}
+	// Integers and simple values have no content
+	// beyond their head.
+	return nil
+}
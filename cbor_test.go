@@ -0,0 +1,271 @@
+package macaroon_test
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/rogpeppe/macaroon"
+)
+
+type cborSuite struct{}
+
+var _ = gc.Suite(&cborSuite{})
+
+func (*cborSuite) TestMarshalCBOR(c *gc.C) {
+	m, err := macaroon.NewWithParams(macaroon.NewParams{
+		RootKey:  []byte("key"),
+		Id:       []byte("id"),
+		Location: "loc",
+		Version:  macaroon.V2,
+	})
+	c.Assert(err, gc.IsNil)
+	err = m.AddFirstPartyCaveat("cav")
+	c.Assert(err, gc.IsNil)
+	data, err := m.MarshalCBOR()
+	c.Assert(err, gc.IsNil)
+	expect := "" +
+		"a5" + // map(5)
+		"6176" + "01" + // "v": 1
+		"616c" + "636c6f63" + // "l": "loc"
+		"6169" + "426964" + // "i": h'6964'
+		"6163" + "81" + // "c": array(1)
+		"a1" + "6169" + "43636176" + // {"i": h'636176'}
+		"6173" + "5820" + hex.EncodeToString(m.Signature()) // "s": h'...'
+	c.Assert(hex.EncodeToString(data), gc.Equals, expect)
+}
+
+func (*cborSuite) TestRoundTrip(c *gc.C) {
+	for _, vers := range []macaroon.Version{macaroon.V1, macaroon.V2} {
+		c.Logf("version %v", vers)
+		rootKey, s := newDischargedSlice(c, vers)
+		s.Bind()
+		for i, m0 := range s {
+			c.Logf("macaroon %d", i)
+			data, err := m0.MarshalCBOR()
+			c.Assert(err, gc.IsNil)
+			var m1 macaroon.Macaroon
+			err = m1.UnmarshalCBOR(data)
+			c.Assert(err, gc.IsNil)
+			assertEqualMacaroons(c, m0, &m1)
+			c.Assert(m1.Version(), gc.Equals, m0.Version())
+		}
+		data, err := s.MarshalCBOR()
+		c.Assert(err, gc.IsNil)
+		var s1 macaroon.Slice
+		err = s1.UnmarshalCBOR(data)
+		c.Assert(err, gc.IsNil)
+		assertEqualSlices(c, s, s1)
+		err = s1.Primary().Verify(rootKey, alwaysOK, s1.Discharges())
+		c.Assert(err, gc.IsNil)
+	}
+}
+
+func (*cborSuite) TestCrossFormat(c *gc.C) {
+	m0 := MustNew([]byte("root key"), "\xff binary id", "a location")
+	err := m0.AddFirstPartyCaveatBytes([]byte("\x01\x00 binary caveat"))
+	c.Assert(err, gc.IsNil)
+	err = m0.AddThirdPartyCaveat([]byte("3rd party key"), "third party", "elsewhere")
+	c.Assert(err, gc.IsNil)
+
+	// CBOR to binary.
+	cborData, err := m0.MarshalCBOR()
+	c.Assert(err, gc.IsNil)
+	var m1 macaroon.Macaroon
+	err = m1.UnmarshalCBOR(cborData)
+	c.Assert(err, gc.IsNil)
+	binData0, err := m0.MarshalBinary()
+	c.Assert(err, gc.IsNil)
+	binData1, err := m1.MarshalBinary()
+	c.Assert(err, gc.IsNil)
+	c.Assert(binData1, gc.DeepEquals, binData0)
+
+	// Binary to CBOR.
+	var m2 macaroon.Macaroon
+	err = m2.UnmarshalBinary(binData0)
+	c.Assert(err, gc.IsNil)
+	cborData2, err := m2.MarshalCBOR()
+	c.Assert(err, gc.IsNil)
+	c.Assert(cborData2, gc.DeepEquals, cborData)
+
+	// JSON to CBOR and back.
+	jsonData, err := m0.MarshalJSON()
+	c.Assert(err, gc.IsNil)
+	var m3 macaroon.Macaroon
+	err = m3.UnmarshalJSON(jsonData)
+	c.Assert(err, gc.IsNil)
+	cborData3, err := m3.MarshalCBOR()
+	c.Assert(err, gc.IsNil)
+	c.Assert(cborData3, gc.DeepEquals, cborData)
+	jsonData3, err := m1.MarshalJSON()
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(jsonData3), gc.Equals, string(jsonData))
+}
+
+func (*cborSuite) TestUnmarshalWithoutVersion(c *gc.C) {
+	// {"i": h'6964', "s": h'00'}
+	data, err := hex.DecodeString("a2" + "6169" + "426964" + "6173" + "4100")
+	c.Assert(err, gc.IsNil)
+	var m macaroon.Macaroon
+	err = m.UnmarshalCBOR(data)
+	c.Assert(err, gc.IsNil)
+	c.Assert(m.Id(), gc.Equals, "id")
+	c.Assert(m.Version(), gc.Equals, macaroon.V1)
+	c.Assert(m.Caveats(), gc.HasLen, 0)
+}
+
+func (*cborSuite) TestUnmarshalIgnoresUnknownKeys(c *gc.C) {
+	// {"x": [1, {"y": h''}], "i": h'6964', "s": h'00'}
+	data, err := hex.DecodeString("a3" + "6178" + "82" + "01" + "a1" + "6179" + "40" + "6169" + "426964" + "6173" + "4100")
+	c.Assert(err, gc.IsNil)
+	var m macaroon.Macaroon
+	err = m.UnmarshalCBOR(data)
+	c.Assert(err, gc.IsNil)
+	c.Assert(m.Id(), gc.Equals, "id")
+}
+
+var unmarshalCBORErrorTests = []struct {
+	about     string
+	data      string
+	expectErr string
+}{{
+	about:     "empty data",
+	data:      "",
+	expectErr: `cannot unmarshal CBOR data: unexpected end of data`,
+}, {
+	about:     "not a map",
+	data:      "80",
+	expectErr: `cannot unmarshal CBOR data: unexpected array, want map`,
+}, {
+	about:     "truncated identifier",
+	data:      "a1" + "6169" + "4269",
+	expectErr: `cannot unmarshal CBOR data: unexpected end of data`,
+}, {
+	about:     "no identifier",
+	data:      "a1" + "6173" + "4100",
+	expectErr: `cannot unmarshal CBOR data: macaroon identifier not found`,
+}, {
+	about:     "no signature",
+	data:      "a1" + "6169" + "426964",
+	expectErr: `cannot unmarshal CBOR data: macaroon signature not found`,
+}, {
+	about:     "unknown version",
+	data:      "a1" + "6176" + "05",
+	expectErr: `cannot unmarshal CBOR data: unknown macaroon version 5`,
+}, {
+	about:     "caveat without id",
+	data:      "a1" + "6163" + "81" + "a0",
+	expectErr: `cannot unmarshal CBOR data: caveat 0 has no id`,
+}, {
+	about:     "huge caveat count",
+	data:      "a1" + "6163" + "9bffffffffffffffff",
+	expectErr: `cannot unmarshal CBOR data: unexpected end of data`,
+}, {
+	about:     "indefinite length",
+	data:      "bf",
+	expectErr: `cannot unmarshal CBOR data: unsupported CBOR additional information 31`,
+}, {
+	about:     "trailing data",
+	data:      "a2" + "6169" + "426964" + "6173" + "4100" + "00",
+	expectErr: `cannot unmarshal CBOR data: unexpected trailing data`,
+}}
+
+func (*cborSuite) TestUnmarshalError(c *gc.C) {
+	for i, test := range unmarshalCBORErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		data, err := hex.DecodeString(test.data)
+		c.Assert(err, gc.IsNil)
+		var m macaroon.Macaroon
+		err = m.UnmarshalCBOR(data)
+		c.Assert(err, gc.ErrorMatches, test.expectErr)
+	}
+}
+
+func (*cborSuite) TestUnmarshalSliceError(c *gc.C) {
+	_, s := newDischargedSlice(c, macaroon.V2)
+	data, err := s.MarshalCBOR()
+	c.Assert(err, gc.IsNil)
+	var s1 macaroon.Slice
+	err = s1.UnmarshalCBOR(data[0 : len(data)-1])
+	c.Assert(err, gc.ErrorMatches, `cannot unmarshal macaroon 2: unexpected end of data`)
+
+	err = s1.UnmarshalCBOR([]byte{0xa0})
+	c.Assert(err, gc.ErrorMatches, `cannot unmarshal CBOR data: unexpected map, want array`)
+}
+
+func (*cborSuite) TestSchemeIsNotTrusted(c *gc.C) {
+	for _, scheme := range allSchemes {
+		c.Logf("scheme %v", scheme)
+		m0, err := macaroon.NewWithScheme([]byte("key"), "id", "", scheme)
+		c.Assert(err, gc.IsNil)
+		data, err := m0.MarshalCBOR()
+		c.Assert(err, gc.IsNil)
+
+		// The scheme in the encoding is not used.
+		var m1 macaroon.Macaroon
+		err = m1.UnmarshalCBOR(data)
+		c.Assert(err, gc.IsNil)
+		c.Assert(m1.Scheme(), gc.Equals, macaroon.SchemeNative)
+
+		// Verification with the encoded scheme succeeds; with
+		// any other scheme it fails, even if the signature
+		// would otherwise match.
+		for _, other := range allSchemes {
+			v := macaroon.NewVerifier(macaroon.VerifierParams{
+				Check:  alwaysOK,
+				Scheme: other,
+			})
+			err = v.Verify(&m1, []byte("key"))
+			switch {
+			case other == scheme:
+				c.Assert(err, gc.IsNil)
+			case scheme != macaroon.SchemeNative:
+				// SchemeNative is not recorded in the encoding.
+				c.Assert(err, gc.ErrorMatches, fmt.Sprintf(`macaroon encoded with scheme %v, not %v`, scheme, other))
+				c.Assert(err.(*macaroon.VerificationError).Kind, gc.Equals, macaroon.BadSignature)
+			}
+		}
+
+		// The scheme of the target macaroon is retained.
+		var m2 macaroon.Macaroon
+		m2.SetScheme(scheme)
+		err = m2.UnmarshalCBOR(data)
+		c.Assert(err, gc.IsNil)
+		c.Assert(m2.Scheme(), gc.Equals, scheme)
+		err = m2.Verify([]byte("key"), alwaysOK, nil)
+		c.Assert(err, gc.IsNil)
+	}
+}
+
+func (*cborSuite) TestEncodedSchemeMismatch(c *gc.C) {
+	// A macaroon minted with SchemeNative but encoded as
+	// if it used another scheme is rejected, even though
+	// its signature is valid for the verifier's scheme.
+	m0 := MustNew([]byte("key"), "id", "")
+	m0.SetScheme(macaroon.SchemeHMACSHA512)
+	data, err := m0.MarshalCBOR()
+	c.Assert(err, gc.IsNil)
+	var m1 macaroon.Macaroon
+	err = m1.UnmarshalCBOR(data)
+	c.Assert(err, gc.IsNil)
+	err = m1.Verify([]byte("key"), alwaysOK, nil)
+	c.Assert(err, gc.ErrorMatches, `macaroon encoded with scheme hmac-sha512, not native`)
+
+	// Decoding from another format forgets the encoded scheme.
+	data, err = m1.MarshalBinary()
+	c.Assert(err, gc.IsNil)
+	err = m1.UnmarshalBinary(data)
+	c.Assert(err, gc.IsNil)
+	err = m1.Verify([]byte("key"), alwaysOK, nil)
+	c.Assert(err, gc.IsNil)
+}
+
+func (*cborSuite) TestUnknownScheme(c *gc.C) {
+	// {"a": "foo"}
+	data, err := hex.DecodeString("a1" + "6161" + "63666f6f")
+	c.Assert(err, gc.IsNil)
+	var m macaroon.Macaroon
+	err = m.UnmarshalCBOR(data)
+	c.Assert(err, gc.ErrorMatches, `cannot unmarshal CBOR data: unknown signature scheme "foo"`)
+}
@@ -1,8 +1,12 @@
 package macaroon
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/sha512"
 	"fmt"
 	"hash"
 	"io"
@@ -20,6 +24,8 @@ func keyedHasher(key []byte) hash.Hash {
 	return hmac.New(sha256.New, key)
 }
 
+// makeKey makes a secretbox key from the given key, zero-padding
+// keys that are too short and hashing any others.
 func makeKey(key []byte) *[keyLen]byte {
 	if len(key) < keyLen {
 		var h [keyLen]byte
@@ -45,25 +51,416 @@ func newNonce(r io.Reader) (*[nonceLen]byte, error) {
 }
 
 func encrypt(key, text []byte, r io.Reader) ([]byte, error) {
+	return encryptWithKey(makeKey(key), text, r)
+}
+
+func encryptWithKey(key *[keyLen]byte, text []byte, r io.Reader) ([]byte, error) {
 	nonce, err := newNonce(r)
 	if err != nil {
 		return nil, err
 	}
 	out := make([]byte, 0, len(nonce)+secretbox.Overhead+len(text))
 	out = append(out, nonce[:]...)
-	return secretbox.Seal(out, text, nonce, makeKey(key)), nil
+	return secretbox.Seal(out, text, nonce, key), nil
 }
 
 func decrypt(key, ciphertext []byte) ([]byte, error) {
+	return decryptWithKey(makeKey(key), ciphertext)
+}
+
+func decryptWithKey(key *[keyLen]byte, ciphertext []byte) ([]byte, error) {
 	if len(ciphertext) < nonceLen+secretbox.Overhead {
 		return nil, fmt.Errorf("message too short")
 	}
 	var nonce [nonceLen]byte
 	copy(nonce[:], ciphertext)
 	ciphertext = ciphertext[nonceLen:]
-	text, ok := secretbox.Open(nil, ciphertext, &nonce, makeKey(key))
+	text, ok := secretbox.Open(nil, ciphertext, &nonce, key)
 	if !ok {
 		return nil, fmt.Errorf("decryption failure")
 	}
 	return text, nil
 }
+
+// Scheme identifies the cipher suite used to calculate the
+// signature of a macaroon, to encrypt the root keys of
+// its third party caveats and to bind discharge macaroons
+// to it.
+//
+// The scheme is not recorded in the binary or JSON forms of
+// a macaroon, so it must be agreed between the minter and
+// the verifier of a macaroon, and set with SetScheme when
+// unmarshaling. The CBOR form records the scheme unless
+// it is SchemeNative.
+type Scheme int
+
+const (
+	// SchemeNative is the scheme that has always been used
+	// by this package. It is not understood by any other
+	// macaroon implementation. Signatures are calculated
+	// with HMAC-SHA256 and third party caveat keys are
+	// encrypted with NaCl secretbox.
+	SchemeNative Scheme = iota
+
+	// SchemeLibmacaroons calculates signatures exactly
+	// as libmacaroons does, so that macaroons can be
+	// verified by, and can verify discharges from, other
+	// implementations.
+	SchemeLibmacaroons
+
+	// SchemeHMACSHA512 is like SchemeNative except that
+	// signatures are calculated with HMAC-SHA512, so they
+	// are 64 bytes long. Third party caveat keys are
+	// encrypted with NaCl secretbox, keyed with the first 32
+	// bytes of the signature.
+	SchemeHMACSHA512
+
+	// SchemeAESGCM is like SchemeNative except that third
+	// party caveat keys are encrypted with AES-256 in
+	// Galois/Counter mode, keyed with the signature.
+	SchemeAESGCM
+)
+
+var schemeNames = []string{
+	SchemeNative:       "native",
+	SchemeLibmacaroons: "libmacaroons",
+	SchemeHMACSHA512:   "hmac-sha512",
+	SchemeAESGCM:       "aes-gcm",
+}
+
+// String implements fmt.Stringer.
+func (s Scheme) String() string {
+	if s.valid() {
+		return schemeNames[s]
+	}
+	return fmt.Sprintf("Scheme(%d)", int(s))
+}
+
+// parseScheme returns the scheme with the given name.
+func parseScheme(name string) (Scheme, error) {
+	for s, sname := range schemeNames {
+		if sname == name {
+			return Scheme(s), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown signature scheme %q", name)
+}
+
+// valid reports whether s is a known scheme.
+func (s Scheme) valid() bool {
+	return s >= 0 && int(s) < len(schemeNames)
+}
+
+// newHash returns a new instance of the hash
+// used to calculate signatures.
+func (s Scheme) newHash() hash.Hash {
+	if s == SchemeHMACSHA512 {
+		return sha512.New()
+	}
+	return sha256.New()
+}
+
+// newHasher returns a hasher for calculating signatures
+// with the scheme.
+func (s Scheme) newHasher() *hasher {
+	return newHasherWith(s.newHash)
+}
+
+// keyGen is the key used by libmacaroons to derive
+// fixed-length keys from variable-length root keys.
+var keyGen = []byte("macaroons-key-generator")
+
+// zeroKey is the key used by libmacaroons to bind
+// a discharge macaroon to its primary macaroon.
+var zeroKey [keyLen]byte
+
+// deriveKey returns the key that will actually be used to
+// sign a macaroon minted with the given root key.
+func (s Scheme) deriveKey(rootKey []byte) []byte {
+	if s == SchemeLibmacaroons {
+		return keyedHash(keyGen, rootKey)
+	}
+	return rootKey
+}
+
+// sign returns the signature of a new macaroon with
+// the given identifier, signed with the given derived
+// root key.
+func (s Scheme) sign(key, id []byte) []byte {
+	return cloneBytes(s.newHasher().keyedHash(key, id, nil))
+}
+
+// caveatSig returns the signature of a macaroon
+// after adding a caveat with the given caveat
+// and verification ids to a macaroon with
+// the given signature.
+func (s Scheme) caveatSig(sig, caveatId, verificationId []byte) []byte {
+	return cloneBytes(s.newHasher().caveatSig(s, sig, caveatId, verificationId))
+}
+
+// encryptKey encrypts the derived root key of a third
+// party caveat with the given macaroon signature,
+// returning the verification id for the caveat.
+func (s Scheme) encryptKey(sig, derivedKey []byte, r io.Reader) ([]byte, error) {
+	return s.seal(sig, derivedKey, r)
+}
+
+// decryptKey decrypts the given verification id
+// with the given macaroon signature, returning
+// the derived root key of the third party caveat.
+func (s Scheme) decryptKey(sig, verificationId []byte) ([]byte, error) {
+	return s.open(sig, verificationId)
+}
+
+// seal encrypts the given text with the scheme's cipher,
+// keyed with the given key, which must be at least
+// keyLen bytes long.
+func (s Scheme) seal(key, text []byte, r io.Reader) ([]byte, error) {
+	switch s {
+	case SchemeLibmacaroons, SchemeHMACSHA512:
+		return encryptWithKey(sigKey(key), text, r)
+	case SchemeAESGCM:
+		return encryptAESGCM(key, text, r)
+	}
+	return encrypt(key, text, r)
+}
+
+// open decrypts ciphertext produced by seal.
+func (s Scheme) open(key, ciphertext []byte) ([]byte, error) {
+	switch s {
+	case SchemeLibmacaroons, SchemeHMACSHA512:
+		return decryptWithKey(sigKey(key), ciphertext)
+	case SchemeAESGCM:
+		return decryptAESGCM(key, ciphertext)
+	}
+	return decrypt(key, ciphertext)
+}
+
+// confidentialPrefix is the first byte of the id of
+// every confidential first party caveat.
+const confidentialPrefix = 0
+
+// confidentialKeyGen is used to derive the key that
+// encrypts confidential caveat conditions from the
+// derived root key of a macaroon.
+var confidentialKeyGen = []byte("macaroon-confidential-caveat")
+
+// isConfidential reports whether the given first
+// party caveat id holds an encrypted condition.
+func isConfidential(caveatId []byte) bool {
+	return len(caveatId) > 0 && caveatId[0] == confidentialPrefix
+}
+
+// confidentialKey returns the key used to encrypt the
+// conditions of confidential caveats in a macaroon
+// with the given derived root key.
+func (s Scheme) confidentialKey(derivedKey []byte) []byte {
+	return cloneBytes(s.newHasher().keyedHash(derivedKey, confidentialKeyGen, nil))
+}
+
+// encryptCondition encrypts the condition of a confidential
+// caveat with the given confidential key, returning
+// the caveat id.
+func (s Scheme) encryptCondition(confKey, cond []byte, r io.Reader) ([]byte, error) {
+	data, err := s.seal(confKey, cond, r)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{confidentialPrefix}, data...), nil
+}
+
+// decryptCondition decrypts the id of a confidential
+// caveat with the given confidential key, returning
+// the caveat's condition.
+func (s Scheme) decryptCondition(confKey, caveatId []byte) ([]byte, error) {
+	if !isConfidential(caveatId) {
+		return nil, fmt.Errorf("caveat is not confidential")
+	}
+	return s.open(confKey, caveatId[1:])
+}
+
+// sigKey returns a signature as a secretbox key.
+// Signatures are always at least the size of a key
+// so they are used directly, truncated if necessary.
+func sigKey(sig []byte) *[keyLen]byte {
+	var key [keyLen]byte
+	copy(key[:], sig)
+	return &key
+}
+
+// gcmNonceLen holds the length of the nonce
+// used for AES-GCM encryption.
+const gcmNonceLen = 12
+
+// newGCM returns an AES-256-GCM cipher keyed with the
+// given signature, which must be at least 32 bytes long.
+func newGCM(sig []byte) (cipher.AEAD, error) {
+	if len(sig) < keyLen {
+		return nil, fmt.Errorf("signature too short")
+	}
+	block, err := aes.NewCipher(sig[0:keyLen])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptAESGCM(sig, text []byte, r io.Reader) ([]byte, error) {
+	aead, err := newGCM(sig)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, gcmNonceLen, gcmNonceLen+len(text)+aead.Overhead())
+	if _, err := io.ReadFull(r, out); err != nil {
+		return nil, fmt.Errorf("cannot generate random bytes: %v", err)
+	}
+	return aead.Seal(out, out, text, nil), nil
+}
+
+func decryptAESGCM(sig, ciphertext []byte) ([]byte, error) {
+	aead, err := newGCM(sig)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcmNonceLen+aead.Overhead() {
+		return nil, fmt.Errorf("message too short")
+	}
+	text, err := aead.Open(nil, ciphertext[0:gcmNonceLen], ciphertext[gcmNonceLen:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failure")
+	}
+	return text, nil
+}
+
+// bind binds the given discharge macaroon signature to the
+// given signature of its primary macaroon.
+func (s Scheme) bind(rootSig, dischargeSig []byte) []byte {
+	return cloneBytes(s.newHasher().bind(s, rootSig, dischargeSig))
+}
+
+func cloneBytes(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
+
+const (
+	// maxHashSize holds the largest size of
+	// any hash used by a scheme.
+	maxHashSize = sha512.Size
+
+	// maxBlockSize holds the largest block size
+	// of any hash used by a scheme.
+	maxBlockSize = sha512.BlockSize
+)
+
+// hasher calculates macaroon signatures. It
+// reuses the same hash states and buffers for all
+// calculations, so that verification of a macaroon
+// with many caveats does not need to allocate for
+// each caveat.
+//
+// The slices returned by hasher methods
+// refer to its internal buffers and are only
+// valid until the next call.
+type hasher struct {
+	// inner and outer hold the hash states for the
+	// inner and outer hashes of the HMAC.
+	inner     hash.Hash
+	outer     hash.Hash
+	size      int
+	blockSize int
+	key       [maxBlockSize]byte
+	key2      [maxHashSize]byte
+	pad       [maxBlockSize]byte
+	innerSum  [maxHashSize]byte
+	pair      [2 * maxHashSize]byte
+	sum       [maxHashSize]byte
+}
+
+// newHasher returns a hasher that uses HMAC-SHA256.
+func newHasher() *hasher {
+	return newHasherWith(sha256.New)
+}
+
+// newHasherWith returns a hasher that uses HMAC
+// with the given hash.
+func newHasherWith(newHash func() hash.Hash) *hasher {
+	inner := newHash()
+	return &hasher{
+		inner:     inner,
+		outer:     newHash(),
+		size:      inner.Size(),
+		blockSize: inner.BlockSize(),
+	}
+}
+
+// keyedHash returns the HMAC of the concatenation of d1
+// and d2 keyed with the given key. It returns the same
+// result as crypto/hmac, but reuses the hasher's hash
+// states rather than allocating new ones for each key.
+func (h *hasher) keyedHash(key, d1, d2 []byte) []byte {
+	// Copy the key first, because it may refer
+	// to one of our own buffers.
+	if len(key) > h.blockSize {
+		h.outer.Reset()
+		h.outer.Write(key)
+		key = h.outer.Sum(h.key[:0])
+	} else {
+		key = h.key[:copy(h.key[:], key)]
+	}
+	h.inner.Reset()
+	h.inner.Write(h.setPad(key, 0x36))
+	h.inner.Write(d1)
+	h.inner.Write(d2)
+	innerSum := h.inner.Sum(h.innerSum[:0])
+	h.outer.Reset()
+	h.outer.Write(h.setPad(key, 0x5c))
+	h.outer.Write(innerSum)
+	return h.outer.Sum(h.sum[:0])
+}
+
+// setPad sets h.pad to the HMAC pad for the given key
+// and padding byte, as defined by RFC 2104, and returns it.
+func (h *hasher) setPad(key []byte, padByte byte) []byte {
+	pad := h.pad[0:h.blockSize]
+	n := copy(pad, key)
+	for i := n; i < len(pad); i++ {
+		pad[i] = 0
+	}
+	for i := range pad {
+		pad[i] ^= padByte
+	}
+	return pad
+}
+
+// keyedHash2 returns the libmacaroons hash of two
+// pieces of data.
+func (h *hasher) keyedHash2(key, d1, d2 []byte) []byte {
+	// Take a copy of the key because keyedHash
+	// overwrites h.sum, which key may refer to.
+	key = append(h.key2[:0], key...)
+	copy(h.pair[:], h.keyedHash(key, d1, nil))
+	copy(h.pair[h.size:], h.keyedHash(key, d2, nil))
+	return h.keyedHash(key, h.pair[0:2*h.size], nil)
+}
+
+// caveatSig is like Scheme.caveatSig.
+func (h *hasher) caveatSig(s Scheme, sig, caveatId, verificationId []byte) []byte {
+	if s == SchemeLibmacaroons && len(verificationId) > 0 {
+		return h.keyedHash2(sig, verificationId, caveatId)
+	}
+	return h.keyedHash(sig, verificationId, caveatId)
+}
+
+// bind is like Scheme.bind.
+func (h *hasher) bind(s Scheme, rootSig, dischargeSig []byte) []byte {
+	if bytes.Equal(rootSig, dischargeSig) {
+		return rootSig
+	}
+	if s == SchemeLibmacaroons {
+		return h.keyedHash2(zeroKey[:], rootSig, dischargeSig)
+	}
+	h.outer.Reset()
+	h.outer.Write(rootSig)
+	h.outer.Write(dischargeSig)
+	return h.outer.Sum(h.sum[:0])
+}
@@ -1,8 +1,12 @@
 package macaroon
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
 	"fmt"
+	"testing"
 
 	"code.google.com/p/go.crypto/nacl/secretbox"
 	gc "gopkg.in/check.v1"
@@ -63,3 +67,93 @@ func randomBytes(n int) []byte {
 	}
 	return buf
 }
+
+func (*cryptoSuite) TestHasherKeyedHash(c *gc.C) {
+	h := newHasher()
+	for _, keyLen := range []int{0, 1, 32, 64, 65, 200} {
+		c.Logf("key length %d", keyLen)
+		key := randomBytes(keyLen)
+		d1, d2 := randomBytes(20), randomBytes(50)
+		expect := keyedHash(key, append(append([]byte(nil), d1...), d2...))
+		c.Assert(h.keyedHash(key, d1, d2), gc.DeepEquals, expect)
+
+		// The key may refer to the hasher's own result.
+		sum := h.keyedHash(key, d1, nil)
+		expect = keyedHash(sum, d2)
+		c.Assert(h.keyedHash(sum, d2, nil), gc.DeepEquals, expect)
+	}
+}
+
+func (*cryptoSuite) TestHasherKeyedHash2(c *gc.C) {
+	h := newHasher()
+	key, d1, d2 := randomBytes(32), randomBytes(20), randomBytes(50)
+	expect := append(keyedHash(key, d1), keyedHash(key, d2)...)
+	expect = keyedHash(key, expect)
+	c.Assert(h.keyedHash2(key, d1, d2), gc.DeepEquals, expect)
+
+	sum := h.keyedHash(key, d1, nil)
+	expect = append(keyedHash(sum, d1), keyedHash(sum, d2)...)
+	expect = keyedHash(sum, expect)
+	sum = h.keyedHash(key, d1, nil)
+	c.Assert(h.keyedHash2(sum, d1, d2), gc.DeepEquals, expect)
+}
+
+func (*cryptoSuite) TestHasherSHA512(c *gc.C) {
+	h := SchemeHMACSHA512.newHasher()
+	for _, keyLen := range []int{0, 64, 128, 129, 300} {
+		c.Logf("key length %d", keyLen)
+		key := randomBytes(keyLen)
+		d1, d2 := randomBytes(20), randomBytes(50)
+		mac := hmac.New(sha512.New, key)
+		mac.Write(d1)
+		mac.Write(d2)
+		c.Assert(h.keyedHash(key, d1, d2), gc.DeepEquals, mac.Sum(nil))
+	}
+}
+
+func (*cryptoSuite) TestHasherKnownAnswers(c *gc.C) {
+	// Test case 2 from RFC 4231, split across both
+	// data arguments.
+	key := []byte("Jefe")
+	d1, d2 := []byte("what do ya want "), []byte("for nothing?")
+	c.Assert(hex.EncodeToString(newHasher().keyedHash(key, d1, d2)), gc.Equals,
+		"5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843")
+	c.Assert(hex.EncodeToString(SchemeHMACSHA512.newHasher().keyedHash(key, d1, d2)), gc.Equals,
+		"164b7a7bfcf819e2e395fbe73b56e0a387bd64222e831fd610270cd7ea250554"+
+			"9758bf75c05a994a6d034f65f8f0e6fdcaeab1a34d4a6b4b636e070a38bce737")
+}
+
+func (*cryptoSuite) TestHasherDoesNotAllocate(c *gc.C) {
+	for _, s := range []Scheme{SchemeNative, SchemeLibmacaroons, SchemeHMACSHA512} {
+		c.Logf("scheme %v", s)
+		h := s.newHasher()
+		key, d1, d2 := randomBytes(32), randomBytes(20), randomBytes(50)
+		allocs := testing.AllocsPerRun(20, func() {
+			h.caveatSig(s, h.keyedHash(key, d1, d2), d1, d2)
+		})
+		c.Assert(allocs, gc.Equals, 0.0)
+	}
+}
+
+func (*cryptoSuite) TestSchemeEncryptKey(c *gc.C) {
+	for _, scheme := range []Scheme{SchemeNative, SchemeLibmacaroons, SchemeHMACSHA512, SchemeAESGCM} {
+		c.Logf("scheme %v", scheme)
+		sig := scheme.sign([]byte("root key"), []byte("id"))
+		text := []byte("some text")
+		b, err := scheme.encryptKey(sig, text, rand.Reader)
+		c.Assert(err, gc.IsNil)
+		t, err := scheme.decryptKey(sig, b)
+		c.Assert(err, gc.IsNil)
+		c.Assert(string(t), gc.Equals, string(text))
+
+		otherSig := scheme.sign([]byte("other key"), []byte("id"))
+		_, err = scheme.decryptKey(otherSig, b)
+		c.Assert(err, gc.ErrorMatches, "decryption failure")
+
+		_, err = scheme.decryptKey(sig, b[0:10])
+		c.Assert(err, gc.ErrorMatches, "message too short")
+
+		_, err = scheme.encryptKey(sig, text, &ErrorReader{})
+		c.Assert(err, gc.ErrorMatches, "cannot generate random bytes:.*")
+	}
+}
@@ -0,0 +1,98 @@
+package macaroon_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/rogpeppe/macaroon"
+)
+
+// fuzzSeeds returns the encodings of some valid macaroons
+// produced by the given marshal function.
+func fuzzSeeds(f *testing.F, marshal func(m *macaroon.Macaroon) ([]byte, error)) {
+	for _, vers := range []macaroon.Version{macaroon.V1, macaroon.V2} {
+		m, err := macaroon.NewWithParams(macaroon.NewParams{
+			RootKey:  []byte("key"),
+			Id:       []byte("id"),
+			Location: "loc",
+			Version:  vers,
+		})
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(mustMarshal(f, marshal, m))
+		if err := m.AddFirstPartyCaveat("first party"); err != nil {
+			f.Fatal(err)
+		}
+		if err := m.AddThirdPartyCaveat([]byte("3rd key"), "third party", "elsewhere"); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(mustMarshal(f, marshal, m))
+	}
+}
+
+func mustMarshal(f *testing.F, marshal func(m *macaroon.Macaroon) ([]byte, error), m *macaroon.Macaroon) []byte {
+	data, err := marshal(m)
+	if err != nil {
+		f.Fatal(err)
+	}
+	return data
+}
+
+// checkDecoded checks that a macaroon decoded with the default
+// limits is within them and can be marshaled again.
+func checkDecoded(t *testing.T, m *macaroon.Macaroon) {
+	if n := len(m.Caveats()); n > macaroon.DefaultDecodeLimits.MaxCaveats {
+		t.Fatalf("decoded macaroon has %d caveats", n)
+	}
+	if _, err := m.MarshalJSON(); err != nil {
+		t.Fatalf("cannot marshal decoded macaroon: %v", err)
+	}
+	m.Verify([]byte("key"), alwaysOK, nil)
+}
+
+func FuzzUnmarshalBinary(f *testing.F) {
+	fuzzSeeds(f, (*macaroon.Macaroon).MarshalBinary)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var m macaroon.Macaroon
+		if err := m.UnmarshalBinaryWithLimits(data, macaroon.DefaultDecodeLimits); err == nil {
+			checkDecoded(t, &m)
+		}
+		var s macaroon.Slice
+		if err := s.UnmarshalBinaryWithLimits(data, macaroon.DefaultDecodeLimits); err == nil {
+			if len(s) > macaroon.DefaultDecodeLimits.MaxDischarges+1 {
+				t.Fatalf("decoded slice has %d macaroons", len(s))
+			}
+		}
+	})
+}
+
+func FuzzUnmarshalJSON(f *testing.F) {
+	fuzzSeeds(f, (*macaroon.Macaroon).MarshalJSON)
+	fuzzSeeds(f, func(m *macaroon.Macaroon) ([]byte, error) {
+		m.SetJSONFormat(macaroon.JSONFormatV2)
+		return json.Marshal(macaroon.Slice{m})
+	})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var m macaroon.Macaroon
+		if err := m.UnmarshalJSONWithLimits(data, macaroon.DefaultDecodeLimits); err == nil {
+			checkDecoded(t, &m)
+		}
+		var s macaroon.Slice
+		if err := s.UnmarshalJSONWithLimits(data, macaroon.DefaultDecodeLimits); err == nil {
+			if len(s) > macaroon.DefaultDecodeLimits.MaxDischarges+1 {
+				t.Fatalf("decoded slice has %d macaroons", len(s))
+			}
+		}
+	})
+}
+
+func FuzzUnmarshalCBOR(f *testing.F) {
+	fuzzSeeds(f, (*macaroon.Macaroon).MarshalCBOR)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var m macaroon.Macaroon
+		if err := m.UnmarshalCBORWithLimits(data, macaroon.DefaultDecodeLimits); err == nil {
+			checkDecoded(t, &m)
+		}
+	})
+}
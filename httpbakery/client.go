@@ -26,6 +26,22 @@ type WaitResponse struct {
 	Macaroon *macaroon.Macaroon
 }
 
+// CookieFormat specifies how Do stores macaroons in cookies.
+type CookieFormat int
+
+const (
+	// CookieFormatJSON stores each macaroon in its own cookie
+	// as base64-encoded JSON. It is understood by all servers.
+	CookieFormatJSON CookieFormat = iota
+
+	// CookieFormatSlice stores the primary macaroon and its
+	// discharges together in a single cookie, encoded with
+	// macaroon.SerializeSlice. It is only understood by servers
+	// that decode cookies with macaroon.DeserializeSlice,
+	// as Service.NewRequest does.
+	CookieFormatSlice
+)
+
 // Do makes an http request to the given client.
 // If the request fails with a discharge-required error,
 // any required discharge macaroons will be acquired,
@@ -33,7 +49,14 @@ type WaitResponse struct {
 //
 // If the client.Jar field is non-nil, the macaroons will be
 // stored there and made available to subsequent requests.
+// They are stored in CookieFormatJSON.
 func Do(client *http.Client, req *http.Request, visitWebPage func(url *url.URL) error, getBody func() io.ReadCloser) (*http.Response, error) {
+	return DoWithCookieFormat(client, req, visitWebPage, getBody, CookieFormatJSON)
+}
+
+// DoWithCookieFormat is like Do except that the macaroons
+// are stored in cookies in the given format.
+func DoWithCookieFormat(client *http.Client, req *http.Request, visitWebPage func(url *url.URL) error, getBody func() io.ReadCloser, format CookieFormat) (*http.Response, error) {
 	// Add a temporary cookie jar (without mutating the original
 	// client) if there isn't one available.
 	if client.Jar == nil {
@@ -50,6 +73,7 @@ func Do(client *http.Client, req *http.Request, visitWebPage func(url *url.URL)
 	ctxt := &clientContext{
 		client:       client,
 		visitWebPage: visitWebPage,
+		cookieFormat: format,
 	}
 	return ctxt.do(req, getBody)
 }
@@ -57,6 +81,7 @@ func Do(client *http.Client, req *http.Request, visitWebPage func(url *url.URL)
 type clientContext struct {
 	client       *http.Client
 	visitWebPage func(*url.URL) error
+	cookieFormat CookieFormat
 }
 
 // relativeURL returns newPath relative to an original URL.
@@ -111,18 +136,14 @@ func (ctxt *clientContext) do1(req *http.Request, getBody func() io.ReadCloser)
 		return nil, errgo.New("no macaroon found in response")
 	}
 	mac := resp.Info.Macaroon
-	macaroons, err := bakery.DischargeAll(mac, ctxt.obtainThirdPartyDischarge)
+	discharges, err := bakery.DischargeAll(mac, ctxt.obtainThirdPartyDischarge)
 	if err != nil {
 		return nil, err
 	}
+	ms := append(macaroon.Slice{mac}, discharges...)
 	// Bind the discharge macaroons to the original macaroon.
-	for _, m := range macaroons {
-		m.Bind(mac.Signature())
-	}
-	// TODO(rog) perhaps we should add all the macaroons as a single
-	// cookie, with the principal macaroon first.
-	macaroons = append(macaroons, mac)
-	if err := ctxt.addCookies(req, macaroons); err != nil {
+	ms.Bind()
+	if err := ctxt.addCookies(req, ms); err != nil {
 		return nil, errgo.Notef(err, "cannot add cookie")
 	}
 	// Try again with our newly acquired discharge macaroons
@@ -131,18 +152,37 @@ func (ctxt *clientContext) do1(req *http.Request, getBody func() io.ReadCloser)
 	return hresp, err
 }
 
-func (ctxt *clientContext) addCookies(req *http.Request, ms []*macaroon.Macaroon) error {
+// addCookies adds cookies holding the given macaroons
+// to the client's cookie jar, in the client's cookie format.
+// Each cookie is named after the signature of the macaroon
+// it holds, or of the primary macaroon in CookieFormatSlice.
+func (ctxt *clientContext) addCookies(req *http.Request, ms macaroon.Slice) error {
 	var cookies []*http.Cookie
-	for _, m := range ms {
-		data, err := m.MarshalJSON()
+	switch ctxt.cookieFormat {
+	case CookieFormatJSON:
+		for _, m := range ms {
+			data, err := m.MarshalJSON()
+			if err != nil {
+				return errgo.Notef(err, "cannot marshal macaroon")
+			}
+			cookies = append(cookies, &http.Cookie{
+				Name:  fmt.Sprintf("macaroon-%x", m.Signature()),
+				Value: base64.StdEncoding.EncodeToString(data),
+				// TODO(rog) other fields
+			})
+		}
+	case CookieFormatSlice:
+		value, err := macaroon.SerializeSlice(ms)
 		if err != nil {
-			return errgo.Notef(err, "cannot marshal macaroon")
+			return errgo.Notef(err, "cannot marshal macaroons")
 		}
 		cookies = append(cookies, &http.Cookie{
-			Name:  fmt.Sprintf("macaroon-%x", m.Signature()),
-			Value: base64.StdEncoding.EncodeToString(data),
+			Name:  fmt.Sprintf("macaroon-%x", ms.Primary().Signature()),
+			Value: value,
 			// TODO(rog) other fields
 		})
+	default:
+		return errgo.Newf("unknown cookie format %d", ctxt.cookieFormat)
 	}
 	// TODO should we set it for the URL only, or the host.
 	// Can we set cookies such that they'll always get sent to any
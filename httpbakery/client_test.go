@@ -0,0 +1,128 @@
+package httpbakery_test
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/macaroon.v1"
+
+	"github.com/rogpeppe/macaroon/bakery"
+	"github.com/rogpeppe/macaroon/bakery/checkers"
+	"github.com/rogpeppe/macaroon/httpbakery"
+)
+
+type ClientSuite struct{}
+
+var _ = gc.Suite(&ClientSuite{})
+
+// newDischargedMacaroons returns a target service and a macaroon
+// minted by it with a third party caveat, bound to its discharge.
+func newDischargedMacaroons(c *gc.C) (*httpbakery.Service, macaroon.Slice) {
+	as, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "as-loc",
+	})
+	c.Assert(err, gc.IsNil)
+	ts, err := httpbakery.NewService(bakery.NewServiceParams{
+		Location: "ts-loc",
+		Locator: bakery.PublicKeyLocatorMap{
+			"as-loc": as.PublicKey(),
+		},
+	})
+	c.Assert(err, gc.IsNil)
+	m, err := ts.NewMacaroon("", nil, []bakery.Caveat{
+		checkers.ThirdParty("as-loc", "something"),
+	})
+	c.Assert(err, gc.IsNil)
+	dm, err := as.Discharge(bakery.ThirdPartyCheckerFunc(func(string, string) ([]bakery.Caveat, error) {
+		return nil, nil
+	}), m.Caveats()[0].Id)
+	c.Assert(err, gc.IsNil)
+	ms := macaroon.Slice{m, dm}
+	ms.Bind()
+	return ts, ms
+}
+
+// cookieRequest returns a server-side request holding
+// the cookies stored by httpbakery.AddCookies in the
+// given format.
+func cookieRequest(c *gc.C, ms macaroon.Slice, format httpbakery.CookieFormat) *http.Request {
+	jar, err := cookiejar.New(nil)
+	c.Assert(err, gc.IsNil)
+	client := &http.Client{Jar: jar}
+	req, err := http.NewRequest("GET", "http://example.com/", nil)
+	c.Assert(err, gc.IsNil)
+	err = httpbakery.AddCookies(client, req, ms, format)
+	c.Assert(err, gc.IsNil)
+
+	serverReq, err := http.NewRequest("GET", "http://example.com/", nil)
+	c.Assert(err, gc.IsNil)
+	for _, cookie := range jar.Cookies(req.URL) {
+		serverReq.AddCookie(cookie)
+	}
+	return serverReq
+}
+
+// oldServerRequest returns a request for the given service holding
+// the macaroons in the cookies of the given request, decoded
+// as servers did before macaroon slices were introduced:
+// each cookie must hold a single base64-encoded JSON macaroon.
+func oldServerRequest(svc *httpbakery.Service, httpReq *http.Request) *bakery.Request {
+	req := svc.Service.NewRequest(bakery.FirstPartyCheckerFunc(alwaysOK))
+	for _, cookie := range httpReq.Cookies() {
+		if !strings.HasPrefix(cookie.Name, "macaroon-") {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(cookie.Value)
+		if err != nil {
+			continue
+		}
+		var m macaroon.Macaroon
+		if err := m.UnmarshalJSON(data); err != nil {
+			continue
+		}
+		req.AddClientMacaroon(&m)
+	}
+	return req
+}
+
+func alwaysOK(string) error {
+	return nil
+}
+
+func (*ClientSuite) TestJSONCookieFormat(c *gc.C) {
+	ts, ms := newDischargedMacaroons(c)
+	httpReq := cookieRequest(c, ms, httpbakery.CookieFormatJSON)
+	c.Assert(httpReq.Cookies(), gc.HasLen, 2)
+
+	// Both old and new servers accept the cookies.
+	err := oldServerRequest(ts, httpReq).Check()
+	c.Assert(err, gc.IsNil)
+	err = ts.NewRequest(httpReq, bakery.FirstPartyCheckerFunc(alwaysOK)).Check()
+	c.Assert(err, gc.IsNil)
+}
+
+func (*ClientSuite) TestSliceCookieFormat(c *gc.C) {
+	ts, ms := newDischargedMacaroons(c)
+	httpReq := cookieRequest(c, ms, httpbakery.CookieFormatSlice)
+	c.Assert(httpReq.Cookies(), gc.HasLen, 1)
+
+	err := ts.NewRequest(httpReq, bakery.FirstPartyCheckerFunc(alwaysOK)).Check()
+	c.Assert(err, gc.IsNil)
+
+	// Old servers do not understand the cookie.
+	err = oldServerRequest(ts, httpReq).Check()
+	c.Assert(err, gc.ErrorMatches, `verification failed: no possible macaroons found`)
+}
+
+func (*ClientSuite) TestUnknownCookieFormat(c *gc.C) {
+	_, ms := newDischargedMacaroons(c)
+	jar, err := cookiejar.New(nil)
+	c.Assert(err, gc.IsNil)
+	req, err := http.NewRequest("GET", "http://example.com/", nil)
+	c.Assert(err, gc.IsNil)
+	err = httpbakery.AddCookies(&http.Client{Jar: jar}, req, ms, 99)
+	c.Assert(err, gc.ErrorMatches, `unknown cookie format 99`)
+}
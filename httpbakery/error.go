@@ -6,6 +6,8 @@ import (
 	"github.com/juju/utils/jsonhttp"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/macaroon.v1"
+
+	"github.com/rogpeppe/macaroon/bakery"
 )
 
 // ErrorCode holds an error code that classifies
@@ -24,6 +26,7 @@ const (
 	ErrBadRequest          = ErrorCode("bad request")
 	ErrDischargeRequired   = ErrorCode("macaroon discharge required")
 	ErrInteractionRequired = ErrorCode("interaction required")
+	ErrPermissionDenied    = ErrorCode("permission denied")
 )
 
 var (
@@ -86,6 +89,8 @@ func errorToResponse(err error) (int, interface{}) {
 		status = http.StatusBadRequest
 	case ErrDischargeRequired, ErrInteractionRequired:
 		status = http.StatusProxyAuthRequired
+	case ErrPermissionDenied:
+		status = http.StatusForbidden
 	}
 	return status, errorBody
 }
@@ -107,6 +112,8 @@ func errorResponseBody(err error) *Error {
 	cause := errgo.Cause(err)
 	if coder, ok := cause.(errorCoder); ok {
 		errResp.Code = coder.ErrorCode()
+	} else if macaroon.IsFatal(cause) {
+		errResp.Code = ErrPermissionDenied
 	}
 	if infoer, ok := cause.(errorInfoer); ok {
 		errResp.Info = infoer.ErrorInfo()
@@ -114,6 +121,42 @@ func errorResponseBody(err error) *Error {
 	return errResp
 }
 
+// ShouldMintMacaroon reports whether the given error, as returned
+// from bakery.Request.Check, means that minting a fresh
+// macaroon and returning it with WriteDischargeRequiredError
+// might allow the client to make the request successfully.
+//
+// It returns false if the error was not caused by macaroon
+// verification failing, if verification failed because
+// the client's macaroons exceeded the verification limits,
+// or if the failure was marked as fatal by a first party
+// caveat checker (see macaroon.Fatal). In the latter case
+// the error should be reported as permission denied,
+// for example with WritePermissionDeniedError.
+func ShouldMintMacaroon(err error) bool {
+	verr, ok := errgo.Cause(err).(*bakery.VerificationError)
+	if !ok {
+		return false
+	}
+	merr, ok := verr.Reason.(*macaroon.VerificationError)
+	if !ok {
+		// No macaroons were found or none of them
+		// were recognized.
+		return true
+	}
+	if verr.Fatal() {
+		return false
+	}
+	switch merr.Kind {
+	case macaroon.MissingDischarge,
+		macaroon.CheckFailed,
+		macaroon.BadSignature,
+		macaroon.UnusedDischarge:
+		return true
+	}
+	return false
+}
+
 func badRequestErrorf(f string, a ...interface{}) error {
 	return errgo.WithCausef(nil, ErrBadRequest, f, a...)
 }
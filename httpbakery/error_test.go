@@ -0,0 +1,151 @@
+package httpbakery_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon.v1"
+
+	"github.com/rogpeppe/macaroon/bakery"
+	"github.com/rogpeppe/macaroon/bakery/checkers"
+	"github.com/rogpeppe/macaroon/httpbakery"
+)
+
+type ErrorSuite struct{}
+
+var _ = gc.Suite(&ErrorSuite{})
+
+// checkError returns the error from checking a new macaroon
+// with a first party caveat that is rejected with the given
+// error, along with the macaroon.
+func checkError(c *gc.C, checkErr error) (*macaroon.Macaroon, error) {
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "loc",
+	})
+	c.Assert(err, gc.IsNil)
+	m, err := svc.NewMacaroon("", nil, []bakery.Caveat{
+		checkers.FirstParty("something"),
+	})
+	c.Assert(err, gc.IsNil)
+	req := svc.NewRequest(bakery.FirstPartyCheckerFunc(func(string) error {
+		return checkErr
+	}))
+	req.AddClientMacaroon(m)
+	err = req.Check()
+	c.Assert(err, gc.NotNil)
+	return m, err
+}
+
+// errorResponse returns the status code and
+// the error held in the given recorded response.
+func errorResponse(c *gc.C, rec *httptest.ResponseRecorder) (int, *httpbakery.Error) {
+	var resp httpbakery.Error
+	err := json.Unmarshal(rec.Body.Bytes(), &resp)
+	c.Assert(err, gc.IsNil, gc.Commentf("body %q", rec.Body.Bytes()))
+	return rec.Code, &resp
+}
+
+func (*ErrorSuite) TestWriteDischargeRequiredErrorRemediable(c *gc.C) {
+	m, checkErr := checkError(c, fmt.Errorf("expired"))
+	rec := httptest.NewRecorder()
+	httpbakery.WriteDischargeRequiredError(rec, m, checkErr)
+	status, resp := errorResponse(c, rec)
+	c.Assert(status, gc.Equals, http.StatusProxyAuthRequired)
+	c.Assert(resp.Code, gc.Equals, httpbakery.ErrDischargeRequired)
+	c.Assert(resp.Message, gc.Equals, `verification failed: expired`)
+	c.Assert(resp.Info, gc.NotNil)
+	c.Assert(resp.Info.Macaroon, gc.NotNil)
+	c.Assert(resp.Info.Macaroon.Id(), gc.Equals, m.Id())
+}
+
+func (*ErrorSuite) TestWriteDischargeRequiredErrorFatal(c *gc.C) {
+	m, checkErr := checkError(c, macaroon.Fatal(fmt.Errorf("not allowed")))
+	rec := httptest.NewRecorder()
+	httpbakery.WriteDischargeRequiredError(rec, m, errgo.Mask(checkErr, errgo.Any))
+	status, resp := errorResponse(c, rec)
+	c.Assert(status, gc.Equals, http.StatusForbidden)
+	c.Assert(resp.Code, gc.Equals, httpbakery.ErrPermissionDenied)
+	c.Assert(resp.Message, gc.Equals, `verification failed: not allowed`)
+	// The client is not sent a macaroon to discharge.
+	c.Assert(resp.Info, gc.IsNil)
+}
+
+func (*ErrorSuite) TestWriteDischargeRequiredErrorNilError(c *gc.C) {
+	m, _ := checkError(c, fmt.Errorf("expired"))
+	rec := httptest.NewRecorder()
+	httpbakery.WriteDischargeRequiredError(rec, m, nil)
+	status, resp := errorResponse(c, rec)
+	c.Assert(status, gc.Equals, http.StatusProxyAuthRequired)
+	c.Assert(resp.Code, gc.Equals, httpbakery.ErrDischargeRequired)
+	c.Assert(resp.Message, gc.Equals, `unauthorized`)
+}
+
+func (*ErrorSuite) TestWritePermissionDeniedError(c *gc.C) {
+	for _, checkErr := range []error{
+		fmt.Errorf("expired"),
+		macaroon.Fatal(fmt.Errorf("not allowed")),
+	} {
+		c.Logf("checker error %v", checkErr)
+		_, err := checkError(c, checkErr)
+		rec := httptest.NewRecorder()
+		httpbakery.WritePermissionDeniedError(rec, err)
+		status, resp := errorResponse(c, rec)
+		c.Assert(status, gc.Equals, http.StatusForbidden)
+		c.Assert(resp.Code, gc.Equals, httpbakery.ErrPermissionDenied)
+		c.Assert(resp.Message, gc.Equals, err.Error())
+		c.Assert(resp.Info, gc.IsNil)
+	}
+}
+
+var writeErrorTests = []struct {
+	about        string
+	err          func(c *gc.C) error
+	expectStatus int
+	expectCode   httpbakery.ErrorCode
+}{{
+	about: "fatal verification error",
+	err: func(c *gc.C) error {
+		_, err := checkError(c, macaroon.Fatal(fmt.Errorf("not allowed")))
+		return errgo.Mask(err, errgo.Any)
+	},
+	expectStatus: http.StatusForbidden,
+	expectCode:   httpbakery.ErrPermissionDenied,
+}, {
+	about: "remediable verification error",
+	err: func(c *gc.C) error {
+		_, err := checkError(c, fmt.Errorf("expired"))
+		return err
+	},
+	expectStatus: http.StatusInternalServerError,
+}, {
+	about: "error with code",
+	err: func(c *gc.C) error {
+		return errgo.WithCausef(nil, httpbakery.ErrBadRequest, "bad")
+	},
+	expectStatus: http.StatusBadRequest,
+	expectCode:   httpbakery.ErrBadRequest,
+}, {
+	about: "error with discharge required code",
+	err: func(c *gc.C) error {
+		return httpbakery.ErrDischargeRequired
+	},
+	expectStatus: http.StatusProxyAuthRequired,
+	expectCode:   httpbakery.ErrDischargeRequired,
+}}
+
+func (*ErrorSuite) TestWriteError(c *gc.C) {
+	for i, test := range writeErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		err := test.err(c)
+		rec := httptest.NewRecorder()
+		httpbakery.WriteError(rec, err)
+		status, resp := errorResponse(c, rec)
+		c.Assert(status, gc.Equals, test.expectStatus)
+		c.Assert(resp.Code, gc.Equals, test.expectCode)
+		c.Assert(resp.Message, gc.Equals, err.Error())
+	}
+}
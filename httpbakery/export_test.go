@@ -0,0 +1,22 @@
+package httpbakery
+
+import (
+	"net/http"
+
+	"gopkg.in/macaroon.v1"
+)
+
+// WriteError writes an error response as written
+// by the httpbakery HTTP handlers.
+var WriteError = writeError
+
+// AddCookies adds cookies holding the given macaroons to
+// the client's cookie jar for the given request, in the
+// given format, as Do does after acquiring discharges.
+func AddCookies(client *http.Client, req *http.Request, ms macaroon.Slice, format CookieFormat) error {
+	ctxt := &clientContext{
+		client:       client,
+		cookieFormat: format,
+	}
+	return ctxt.addCookies(req, ms)
+}
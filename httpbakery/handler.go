@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 
+	"gopkg.in/errgo.v1"
 	"gopkg.in/macaroon.v1"
 )
 
@@ -23,6 +24,12 @@ func WriteDischargeRequiredError(w http.ResponseWriter, m *macaroon.Macaroon, or
 	if originalErr == nil {
 		originalErr = fmt.Errorf("unauthorized")
 	}
+	if macaroon.IsFatal(errgo.Cause(originalErr)) {
+		// A new macaroon cannot help, so don't
+		// invite the client to discharge it.
+		WritePermissionDeniedError(w, originalErr)
+		return
+	}
 	writeError(w, &Error{
 		Message: originalErr.Error(),
 		Code:    ErrDischargeRequired,
@@ -32,6 +39,17 @@ func WriteDischargeRequiredError(w http.ResponseWriter, m *macaroon.Macaroon, or
 	})
 }
 
+// WritePermissionDeniedError writes a response to w
+// with a 403 (Forbidden) status and the ErrPermissionDenied
+// error code, reporting the given error, which is usually
+// a fatal verification failure returned by bakery.Request.Check.
+func WritePermissionDeniedError(w http.ResponseWriter, err error) {
+	writeError(w, &Error{
+		Message: err.Error(),
+		Code:    ErrPermissionDenied,
+	})
+}
+
 // It remains to be seen whether the following code is useful
 // in practice:
 
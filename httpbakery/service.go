@@ -4,7 +4,6 @@
 package httpbakery
 
 import (
-	"encoding/base64"
 	"fmt"
 	"log"
 	"net/http"
@@ -80,23 +79,32 @@ func NewService(p bakery.NewServiceParams) (*Service, error) {
 // NewRequest returns a new request, converting cookies from the
 // HTTP request into macaroons in the bakery request when they're
 // found. Mmm.
+//
+// The macaroons in each cookie must be within the service's
+// decode limits (see bakery.NewServiceParams.DecodeLimits);
+// cookies that are not are ignored. The limit on the
+// number of discharges applies to all the cookies together.
 func (svc *Service) NewRequest(httpReq *http.Request, checker bakery.FirstPartyChecker) *bakery.Request {
 	req := svc.Service.NewRequest(checker)
+	limits := svc.DecodeLimits()
+	total := 0
 	for _, cookie := range httpReq.Cookies() {
 		if !strings.HasPrefix(cookie.Name, "macaroon-") {
 			continue
 		}
-		data, err := base64.StdEncoding.DecodeString(cookie.Value)
+		ms, err := macaroon.DeserializeSliceWithLimits(cookie.Value, limits)
 		if err != nil {
-			log.Printf("cannot base64-decode cookie; ignoring: %v", err)
+			log.Printf("cannot unmarshal macaroons from cookie; ignoring: %v", err)
 			continue
 		}
-		var m macaroon.Macaroon
-		if err := m.UnmarshalJSON(data); err != nil {
-			log.Printf("cannot unmarshal macaroon from cookie; ignoring: %v", err)
+		if limits.MaxDischarges > 0 && total+len(ms) > limits.MaxDischarges+1 {
+			log.Printf("too many macaroons in cookies; ignoring %q", cookie.Name)
 			continue
 		}
-		req.AddClientMacaroon(&m)
+		total += len(ms)
+		for _, m := range ms {
+			req.AddClientMacaroon(m)
+		}
 	}
 	return req
 }
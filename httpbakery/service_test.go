@@ -0,0 +1,167 @@
+package httpbakery_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/macaroon.v1"
+
+	"github.com/rogpeppe/macaroon/bakery"
+	"github.com/rogpeppe/macaroon/bakery/checkers"
+	"github.com/rogpeppe/macaroon/httpbakery"
+)
+
+type ServiceSuite struct{}
+
+var _ = gc.Suite(&ServiceSuite{})
+
+// newLimitedService returns a target service that applies the
+// given decode limits, a third party service that discharges
+// its caveats, and a server that requires a macaroon from the
+// target service.
+func newLimitedService(c *gc.C, limits macaroon.DecodeLimits) (ts *httpbakery.Service, as *bakery.Service, srv *httptest.Server) {
+	as, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "as-loc",
+	})
+	c.Assert(err, gc.IsNil)
+	ts, err = httpbakery.NewService(bakery.NewServiceParams{
+		Location: "ts-loc",
+		Locator: bakery.PublicKeyLocatorMap{
+			"as-loc": as.PublicKey(),
+		},
+		DecodeLimits: &limits,
+	})
+	c.Assert(err, gc.IsNil)
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		err := ts.NewRequest(req, bakery.FirstPartyCheckerFunc(alwaysOK)).Check()
+		if err == nil {
+			w.Write([]byte("ok"))
+			return
+		}
+		if !httpbakery.ShouldMintMacaroon(err) {
+			httpbakery.WritePermissionDeniedError(w, err)
+			return
+		}
+		m, merr := ts.NewMacaroon("", nil, []bakery.Caveat{
+			checkers.ThirdParty("as-loc", "something"),
+		})
+		if merr != nil {
+			httpbakery.WriteError(w, merr)
+			return
+		}
+		httpbakery.WriteDischargeRequiredError(w, m, err)
+	}))
+	return ts, as, srv
+}
+
+// newMacaroons returns a macaroon minted by ts with n third
+// party caveats, bound to a discharge of each one by as.
+func newMacaroons(c *gc.C, ts *httpbakery.Service, as *bakery.Service, n int) macaroon.Slice {
+	var caveats []bakery.Caveat
+	for i := 0; i < n; i++ {
+		caveats = append(caveats, checkers.ThirdParty("as-loc", "something"))
+	}
+	m, err := ts.NewMacaroon("", nil, caveats)
+	c.Assert(err, gc.IsNil)
+	ms := macaroon.Slice{m}
+	for _, cav := range m.Caveats() {
+		dm, err := as.Discharge(bakery.ThirdPartyCheckerFunc(func(string, string) ([]bakery.Caveat, error) {
+			return nil, nil
+		}), cav.Id)
+		c.Assert(err, gc.IsNil)
+		ms = append(ms, dm)
+	}
+	ms.Bind()
+	return ms
+}
+
+// doRequest sends a request to the given server holding the
+// macaroons in cookies of the given format, and returns the
+// response status and the error in the response, if any.
+func doRequest(c *gc.C, srv *httptest.Server, ms macaroon.Slice, format httpbakery.CookieFormat) (int, *httpbakery.Error) {
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	c.Assert(err, gc.IsNil)
+	for _, cookie := range cookieRequest(c, ms, format).Cookies() {
+		req.AddCookie(cookie)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	var errResp httpbakery.Error
+	err = json.NewDecoder(resp.Body).Decode(&errResp)
+	c.Assert(err, gc.IsNil)
+	return resp.StatusCode, &errResp
+}
+
+func (*ServiceSuite) TestRequestWithinLimits(c *gc.C) {
+	ts, as, srv := newLimitedService(c, macaroon.DecodeLimits{
+		MaxSize:       4096,
+		MaxDischarges: 2,
+	})
+	defer srv.Close()
+	for _, format := range []httpbakery.CookieFormat{
+		httpbakery.CookieFormatJSON,
+		httpbakery.CookieFormatSlice,
+	} {
+		c.Logf("cookie format %d", format)
+		status, resp := doRequest(c, srv, newMacaroons(c, ts, as, 2), format)
+		c.Assert(status, gc.Equals, http.StatusOK, gc.Commentf("response %#v", resp))
+	}
+}
+
+func (*ServiceSuite) TestRequestWithOversizeMacaroons(c *gc.C) {
+	ts, as, srv := newLimitedService(c, macaroon.DecodeLimits{
+		MaxSize: 4096,
+	})
+	defer srv.Close()
+
+	// A first party caveat makes the primary macaroon too
+	// large, so it is ignored and the client is asked to
+	// discharge a new macaroon. In the JSON format, only
+	// the discharge macaroon remains.
+	ms := newMacaroons(c, ts, as, 1)
+	err := ms[0].AddFirstPartyCaveat("x " + strings.Repeat("x", 4096))
+	c.Assert(err, gc.IsNil)
+	ms.Bind()
+	checkDischargeRequired(c, srv, ms, map[httpbakery.CookieFormat]string{
+		httpbakery.CookieFormatJSON:  `verification failed: no recognized macaroons found`,
+		httpbakery.CookieFormatSlice: `verification failed: no possible macaroons found`,
+	})
+}
+
+func (*ServiceSuite) TestRequestWithTooManyDischarges(c *gc.C) {
+	ts, as, srv := newLimitedService(c, macaroon.DecodeLimits{
+		MaxDischarges: 2,
+	})
+	defer srv.Close()
+
+	// The macaroons beyond the limit are ignored, so the
+	// client is asked to discharge a new macaroon. In the
+	// JSON format, the cookies up to the limit are used.
+	ms := newMacaroons(c, ts, as, 3)
+	checkDischargeRequired(c, srv, ms, map[httpbakery.CookieFormat]string{
+		httpbakery.CookieFormatJSON:  `verification failed: cannot find discharge macaroon for caveat .*`,
+		httpbakery.CookieFormatSlice: `verification failed: no possible macaroons found`,
+	})
+}
+
+// checkDischargeRequired checks that a request to the given server
+// with the macaroons in cookies of each given format fails with
+// a discharge required error with the given message.
+func checkDischargeRequired(c *gc.C, srv *httptest.Server, ms macaroon.Slice, expectMessage map[httpbakery.CookieFormat]string) {
+	for format, msg := range expectMessage {
+		c.Logf("cookie format %d", format)
+		status, resp := doRequest(c, srv, ms, format)
+		c.Assert(status, gc.Equals, http.StatusProxyAuthRequired)
+		c.Assert(resp.Code, gc.Equals, httpbakery.ErrDischargeRequired)
+		c.Assert(resp.Message, gc.Matches, msg)
+		c.Assert(resp.Info, gc.NotNil)
+		c.Assert(resp.Info.Macaroon, gc.NotNil)
+	}
+}
@@ -0,0 +1,85 @@
+package macaroon
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// String returns a human-readable description of the macaroon in the
+// same form as the libmacaroons inspect function: one line for each
+// field, holding the field name followed by its value. Verification
+// ids are shown as base64 and the signature as hex. Other values are
+// shown as Go-quoted strings when they are not printable UTF-8 text.
+//
+// For example:
+//
+//	location http://mybank/
+//	identifier we used our other secret key
+//	cid account = 3735928559
+//	cid this was how we remind auth of key/pred
+//	vid AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA027FAuBYhtHwJ58FX6UlVNFtFsGxQHS7uD/w/dedwv4Jjw7UorCREw5rXbRqIKhr
+//	cl http://auth.mybank/
+//	signature d27db2fd1f22760e4c3dae8137e2d8fc1df6c0741c18aed4b97256bf78d1f55c
+func (m *Macaroon) String() string {
+	var buf bytes.Buffer
+	m.inspect(&buf)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// inspect writes the description of m to buf,
+// with each line terminated by a newline.
+func (m *Macaroon) inspect(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "%s %s\n", fieldLocation, inspectValue(m.dataBytes(m.location)))
+	fmt.Fprintf(buf, "%s %s\n", fieldIdentifier, inspectValue(m.dataBytes(m.id)))
+	for _, cav := range m.caveats {
+		fmt.Fprintf(buf, "%s %s\n", fieldCaveatId, inspectValue(m.dataBytes(cav.caveatId)))
+		if cav.isThirdParty() {
+			fmt.Fprintf(buf, "%s %s\n", fieldVerificationId, base64.StdEncoding.EncodeToString(m.dataBytes(cav.verificationId)))
+		}
+		if cav.location.len() != 0 {
+			fmt.Fprintf(buf, "%s %s\n", fieldCaveatLocation, inspectValue(m.dataBytes(cav.location)))
+		}
+	}
+	fmt.Fprintf(buf, "%s %x\n", fieldSignature, m.sig)
+}
+
+// String returns a human-readable description of all the
+// macaroons in s, as returned by Macaroon.String.
+// The description of each macaroon is preceded by
+// a line describing its role.
+func (s Slice) String() string {
+	var buf bytes.Buffer
+	for i, m := range s {
+		if i > 0 {
+			buf.WriteByte('\n')
+		}
+		if i == 0 {
+			buf.WriteString("# primary\n")
+		} else {
+			fmt.Fprintf(&buf, "# discharge %d\n", i)
+		}
+		m.inspect(&buf)
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// inspectValue returns a printable form of the given
+// field value. Values that are not printable UTF-8
+// text, or that might be mistaken for quoted
+// values, are quoted.
+func inspectValue(b []byte) string {
+	if !utf8.Valid(b) || len(b) > 0 && b[0] == '"' {
+		return strconv.Quote(string(b))
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) {
+			return strconv.Quote(string(b))
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,85 @@
+package macaroon_test
+
+import (
+	"encoding/hex"
+	"encoding/json"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/rogpeppe/macaroon"
+)
+
+type inspectSuite struct{}
+
+var _ = gc.Suite(&inspectSuite{})
+
+func (*inspectSuite) TestString(c *gc.C) {
+	var m macaroon.Macaroon
+	err := json.Unmarshal([]byte(libmacaroonsThirdPartyJSON), &m)
+	c.Assert(err, gc.IsNil)
+	c.Assert(m.String(), gc.Equals, `
+location http://mybank/
+identifier we used our other secret key
+cid account = 3735928559
+cid this was how we remind auth of key/pred
+vid AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA027FAuBYhtHwJ58FX6UlVNFtFsGxQHS7uD/w/dedwv4Jjw7UorCREw5rXbRqIKhr
+cl http://auth.mybank/
+signature d27db2fd1f22760e4c3dae8137e2d8fc1df6c0741c18aed4b97256bf78d1f55c`[1:])
+}
+
+var inspectValueTests = []struct {
+	about  string
+	id     string
+	expect string
+}{{
+	about:  "empty",
+	id:     "",
+	expect: "identifier ",
+}, {
+	about:  "printable text",
+	id:     "hello, world ☺",
+	expect: "identifier hello, world ☺",
+}, {
+	about:  "newline",
+	id:     "hello\nworld",
+	expect: `identifier "hello\nworld"`,
+}, {
+	about:  "invalid UTF-8",
+	id:     "\xff\x00abc",
+	expect: `identifier "\xff\x00abc"`,
+}, {
+	about:  "leading quote",
+	id:     `"hello"`,
+	expect: `identifier "\"hello\""`,
+}}
+
+func (*inspectSuite) TestStringEscaping(c *gc.C) {
+	for i, test := range inspectValueTests {
+		c.Logf("test %d: %s", i, test.about)
+		m := MustNew([]byte("key"), test.id, "")
+		c.Assert(m.String(), gc.Equals, "location \n"+test.expect+"\nsignature "+sigHex(m))
+	}
+}
+
+func (*inspectSuite) TestSliceString(c *gc.C) {
+	primary := MustNew([]byte("key"), "primary", "loc")
+	err := primary.AddFirstPartyCaveat("first caveat")
+	c.Assert(err, gc.IsNil)
+	discharge := MustNew([]byte("other key"), "discharge", "other loc")
+	s := macaroon.Slice{primary, discharge}
+	c.Assert(s.String(), gc.Equals, `
+# primary
+location loc
+identifier primary
+cid first caveat
+signature `[1:]+sigHex(primary)+`
+
+# discharge 1
+location other loc
+identifier discharge
+signature `+sigHex(discharge))
+}
+
+func sigHex(m *macaroon.Macaroon) string {
+	return hex.EncodeToString(m.Signature())
+}
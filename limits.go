@@ -0,0 +1,264 @@
+package macaroon
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// DecodeLimits holds limits on the macaroons accepted when
+// decoding data from an untrusted source, such as a client
+// request. A zero field means that there is no limit.
+//
+// The plain UnmarshalBinary, UnmarshalJSON and UnmarshalCBOR
+// methods and Deserialize and DeserializeSlice apply no limits.
+type DecodeLimits struct {
+	// MaxSize holds the maximum size in bytes of the
+	// encoded data, after any base64 decoding.
+	MaxSize int
+
+	// MaxCaveats holds the maximum number of caveats
+	// in any one macaroon.
+	MaxCaveats int
+
+	// MaxFieldSize holds the maximum size in bytes of
+	// any field of a macaroon: its location, identifier
+	// and signature, and the id, verification id and
+	// location of each of its caveats.
+	MaxFieldSize int
+
+	// MaxDischarges holds the maximum number of discharge
+	// macaroons in a slice - that is, the number of
+	// macaroons after the first.
+	MaxDischarges int
+}
+
+// DefaultDecodeLimits holds limits that are generous
+// for any macaroons minted by the bakery package.
+var DefaultDecodeLimits = DecodeLimits{
+	MaxSize:       64 * 1024,
+	MaxCaveats:    256,
+	MaxFieldSize:  16 * 1024,
+	MaxDischarges: 64,
+}
+
+// checkSize checks that data of the given size is
+// within the limits.
+func (l DecodeLimits) checkSize(n int) error {
+	if l.MaxSize > 0 && n > l.MaxSize {
+		return fmt.Errorf("data too large (%d bytes; max %d)", n, l.MaxSize)
+	}
+	return nil
+}
+
+// checkEncodedSize checks that base64-encoded data with the given
+// length cannot be within the limits, without decoding it.
+func (l DecodeLimits) checkEncodedSize(n int) error {
+	if l.MaxSize > 0 && n > base64.StdEncoding.EncodedLen(l.MaxSize) {
+		return fmt.Errorf("encoded data too large (%d bytes; max %d)", n, base64.StdEncoding.EncodedLen(l.MaxSize))
+	}
+	return nil
+}
+
+// checkDischarges checks that a slice holding n
+// macaroons is within the limits.
+func (l DecodeLimits) checkDischarges(n int) error {
+	if l.MaxDischarges > 0 && n-1 > l.MaxDischarges {
+		return fmt.Errorf("too many discharge macaroons (max %d)", l.MaxDischarges)
+	}
+	return nil
+}
+
+// checkMacaroon checks that m is within the limits.
+func (l DecodeLimits) checkMacaroon(m *Macaroon) error {
+	if l.MaxCaveats > 0 && len(m.caveats) > l.MaxCaveats {
+		return fmt.Errorf("too many caveats (max %d)", l.MaxCaveats)
+	}
+	if l.MaxFieldSize <= 0 {
+		return nil
+	}
+	check := func(name string, n int) error {
+		if n > l.MaxFieldSize {
+			return fmt.Errorf("%s field too large (%d bytes; max %d)", name, n, l.MaxFieldSize)
+		}
+		return nil
+	}
+	if err := check("location", len(m.dataBytes(m.location))); err != nil {
+		return err
+	}
+	if err := check("identifier", len(m.dataBytes(m.id))); err != nil {
+		return err
+	}
+	if err := check("signature", len(m.sig)); err != nil {
+		return err
+	}
+	for _, cav := range m.caveats {
+		if err := check("caveat location", len(m.dataBytes(cav.location))); err != nil {
+			return err
+		}
+		if err := check("caveat id", len(m.dataBytes(cav.caveatId))); err != nil {
+			return err
+		}
+		if err := check("verification id", len(m.dataBytes(cav.verificationId))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnmarshalBinaryWithLimits is like UnmarshalBinary except that
+// it returns an error if the macaroon is not within the given limits.
+func (m *Macaroon) UnmarshalBinaryWithLimits(data []byte, limits DecodeLimits) error {
+	if err := limits.checkSize(len(data)); err != nil {
+		return err
+	}
+	if err := m.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	return limits.checkMacaroon(m)
+}
+
+// UnmarshalJSONWithLimits is like UnmarshalJSON except that
+// it returns an error if the macaroon is not within the given limits.
+func (m *Macaroon) UnmarshalJSONWithLimits(data []byte, limits DecodeLimits) error {
+	if err := limits.checkSize(len(data)); err != nil {
+		return err
+	}
+	if err := m.UnmarshalJSON(data); err != nil {
+		return err
+	}
+	return limits.checkMacaroon(m)
+}
+
+// UnmarshalCBORWithLimits is like UnmarshalCBOR except that
+// it returns an error if the macaroon is not within the given limits.
+func (m *Macaroon) UnmarshalCBORWithLimits(data []byte, limits DecodeLimits) error {
+	if err := limits.checkSize(len(data)); err != nil {
+		return err
+	}
+	if err := m.UnmarshalCBOR(data); err != nil {
+		return err
+	}
+	return limits.checkMacaroon(m)
+}
+
+// UnmarshalBinaryWithLimits is like UnmarshalBinary except that
+// it returns an error if the macaroons are not within the given
+// limits. Decoding stops as soon as there are too many
+// macaroons.
+func (s *Slice) UnmarshalBinaryWithLimits(data []byte, limits DecodeLimits) error {
+	if err := limits.checkSize(len(data)); err != nil {
+		return err
+	}
+	ms := (*s)[:0]
+	for len(data) > 0 {
+		if err := limits.checkDischarges(len(ms) + 1); err != nil {
+			return err
+		}
+		var m Macaroon
+		rest, err := m.parseBinary(data)
+		if err != nil {
+			return fmt.Errorf("cannot unmarshal macaroon %d: %v", len(ms), err)
+		}
+		if err := limits.checkMacaroon(&m); err != nil {
+			return fmt.Errorf("cannot unmarshal macaroon %d: %v", len(ms), err)
+		}
+		ms = append(ms, &m)
+		data = rest
+	}
+	*s = ms
+	return nil
+}
+
+// UnmarshalJSONWithLimits is like json.Unmarshal of s except that
+// it returns an error if the macaroons are not within the given
+// limits.
+func (s *Slice) UnmarshalJSONWithLimits(data []byte, limits DecodeLimits) error {
+	if err := limits.checkSize(len(data)); err != nil {
+		return err
+	}
+	var rawMacaroons []json.RawMessage
+	if err := json.Unmarshal(data, &rawMacaroons); err != nil {
+		return fmt.Errorf("cannot unmarshal json data: %v", err)
+	}
+	if err := limits.checkDischarges(len(rawMacaroons)); err != nil {
+		return err
+	}
+	ms := make(Slice, len(rawMacaroons))
+	for i, data := range rawMacaroons {
+		if string(data) == "null" {
+			return fmt.Errorf("null macaroon at index %d", i)
+		}
+		var m Macaroon
+		if err := m.UnmarshalJSONWithLimits(data, limits); err != nil {
+			return fmt.Errorf("cannot unmarshal macaroon %d: %v", i, err)
+		}
+		ms[i] = &m
+	}
+	*s = ms
+	return nil
+}
+
+// DeserializeWithLimits is like Deserialize except that it
+// returns an error if the macaroon is not within the
+// given limits.
+func DeserializeWithLimits(str string, limits DecodeLimits) (*Macaroon, error) {
+	data, err := deserializeData(str, "macaroon", limits)
+	if err != nil {
+		return nil, err
+	}
+	var m Macaroon
+	if len(data) > 0 && data[0] == '{' {
+		err = m.UnmarshalJSONWithLimits(data, limits)
+	} else {
+		err = m.UnmarshalBinaryWithLimits(data, limits)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// DeserializeSliceWithLimits is like DeserializeSlice except that it
+// returns an error if the macaroons are not within the given limits.
+func DeserializeSliceWithLimits(str string, limits DecodeLimits) (Slice, error) {
+	data, err := deserializeData(str, "macaroons", limits)
+	if err != nil {
+		return nil, err
+	}
+	var s Slice
+	switch {
+	case len(data) > 0 && data[0] == '[':
+		err = s.UnmarshalJSONWithLimits(data, limits)
+	case len(data) > 0 && data[0] == '{':
+		var m Macaroon
+		err = m.UnmarshalJSONWithLimits(data, limits)
+		s = Slice{&m}
+	default:
+		err = s.UnmarshalBinaryWithLimits(data, limits)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// deserializeData returns the data encoded in str, which
+// may be unencoded JSON or base64, checking its size against
+// the given limits before decoding it. The what argument
+// describes the data for error messages.
+func deserializeData(str string, what string, limits DecodeLimits) ([]byte, error) {
+	str = strings.TrimSpace(str)
+	if strings.HasPrefix(str, "{") || strings.HasPrefix(str, "[") {
+		return []byte(str), nil
+	}
+	if err := limits.checkEncodedSize(len(str)); err != nil {
+		return nil, err
+	}
+	data, err := Base64Decode(str)
+	if err != nil {
+		return nil, fmt.Errorf("cannot base64-decode %s: %v", what, err)
+	}
+	return data, nil
+}
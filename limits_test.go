@@ -0,0 +1,187 @@
+package macaroon_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/rogpeppe/macaroon"
+)
+
+type limitsSuite struct{}
+
+var _ = gc.Suite(&limitsSuite{})
+
+// newLimitsMacaroon returns a macaroon of the given version
+// with the given number of caveats.
+func newLimitsMacaroon(c *gc.C, vers macaroon.Version, ncav int) *macaroon.Macaroon {
+	m, err := macaroon.NewWithParams(macaroon.NewParams{
+		RootKey:  []byte("key"),
+		Id:       []byte("some id"),
+		Location: "a location",
+		Version:  vers,
+	})
+	c.Assert(err, gc.IsNil)
+	for i := 0; i < ncav; i++ {
+		err := m.AddFirstPartyCaveat(fmt.Sprintf("caveat %d", i))
+		c.Assert(err, gc.IsNil)
+	}
+	return m
+}
+
+var macaroonLimitsTests = []struct {
+	about     string
+	ncav      int
+	limits    macaroon.DecodeLimits
+	expectErr string
+}{{
+	about: "no limits",
+	ncav:  10,
+}, {
+	about:  "within limits",
+	ncav:   10,
+	limits: macaroon.DefaultDecodeLimits,
+}, {
+	about: "too many caveats",
+	ncav:  10,
+	limits: macaroon.DecodeLimits{
+		MaxCaveats: 9,
+	},
+	expectErr: `too many caveats \(max 9\)`,
+}, {
+	about: "field too large",
+	ncav:  1,
+	limits: macaroon.DecodeLimits{
+		MaxFieldSize: 8,
+	},
+	expectErr: `location field too large \(10 bytes; max 8\)`,
+}, {
+	about: "data too large",
+	ncav:  1,
+	limits: macaroon.DecodeLimits{
+		MaxSize: 20,
+	},
+	expectErr: `data too large \(\d+ bytes; max 20\)`,
+}}
+
+func (*limitsSuite) TestMacaroonLimits(c *gc.C) {
+	for i, test := range macaroonLimitsTests {
+		c.Logf("test %d: %s", i, test.about)
+		for _, vers := range []macaroon.Version{macaroon.V1, macaroon.V2} {
+			c.Logf("version %v", vers)
+			m0 := newLimitsMacaroon(c, vers, test.ncav)
+			binData, err := m0.MarshalBinary()
+			c.Assert(err, gc.IsNil)
+			jsonData, err := m0.MarshalJSON()
+			c.Assert(err, gc.IsNil)
+			cborData, err := m0.MarshalCBOR()
+			c.Assert(err, gc.IsNil)
+
+			var m1, m2, m3 macaroon.Macaroon
+			errs := []error{
+				m1.UnmarshalBinaryWithLimits(binData, test.limits),
+				m2.UnmarshalJSONWithLimits(jsonData, test.limits),
+				m3.UnmarshalCBORWithLimits(cborData, test.limits),
+			}
+			for j, err := range errs {
+				if test.expectErr != "" {
+					c.Assert(err, gc.ErrorMatches, test.expectErr, gc.Commentf("decoder %d", j))
+				} else {
+					c.Assert(err, gc.IsNil, gc.Commentf("decoder %d", j))
+				}
+			}
+			if test.expectErr == "" {
+				assertEqualMacaroons(c, m0, &m1)
+				assertEqualMacaroons(c, m0, &m2)
+				assertEqualMacaroons(c, m0, &m3)
+			}
+		}
+	}
+}
+
+func (*limitsSuite) TestCaveatFieldTooLarge(c *gc.C) {
+	m0 := MustNew([]byte("key"), "id", "loc")
+	err := m0.AddFirstPartyCaveat(strings.Repeat("x", 100))
+	c.Assert(err, gc.IsNil)
+	data, err := m0.MarshalBinary()
+	c.Assert(err, gc.IsNil)
+	var m1 macaroon.Macaroon
+	err = m1.UnmarshalBinaryWithLimits(data, macaroon.DecodeLimits{
+		MaxFieldSize: 99,
+	})
+	c.Assert(err, gc.ErrorMatches, `caveat id field too large \(100 bytes; max 99\)`)
+}
+
+func (*limitsSuite) TestSliceLimits(c *gc.C) {
+	_, s := newDischargedSlice(c, macaroon.V2)
+	c.Assert(s, gc.HasLen, 3)
+	binData, err := s.MarshalBinary()
+	c.Assert(err, gc.IsNil)
+	jsonData, err := json.Marshal(s)
+	c.Assert(err, gc.IsNil)
+
+	limits := macaroon.DecodeLimits{
+		MaxDischarges: 2,
+	}
+	var s1 macaroon.Slice
+	err = s1.UnmarshalBinaryWithLimits(binData, limits)
+	c.Assert(err, gc.IsNil)
+	assertEqualSlices(c, s, s1)
+	var s2 macaroon.Slice
+	err = s2.UnmarshalJSONWithLimits(jsonData, limits)
+	c.Assert(err, gc.IsNil)
+	assertEqualSlices(c, s, s2)
+
+	limits.MaxDischarges = 1
+	err = s1.UnmarshalBinaryWithLimits(binData, limits)
+	c.Assert(err, gc.ErrorMatches, `too many discharge macaroons \(max 1\)`)
+	err = s2.UnmarshalJSONWithLimits(jsonData, limits)
+	c.Assert(err, gc.ErrorMatches, `too many discharge macaroons \(max 1\)`)
+
+	// Limits on individual macaroons are applied to each
+	// macaroon in the slice.
+	limits = macaroon.DecodeLimits{
+		MaxCaveats: 1,
+	}
+	err = s1.UnmarshalBinaryWithLimits(binData, limits)
+	c.Assert(err, gc.ErrorMatches, `cannot unmarshal macaroon 0: too many caveats \(max 1\)`)
+	err = s2.UnmarshalJSONWithLimits(jsonData, limits)
+	c.Assert(err, gc.ErrorMatches, `cannot unmarshal macaroon 0: too many caveats \(max 1\)`)
+
+	err = s2.UnmarshalJSONWithLimits([]byte(`[null]`), macaroon.DefaultDecodeLimits)
+	c.Assert(err, gc.ErrorMatches, `null macaroon at index 0`)
+}
+
+func (*limitsSuite) TestDeserializeWithLimits(c *gc.C) {
+	_, s := newDischargedSlice(c, macaroon.V1)
+	str, err := macaroon.SerializeSlice(s)
+	c.Assert(err, gc.IsNil)
+	s1, err := macaroon.DeserializeSliceWithLimits(str, macaroon.DefaultDecodeLimits)
+	c.Assert(err, gc.IsNil)
+	assertEqualSlices(c, s, s1)
+
+	m, err := macaroon.DeserializeWithLimits(str, macaroon.DefaultDecodeLimits)
+	c.Assert(err, gc.IsNil)
+	assertEqualMacaroons(c, s[0], m)
+
+	_, err = macaroon.DeserializeSliceWithLimits(str, macaroon.DecodeLimits{
+		MaxDischarges: 1,
+	})
+	c.Assert(err, gc.ErrorMatches, `too many discharge macaroons \(max 1\)`)
+
+	// Over-long encoded data is rejected before it is decoded.
+	_, err = macaroon.DeserializeSliceWithLimits(str, macaroon.DecodeLimits{
+		MaxSize: 10,
+	})
+	c.Assert(err, gc.ErrorMatches, `encoded data too large \(\d+ bytes; max 16\)`)
+	_, err = macaroon.DeserializeWithLimits("!!!!", macaroon.DefaultDecodeLimits)
+	c.Assert(err, gc.ErrorMatches, `cannot base64-decode macaroon: .*`)
+
+	jsonData, err := json.Marshal(s)
+	c.Assert(err, gc.IsNil)
+	s2, err := macaroon.DeserializeSliceWithLimits(string(jsonData), macaroon.DefaultDecodeLimits)
+	c.Assert(err, gc.IsNil)
+	assertEqualSlices(c, s, s2)
+}
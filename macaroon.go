@@ -5,10 +5,7 @@
 package macaroon
 
 import (
-	"bytes"
-	"crypto/hmac"
 	"crypto/rand"
-	"crypto/sha256"
 	"fmt"
 	"io"
 )
@@ -27,6 +24,24 @@ type Macaroon struct {
 	id       packet
 	caveats  []caveat
 	sig      []byte
+
+	// scheme holds the scheme used to calculate
+	// the macaroon's signature.
+	scheme Scheme
+
+	// encodedScheme holds the scheme recorded in the
+	// encoding that the macaroon was decoded from, if
+	// hasEncodedScheme is true. It is never used to
+	// calculate signatures, because it is not trusted.
+	encodedScheme    Scheme
+	hasEncodedScheme bool
+
+	// version holds the binary format version
+	// of the packets in data.
+	version Version
+
+	// jsonFormat holds the format used by MarshalJSON.
+	jsonFormat JSONFormat
 }
 
 // caveat holds a first person or third party caveat.
@@ -36,11 +51,26 @@ type caveat struct {
 	verificationId packet
 }
 
+// Caveat holds a caveat as returned by Macaroon.Caveats.
+// The Id field may hold arbitrary bytes; it is not
+// necessarily valid UTF-8.
 type Caveat struct {
 	Id       string
 	Location string
 }
 
+// IdBytes returns the caveat id as a byte slice.
+func (cav Caveat) IdBytes() []byte {
+	return []byte(cav.Id)
+}
+
+// IsConfidential reports whether the caveat is a first party
+// caveat added with Macaroon.AddConfidentialCaveat, in which
+// case its id holds the encrypted condition.
+func (cav Caveat) IsConfidential() bool {
+	return cav.Location == "" && isConfidential([]byte(cav.Id))
+}
+
 // isThirdParty reports whether the caveat must be satisfied
 // by some third party (if not, it's a first person caveat).
 func (cav *caveat) isThirdParty() bool {
@@ -48,23 +78,91 @@ func (cav *caveat) isThirdParty() bool {
 }
 
 // New returns a new macaroon with the given root key,
-// identifier and location.
+// identifier and location. The macaroon uses SchemeNative
+// to calculate its signature.
 func New(rootKey []byte, id, loc string) (*Macaroon, error) {
-	var m Macaroon
-	if err := m.init(id, loc); err != nil {
+	return NewWithScheme(rootKey, id, loc, SchemeNative)
+}
+
+// NewWithScheme is like New except that the macaroon's
+// signature, and those of any caveats added to it,
+// are calculated with the given scheme.
+func NewWithScheme(rootKey []byte, id, loc string, scheme Scheme) (*Macaroon, error) {
+	return NewWithParams(NewParams{
+		RootKey:  rootKey,
+		Id:       []byte(id),
+		Location: loc,
+		Scheme:   scheme,
+	})
+}
+
+// NewParams holds the parameters for a NewWithParams call.
+type NewParams struct {
+	// RootKey holds the root key of the macaroon.
+	RootKey []byte
+
+	// Id holds the identifier of the macaroon.
+	// It may hold arbitrary bytes.
+	Id []byte
+
+	// Location holds the location hint of the macaroon.
+	Location string
+
+	// Scheme holds the scheme used to calculate
+	// the macaroon's signature.
+	Scheme Scheme
+
+	// Version holds the binary format version of the
+	// macaroon. Only V2 macaroons may hold fields
+	// that are too big for the V1 format.
+	Version Version
+}
+
+// NewWithParams returns a new macaroon with the given parameters.
+func NewWithParams(p NewParams) (*Macaroon, error) {
+	if !p.Scheme.valid() {
+		return nil, fmt.Errorf("unknown signature scheme %v", p.Scheme)
+	}
+	if !p.Version.valid() {
+		return nil, fmt.Errorf("unknown macaroon version %v", p.Version)
+	}
+	m := Macaroon{
+		scheme:  p.Scheme,
+		version: p.Version,
+	}
+	if err := m.init(p.Id, p.Location); err != nil {
 		return nil, err
 	}
-	m.sig = keyedHash(rootKey, m.dataBytes(m.id))
+	m.sig = p.Scheme.sign(p.Scheme.deriveKey(p.RootKey), m.dataBytes(m.id))
 	return &m, nil
 }
 
-func (m *Macaroon) init(id, loc string) error {
+// init initializes m.data with the location and identifier
+// packets, encoded according to m.version.
+func (m *Macaroon) init(id []byte, loc string) error {
+	m.data = nil
+	m.caveats = nil
 	var ok bool
+	if m.version == V2 {
+		m.data = append(m.data, v2Marker)
+		if loc != "" {
+			m.location, ok = m.appendPacketV2(fieldTypeLocation, []byte(loc))
+			if !ok {
+				return fmt.Errorf("macaroon location too big")
+			}
+		}
+		m.id, ok = m.appendPacketV2(fieldTypeIdentifier, id)
+		if !ok {
+			return fmt.Errorf("macaroon identifier too big")
+		}
+		m.appendEOSV2()
+		return nil
+	}
 	m.location, ok = m.appendPacket(fieldLocation, []byte(loc))
 	if !ok {
 		return fmt.Errorf("macaroon location too big")
 	}
-	m.id, ok = m.appendPacket(fieldIdentifier, []byte(id))
+	m.id, ok = m.appendPacket(fieldIdentifier, id)
 	if !ok {
 		return fmt.Errorf("macaroon identifier too big")
 	}
@@ -94,6 +192,79 @@ func (m *Macaroon) Id() string {
 	return m.dataStr(m.id)
 }
 
+// IdBytes returns the macaroon's identifier as a byte slice.
+func (m *Macaroon) IdBytes() []byte {
+	return append([]byte(nil), m.dataBytes(m.id)...)
+}
+
+// Scheme returns the scheme used to calculate the
+// macaroon's signature.
+func (m *Macaroon) Scheme() Scheme {
+	return m.scheme
+}
+
+// SetScheme sets the scheme used to add caveats to
+// the macaroon and to verify it with Macaroon.Verify. It
+// does not change the macaroon's signature. The scheme
+// is not taken from the marshaled form of a macaroon,
+// so SetScheme should be called on a macaroon that has
+// been unmarshaled from data produced by an implementation
+// using a different scheme. The scheme is retained
+// when unmarshaling into an existing macaroon.
+func (m *Macaroon) SetScheme(scheme Scheme) {
+	m.scheme = scheme
+}
+
+// Version returns the binary format version used
+// to marshal the macaroon.
+func (m *Macaroon) Version() Version {
+	return m.version
+}
+
+// SetVersion sets the binary format version used
+// to marshal the macaroon. It returns an error
+// if the macaroon cannot be represented in that
+// version, in which case the macaroon is unchanged.
+func (m *Macaroon) SetVersion(version Version) error {
+	if version == m.version {
+		return nil
+	}
+	if !version.valid() {
+		return fmt.Errorf("unknown macaroon version %v", version)
+	}
+	m1 := Macaroon{
+		sig:        m.sig,
+		scheme:     m.scheme,
+		version:    version,
+		jsonFormat: m.jsonFormat,
+	}
+	if err := m1.init(m.dataBytes(m.id), m.Location()); err != nil {
+		return err
+	}
+	for _, cav := range m.caveats {
+		if _, err := m1.appendCaveat(m.dataBytes(cav.caveatId), m.dataBytes(cav.verificationId), m.dataStr(cav.location)); err != nil {
+			return err
+		}
+	}
+	*m = m1
+	return nil
+}
+
+// JSONFormat returns the format used by MarshalJSON
+// to marshal the macaroon.
+func (m *Macaroon) JSONFormat() JSONFormat {
+	return m.jsonFormat
+}
+
+// SetJSONFormat sets the format used by MarshalJSON
+// to marshal the macaroon. UnmarshalJSON sets the format
+// to the one it found, so a macaroon is marshaled in the
+// same format that it was unmarshaled from unless
+// SetJSONFormat is called.
+func (m *Macaroon) SetJSONFormat(f JSONFormat) {
+	m.jsonFormat = f
+}
+
 // Signature returns the macaroon's signature.
 func (m *Macaroon) Signature() []byte {
 	return append([]byte(nil), m.sig...)
@@ -113,40 +284,74 @@ func (m *Macaroon) Caveats() []Caveat {
 }
 
 // appendCaveat appends a caveat without modifying the macaroon's signature.
-func (m *Macaroon) appendCaveat(caveatId string, verificationId []byte, loc string) (*caveat, error) {
+func (m *Macaroon) appendCaveat(caveatId []byte, verificationId []byte, loc string) (*caveat, error) {
+	start := len(m.data)
+	cav, err := m.appendCaveatPackets(caveatId, verificationId, loc)
+	if err != nil {
+		// Don't leave any partially added caveat behind.
+		m.data = m.data[0:start]
+		return nil, err
+	}
+	m.caveats = append(m.caveats, cav)
+	return &m.caveats[len(m.caveats)-1], nil
+}
+
+func (m *Macaroon) appendCaveatPackets(caveatId []byte, verificationId []byte, loc string) (caveat, error) {
+	if m.version == V2 {
+		return m.appendCaveatPacketsV2(caveatId, verificationId, loc)
+	}
 	var cav caveat
 	var ok bool
-	if caveatId != "" {
-		cav.caveatId, ok = m.appendPacket(fieldCaveatId, []byte(caveatId))
+	if len(caveatId) > 0 {
+		cav.caveatId, ok = m.appendPacket(fieldCaveatId, caveatId)
 		if !ok {
-			return nil, fmt.Errorf("caveat identifier too big")
+			return caveat{}, fmt.Errorf("caveat identifier too big")
 		}
 	}
 	if len(verificationId) > 0 {
 		cav.verificationId, ok = m.appendPacket(fieldVerificationId, verificationId)
 		if !ok {
-			return nil, fmt.Errorf("caveat verification id too big")
+			return caveat{}, fmt.Errorf("caveat verification id too big")
 		}
 	}
 	if loc != "" {
 		cav.location, ok = m.appendPacket(fieldCaveatLocation, []byte(loc))
 		if !ok {
-			return nil, fmt.Errorf("caveat location too big")
+			return caveat{}, fmt.Errorf("caveat location too big")
 		}
 	}
-	m.caveats = append(m.caveats, cav)
-	return &m.caveats[len(m.caveats)-1], nil
+	return cav, nil
+}
+
+func (m *Macaroon) appendCaveatPacketsV2(caveatId []byte, verificationId []byte, loc string) (caveat, error) {
+	var cav caveat
+	var ok bool
+	if loc != "" {
+		cav.location, ok = m.appendPacketV2(fieldTypeLocation, []byte(loc))
+		if !ok {
+			return caveat{}, fmt.Errorf("caveat location too big")
+		}
+	}
+	cav.caveatId, ok = m.appendPacketV2(fieldTypeIdentifier, caveatId)
+	if !ok {
+		return caveat{}, fmt.Errorf("caveat identifier too big")
+	}
+	if len(verificationId) > 0 {
+		cav.verificationId, ok = m.appendPacketV2(fieldTypeVerificationId, verificationId)
+		if !ok {
+			return caveat{}, fmt.Errorf("caveat verification id too big")
+		}
+	}
+	m.appendEOSV2()
+	return cav, nil
 }
 
-func (m *Macaroon) addCaveat(caveatId string, verificationId []byte, loc string) error {
+func (m *Macaroon) addCaveat(caveatId []byte, verificationId []byte, loc string) error {
 	cav, err := m.appendCaveat(caveatId, verificationId, loc)
 	if err != nil {
 		return err
 	}
-	sig := keyedHasher(m.sig)
-	sig.Write(m.dataBytes(cav.verificationId))
-	sig.Write(m.dataBytes(cav.caveatId))
-	m.sig = sig.Sum(m.sig[:0])
+	m.sig = m.scheme.caveatSig(m.sig, m.dataBytes(cav.caveatId), m.dataBytes(cav.verificationId))
 	return nil
 }
 
@@ -154,12 +359,54 @@ func (m *Macaroon) addCaveat(caveatId string, verificationId []byte, loc string)
 // macaroon with the given rootSig. This must be
 // used before it is used in the discharges argument to Verify.
 func (m *Macaroon) Bind(rootSig []byte) {
-	m.sig = bindForRequest(rootSig, m.sig)
+	m.sig = m.scheme.bind(rootSig, m.sig)
 }
 
 // AddFirstPartyCaveat adds a caveat that will be verified
 // by the target service.
+//
+// A leading zero byte is reserved to mark confidential
+// caveats (see AddConfidentialCaveat), so it is an error
+// for caveatId to start with one.
 func (m *Macaroon) AddFirstPartyCaveat(caveatId string) error {
+	return m.AddFirstPartyCaveatBytes([]byte(caveatId))
+}
+
+// AddFirstPartyCaveatBytes is like AddFirstPartyCaveat
+// except that the caveat id is specified as a byte slice.
+func (m *Macaroon) AddFirstPartyCaveatBytes(caveatId []byte) error {
+	if isConfidential(caveatId) {
+		return fmt.Errorf("first party caveat id must not start with a zero byte")
+	}
+	return m.addCaveat(caveatId, nil, "")
+}
+
+// AddConfidentialCaveat adds a first party caveat whose condition
+// is encrypted with a key derived from the given root key, which
+// must be the root key that the macaroon was minted with (or, for
+// a discharge macaroon, the root key of the caveat it discharges).
+// The condition cannot be read by anyone holding the macaroon, but
+// it is decrypted during verification, so the check function
+// passed to Verify sees it as if it had been added with
+// AddFirstPartyCaveat.
+//
+// The id of a confidential caveat always starts with a zero
+// byte, which AddFirstPartyCaveat and AddFirstPartyCaveatBytes
+// reject, so the two kinds of caveat cannot be confused.
+func (m *Macaroon) AddConfidentialCaveat(rootKey []byte, condition string) error {
+	return m.AddConfidentialCaveatWithRand(rootKey, []byte(condition), rand.Reader)
+}
+
+// AddConfidentialCaveatWithRand is like AddConfidentialCaveat
+// except that the condition is specified as a byte slice and
+// the given source of randomness is used instead of
+// crypto/rand.Reader when encrypting it.
+func (m *Macaroon) AddConfidentialCaveatWithRand(rootKey []byte, condition []byte, r io.Reader) error {
+	confKey := m.scheme.confidentialKey(m.scheme.deriveKey(rootKey))
+	caveatId, err := m.scheme.encryptCondition(confKey, condition, r)
+	if err != nil {
+		return err
+	}
 	return m.addCaveat(caveatId, nil, "")
 }
 
@@ -170,27 +417,40 @@ func (m *Macaroon) AddFirstPartyCaveat(caveatId string) error {
 // or by holding a reference to it stored in the third party's
 // storage.
 func (m *Macaroon) AddThirdPartyCaveat(rootKey []byte, caveatId string, loc string) error {
-	return m.addThirdPartyCaveatWithRand(rootKey, caveatId, loc, rand.Reader)
+	return m.AddThirdPartyCaveatWithRand(rootKey, []byte(caveatId), loc, rand.Reader)
 }
 
-func (m *Macaroon) addThirdPartyCaveatWithRand(rootKey []byte, caveatId string, loc string, r io.Reader) error {
-	verificationId, err := encrypt(m.sig, rootKey, r)
-	if err != nil {
-		return err
+// AddThirdPartyCaveatBytes is like AddThirdPartyCaveat
+// except that the caveat id is specified as a byte slice.
+func (m *Macaroon) AddThirdPartyCaveatBytes(rootKey []byte, caveatId []byte, loc string) error {
+	return m.AddThirdPartyCaveatWithRand(rootKey, caveatId, loc, rand.Reader)
+}
+
+// AddThirdPartyCaveatWithRand is like AddThirdPartyCaveatBytes
+// except that the given source of randomness is used instead of
+// crypto/rand.Reader when encrypting the root key. Adding the same
+// caveat with the same random bytes always produces the same
+// macaroon, which is useful for tests and for producing test
+// vectors; a predictable source should never be used otherwise.
+//
+// Caveat ids starting with a zero byte followed by
+// "macaroon-any-of" are reserved for any-of caveats
+// (see AddAnyOfThirdPartyCaveat) and are rejected.
+func (m *Macaroon) AddThirdPartyCaveatWithRand(rootKey []byte, caveatId []byte, loc string, r io.Reader) error {
+	if isAnyOf(caveatId) {
+		return fmt.Errorf("third party caveat id has prefix reserved for any-of caveats")
 	}
-	return m.addCaveat(caveatId, verificationId, loc)
+	return m.addThirdPartyCaveat(rootKey, caveatId, loc, r)
 }
 
-// bndForRequest binds the given macaroon
-// to the given signature of its parent macaroon.
-func bindForRequest(rootSig, dischargeSig []byte) []byte {
-	if bytes.Equal(rootSig, dischargeSig) {
-		return rootSig
+// addThirdPartyCaveat is like AddThirdPartyCaveatWithRand
+// but allows any caveat id.
+func (m *Macaroon) addThirdPartyCaveat(rootKey []byte, caveatId []byte, loc string, r io.Reader) error {
+	verificationId, err := m.scheme.encryptKey(m.sig, m.scheme.deriveKey(rootKey), r)
+	if err != nil {
+		return err
 	}
-	sig := sha256.New()
-	sig.Write(rootSig)
-	sig.Write(dischargeSig)
-	return sig.Sum(nil)
+	return m.addCaveat(caveatId, verificationId, loc)
 }
 
 // Verify verifies that the receiving macaroon is valid.
@@ -200,72 +460,33 @@ func bindForRequest(rootSig, dischargeSig []byte) []byte {
 // condition is not met.
 //
 // The discharge macaroons should be provided in discharges.
+// They are all verified using the scheme of the receiving
+// macaroon, as set by NewWithScheme or SetScheme.
 //
-// Verify returns true if the verification succeeds; if returns
-// (false, nil) if the verification fails, and (false, err) if
-// the verification cannot be asserted (but may not be false).
-//
-// TODO(rog) is there a possible DOS attack that can cause this
-// function to infinitely recurse?
+// Verify returns nil if the verification succeeds.
+// It is equivalent to calling the Verify method
+// on the result of NewVerifier with that scheme.
 func (m *Macaroon) Verify(rootKey []byte, check func(caveat string) error, discharges []*Macaroon) error {
-	// TODO(rog) consider distinguishing between classes of
-	// check error - some errors may be resolved by minting
-	// a new macaroon; others may not.
-	return m.verify(m.sig, rootKey, check, discharges)
+	return NewVerifier(VerifierParams{
+		Check:      check,
+		Scheme:     m.scheme,
+		Discharges: discharges,
+	}).Verify(m, rootKey)
 }
 
-func (m *Macaroon) verify(rootSig []byte, rootKey []byte, check func(caveat string) error, discharges []*Macaroon) error {
-	if len(rootSig) == 0 {
-		rootSig = m.sig
-	}
-	caveatSig := keyedHash(rootKey, m.dataBytes(m.id))
-	for i, cav := range m.caveats {
-		if cav.isThirdParty() {
-			cavKey, err := decrypt(caveatSig, m.dataBytes(cav.verificationId))
-			if err != nil {
-				return fmt.Errorf("failed to decrypt caveat %d signature: %v", i, err)
-			}
-			// We choose an arbitrary error from one of the
-			// possible discharge macaroon verifications
-			// if there's more than one discharge macaroon
-			// with the required id.
-			var verifyErr error
-			found := false
-			for _, dm := range discharges {
-				if !bytes.Equal(dm.dataBytes(dm.id), m.dataBytes(cav.caveatId)) {
-					continue
-				}
-				found = true
-				verifyErr = dm.verify(rootSig, cavKey, check, discharges)
-				if verifyErr == nil {
-					break
-				}
-			}
-			if !found {
-				return fmt.Errorf("cannot find discharge macaroon for caveat %q", m.dataBytes(cav.caveatId))
-			}
-			if verifyErr != nil {
-				return verifyErr
-			}
-		} else {
-			if err := check(string(m.dataBytes(cav.caveatId))); err != nil {
-				return err
-			}
-		}
-		sig := keyedHasher(caveatSig)
-		sig.Write(m.dataBytes(cav.verificationId))
-		sig.Write(m.dataBytes(cav.caveatId))
-		caveatSig = sig.Sum(caveatSig[:0])
-	}
-	// TODO perhaps we should actually do this check before doing
-	// all the potentially expensive caveat checks.
-	boundSig := bindForRequest(rootSig, caveatSig)
-	if !hmac.Equal(boundSig, m.sig) {
-		return fmt.Errorf("signature mismatch after caveat verification")
-	}
-	return nil
-}
-
-type Verifier interface {
-	Verify(m *Macaroon, rootKey []byte) (bool, error)
+// VerifySignature verifies the signature of the receiving macaroon
+// and of all the discharge macaroons needed to discharge its third
+// party caveats, without checking any first party caveats. It returns
+// the conditions of all the first party caveats in those macaroons,
+// which the caller must check before treating the macaroon
+// as valid.
+//
+// It is equivalent to calling the VerifySignature method
+// on the result of NewVerifier with the scheme of the
+// receiving macaroon.
+func (m *Macaroon) VerifySignature(rootKey []byte, discharges []*Macaroon) ([]string, error) {
+	return newVerifier(VerifierParams{
+		Scheme:     m.scheme,
+		Discharges: discharges,
+	}).VerifySignature(m, rootKey)
 }
@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
 
 	gc "gopkg.in/check.v1"
@@ -63,7 +64,9 @@ func (*macaroonSuite) TestFirstPartyCaveat(c *gc.C) {
 
 	m.AddFirstPartyCaveat("not met")
 	err = m.Verify(rootKey, check, nil)
-	c.Assert(err, gc.Equals, expectErr)
+	c.Assert(err, gc.FitsTypeOf, (*macaroon.VerificationError)(nil))
+	c.Assert(err.(*macaroon.VerificationError).Err, gc.Equals, expectErr)
+	c.Assert(err, gc.ErrorMatches, "condition not met")
 
 	c.Assert(tested["not met"], gc.Equals, true)
 }
@@ -89,7 +92,7 @@ func (*macaroonSuite) TestThirdPartyCaveatBadRandom(c *gc.C) {
 	dischargeRootKey := []byte("shared root key")
 	thirdPartyCaveatId := "3rd party caveat"
 
-	err := macaroon.AddThirdPartyCaveatWithRand(m, dischargeRootKey, thirdPartyCaveatId, "remote.com", &macaroon.ErrorReader{})
+	err := m.AddThirdPartyCaveatWithRand(dischargeRootKey, []byte(thirdPartyCaveatId), "remote.com", &macaroon.ErrorReader{})
 	c.Assert(err, gc.ErrorMatches, "cannot generate random bytes: fail")
 }
 
@@ -324,6 +327,87 @@ var verifyTests = []struct {
 		},
 		expectErr: `condition "high-fiving" not met`,
 	}},
+}, {
+	about: "discharge with caveat discharged by itself",
+	macaroons: []macaroonSpec{{
+		rootKey: "root-key",
+		id:      "root-id",
+		caveats: []caveat{{
+			condition: "bob-is-great",
+			location:  "bob",
+			rootKey:   "bob-caveat-root-key",
+		}},
+	}, {
+		location: "bob",
+		rootKey:  "bob-caveat-root-key",
+		id:       "bob-is-great",
+		caveats: []caveat{{
+			condition: "bob-is-great",
+			location:  "bob",
+			rootKey:   "bob-caveat-root-key",
+		}},
+	}},
+	conditions: []conditionTest{{
+		expectErr: `discharge macaroon for caveat "bob-is-great" is already in use`,
+	}},
+}, {
+	about:     "discharges in a cycle",
+	macaroons: cyclicThirdPartyCaveatMacaroons,
+	conditions: []conditionTest{{
+		conditions: map[string]bool{
+			"splendid": true,
+		},
+		expectErr: `discharge macaroon for caveat "bob-is-great" is already in use`,
+	}, {
+		conditions: map[string]bool{
+			"splendid": false,
+		},
+		expectErr: `condition "splendid" not met`,
+	}},
+}, {
+	about: "cycle through duplicate discharges",
+	macaroons: append(cyclicThirdPartyCaveatMacaroons, macaroonSpec{
+		location: "bob",
+		rootKey:  "bob-caveat-root-key",
+		id:       "bob-is-great",
+	}),
+	conditions: []conditionTest{{
+		conditions: map[string]bool{
+			"splendid": true,
+		},
+	}},
+}}
+
+// cyclicThirdPartyCaveatMacaroons holds a primary macaroon
+// and discharges for it that discharge each other's caveats.
+var cyclicThirdPartyCaveatMacaroons = []macaroonSpec{{
+	rootKey: "root-key",
+	id:      "root-id",
+	caveats: []caveat{{
+		condition: "bob-is-great",
+		location:  "bob",
+		rootKey:   "bob-caveat-root-key",
+	}},
+}, {
+	location: "bob",
+	rootKey:  "bob-caveat-root-key",
+	id:       "bob-is-great",
+	caveats: []caveat{{
+		condition: "splendid",
+	}, {
+		condition: "charlie-is-great",
+		location:  "charlie",
+		rootKey:   "charlie-caveat-root-key",
+	}},
+}, {
+	location: "charlie",
+	rootKey:  "charlie-caveat-root-key",
+	id:       "charlie-is-great",
+	caveats: []caveat{{
+		condition: "bob-is-great",
+		location:  "bob",
+		rootKey:   "bob-caveat-root-key",
+	}},
 }}
 
 var recursiveThirdPartyCaveatMacaroons = []macaroonSpec{{
@@ -435,16 +519,14 @@ func (*macaroonSuite) TestMarshalJSON(c *gc.C) {
 
 func (*macaroonSuite) TestJSONRoundTrip(c *gc.C) {
 	// jsonData produced from the second example in libmacaroons
-	// example README, but with the signature tweaked to
-	// match our current behaviour.
-	// TODO fix that behaviour so that our signatures match.
-	jsonData := `{"caveats":[{"cid":"account = 3735928559"},{"cid":"this was how we remind auth of key\/pred","vid":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA027FAuBYhtHwJ58FX6UlVNFtFsGxQHS7uD\/w\/dedwv4Jjw7UorCREw5rXbRqIKhr","cl":"http:\/\/auth.mybank\/"}],"location":"http:\/\/mybank\/","identifier":"we used our other secret key","signature":"6e315b0b391e8c6cc6f8d88fc22933a13430fb289b2fb613cf70f746bbe7d27d"}`
+	// example README.
+	jsonData := libmacaroonsThirdPartyJSON
 
 	var m macaroon.Macaroon
 	err := json.Unmarshal([]byte(jsonData), &m)
 	c.Assert(err, gc.IsNil)
 	c.Assert(hex.EncodeToString(m.Signature()), gc.Equals,
-		"6e315b0b391e8c6cc6f8d88fc22933a13430fb289b2fb613cf70f746bbe7d27d")
+		"d27db2fd1f22760e4c3dae8137e2d8fc1df6c0741c18aed4b97256bf78d1f55c")
 	data, err := m.MarshalJSON()
 	c.Assert(err, gc.IsNil)
 
@@ -566,3 +648,828 @@ func (*macaroonSuite) TestMacaroonFieldsTooBig(c *gc.C) {
 	err = m0.AddThirdPartyCaveat([]byte("shared root key"), "3rd party caveat", string(toobig))
 	c.Assert(err, gc.ErrorMatches, "caveat location too big")
 }
+
+// The following test vectors are taken from the examples
+// in the libmacaroons README.
+
+func (*macaroonSuite) TestLibmacaroonsFirstPartyCaveats(c *gc.C) {
+	rootKey := []byte("this is our super secret key; only we should know it")
+	m, err := macaroon.NewWithScheme(rootKey, "we used our secret key", "http://mybank/", macaroon.SchemeLibmacaroons)
+	c.Assert(err, gc.IsNil)
+	c.Assert(m.Scheme(), gc.Equals, macaroon.SchemeLibmacaroons)
+	c.Assert(hex.EncodeToString(m.Signature()), gc.Equals,
+		"e3d9e02908526c4c0039ae15114115d97fdd68bf2ba379b342aaf0f617d0552f")
+
+	for i, cav := range []struct {
+		condition string
+		expectSig string
+	}{{
+		condition: "account = 3735928559",
+		expectSig: "1efe4763f290dbce0c1d08477367e11f4eee456a64933cf662d79772dbb82128",
+	}, {
+		condition: "time < 2020-01-01T00:00",
+		expectSig: "b5f06c8c8ef92f6c82c6ff282cd1f8bd1849301d09a2db634ba182536a611c49",
+	}, {
+		condition: "email = alice@example.org",
+		expectSig: "ddf553e46083e55b8d71ab822be3d8fcf21d6bf19c40d617bb9fb438934474b6",
+	}} {
+		c.Logf("caveat %d: %q", i, cav.condition)
+		err := m.AddFirstPartyCaveat(cav.condition)
+		c.Assert(err, gc.IsNil)
+		c.Assert(hex.EncodeToString(m.Signature()), gc.Equals, cav.expectSig)
+	}
+	checked := make(map[string]bool)
+	err = m.Verify(rootKey, func(cav string) error {
+		checked[cav] = true
+		return nil
+	}, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(checked, gc.HasLen, 3)
+}
+
+func (*macaroonSuite) TestLibmacaroonsThirdPartyCaveat(c *gc.C) {
+	rootKey := []byte("this is a different super-secret key; never use the same secret twice")
+	m, err := macaroon.NewWithScheme(rootKey, "we used our other secret key", "http://mybank/", macaroon.SchemeLibmacaroons)
+	c.Assert(err, gc.IsNil)
+	err = m.AddFirstPartyCaveat("account = 3735928559")
+	c.Assert(err, gc.IsNil)
+	caveatKey := []byte("4; guaranteed random by a fair toss of the dice")
+	caveatId := "this was how we remind auth of key/pred"
+	// The libmacaroons example uses an all-zero nonce.
+	err = m.AddThirdPartyCaveatWithRand(caveatKey, []byte(caveatId), "http://auth.mybank/", zeroReader{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(hex.EncodeToString(m.Signature()), gc.Equals,
+		"d27db2fd1f22760e4c3dae8137e2d8fc1df6c0741c18aed4b97256bf78d1f55c")
+
+	// Check that we produce exactly the same macaroon as libmacaroons.
+	var m1 macaroon.Macaroon
+	err = json.Unmarshal([]byte(libmacaroonsThirdPartyJSON), &m1)
+	c.Assert(err, gc.IsNil)
+	assertEqualMacaroons(c, m, &m1)
+
+	dm, err := macaroon.NewWithScheme(caveatKey, caveatId, "http://auth.mybank/", macaroon.SchemeLibmacaroons)
+	c.Assert(err, gc.IsNil)
+	err = dm.AddFirstPartyCaveat("time < 2020-01-01T00:00")
+	c.Assert(err, gc.IsNil)
+	c.Assert(hex.EncodeToString(dm.Signature()), gc.Equals,
+		"2ed1049876e9d5840950274b579b0770317df54d338d9d3039c7c67d0d91d63c")
+	dm.Bind(m.Signature())
+
+	// The unmarshaled macaroon must be told its scheme before verification.
+	err = m1.Verify(rootKey, alwaysOK, []*macaroon.Macaroon{dm})
+	c.Assert(err, gc.ErrorMatches, "failed to decrypt caveat 1 signature: decryption failure")
+	m1.SetScheme(macaroon.SchemeLibmacaroons)
+	err = m1.Verify(rootKey, alwaysOK, []*macaroon.Macaroon{dm})
+	c.Assert(err, gc.IsNil)
+}
+
+// libmacaroonsThirdPartyJSON holds the JSON serialization of the
+// third party caveat example macaroon as produced by libmacaroons.
+const libmacaroonsThirdPartyJSON = `{"caveats":[{"cid":"account = 3735928559"},{"cid":"this was how we remind auth of key\/pred","vid":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA027FAuBYhtHwJ58FX6UlVNFtFsGxQHS7uD\/w\/dedwv4Jjw7UorCREw5rXbRqIKhr","cl":"http:\/\/auth.mybank\/"}],"location":"http:\/\/mybank\/","identifier":"we used our other secret key","signature":"d27db2fd1f22760e4c3dae8137e2d8fc1df6c0741c18aed4b97256bf78d1f55c"}`
+
+func (*macaroonSuite) TestSchemesAreIncompatible(c *gc.C) {
+	rootKey := []byte("secret")
+	m0 := MustNew(rootKey, "some id", "a location")
+	m1, err := macaroon.NewWithScheme(rootKey, "some id", "a location", macaroon.SchemeLibmacaroons)
+	c.Assert(err, gc.IsNil)
+	c.Assert(m0.Signature(), gc.Not(gc.DeepEquals), m1.Signature())
+
+	m1.SetScheme(macaroon.SchemeNative)
+	err = m1.Verify(rootKey, never, nil)
+	c.Assert(err, gc.ErrorMatches, "signature mismatch after caveat verification")
+}
+
+var allSchemes = []macaroon.Scheme{
+	macaroon.SchemeNative,
+	macaroon.SchemeLibmacaroons,
+	macaroon.SchemeHMACSHA512,
+	macaroon.SchemeAESGCM,
+}
+
+var schemeSigLens = map[macaroon.Scheme]int{
+	macaroon.SchemeNative:       32,
+	macaroon.SchemeLibmacaroons: 32,
+	macaroon.SchemeHMACSHA512:   64,
+	macaroon.SchemeAESGCM:       32,
+}
+
+func (*macaroonSuite) TestSchemes(c *gc.C) {
+	for _, scheme := range allSchemes {
+		c.Logf("scheme %v", scheme)
+		rootKey := []byte("secret")
+		m, err := macaroon.NewWithScheme(rootKey, "some id", "a location", scheme)
+		c.Assert(err, gc.IsNil)
+		c.Assert(m.Scheme(), gc.Equals, scheme)
+		err = m.AddFirstPartyCaveat("a caveat")
+		c.Assert(err, gc.IsNil)
+		err = m.AddThirdPartyCaveat([]byte("caveat key"), "3rd party caveat", "elsewhere")
+		c.Assert(err, gc.IsNil)
+		c.Assert(m.Signature(), gc.HasLen, schemeSigLens[scheme])
+
+		dm, err := macaroon.NewWithScheme([]byte("caveat key"), "3rd party caveat", "elsewhere", scheme)
+		c.Assert(err, gc.IsNil)
+		err = dm.AddFirstPartyCaveat("another caveat")
+		c.Assert(err, gc.IsNil)
+		dm.Bind(m.Signature())
+
+		// Check that verification selects the scheme
+		// of an unmarshaled macaroon once it is set.
+		data, err := m.MarshalBinary()
+		c.Assert(err, gc.IsNil)
+		var m1 macaroon.Macaroon
+		err = m1.UnmarshalBinary(data)
+		c.Assert(err, gc.IsNil)
+		m1.SetScheme(scheme)
+		err = m1.Verify(rootKey, alwaysOK, []*macaroon.Macaroon{dm})
+		c.Assert(err, gc.IsNil)
+
+		for _, other := range allSchemes {
+			if other == scheme {
+				continue
+			}
+			m1.SetScheme(other)
+			err = m1.Verify(rootKey, alwaysOK, []*macaroon.Macaroon{dm})
+			c.Assert(err, gc.NotNil, gc.Commentf("scheme %v", other))
+		}
+	}
+}
+
+func (*macaroonSuite) TestSchemeString(c *gc.C) {
+	c.Assert(macaroon.SchemeHMACSHA512.String(), gc.Equals, "hmac-sha512")
+	c.Assert(macaroon.SchemeAESGCM.String(), gc.Equals, "aes-gcm")
+	c.Assert(macaroon.Scheme(-1).String(), gc.Equals, "Scheme(-1)")
+}
+
+func (*macaroonSuite) TestNewWithUnknownScheme(c *gc.C) {
+	_, err := macaroon.NewWithScheme([]byte("secret"), "some id", "a location", macaroon.Scheme(99))
+	c.Assert(err, gc.ErrorMatches, `unknown signature scheme Scheme\(99\)`)
+}
+
+func alwaysOK(string) error {
+	return nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(buf []byte) (int, error) {
+	for i := range buf {
+		buf[i] = 0
+	}
+	return len(buf), nil
+}
+
+func (*macaroonSuite) TestBinaryRoundTripAllVersions(c *gc.C) {
+	for _, vers := range []macaroon.Version{macaroon.V1, macaroon.V2} {
+		c.Logf("version %v", vers)
+		rootKey := []byte("secret")
+		m0 := MustNew(rootKey, "some id", "a location")
+		err := m0.SetVersion(vers)
+		c.Assert(err, gc.IsNil)
+		err = m0.AddThirdPartyCaveat([]byte("shared root key"), "3rd party caveat", "remote.com")
+		c.Assert(err, gc.IsNil)
+		err = m0.AddFirstPartyCaveat("first caveat")
+		c.Assert(err, gc.IsNil)
+		err = m0.AddThirdPartyCaveat([]byte("other root key"), "another 3rd party caveat", "elsewhere.com")
+		c.Assert(err, gc.IsNil)
+		data, err := m0.MarshalBinary()
+		c.Assert(err, gc.IsNil)
+		var m1 macaroon.Macaroon
+		err = m1.UnmarshalBinary(data)
+		c.Assert(err, gc.IsNil)
+		c.Assert(m1.Version(), gc.Equals, vers)
+		assertEqualMacaroons(c, m0, &m1)
+
+		data1, err := m1.MarshalBinary()
+		c.Assert(err, gc.IsNil)
+		c.Assert(data1, gc.DeepEquals, data)
+	}
+}
+
+func (*macaroonSuite) TestBinaryMarshalingV2AgainstOtherImplementations(c *gc.C) {
+	// This data holds the libmacaroons third party caveat example
+	// macaroon encoded in the version 2 binary format, as produced
+	// by other macaroon implementations.
+	data := []byte("\x02" +
+		"\x01\x0ehttp://mybank/" +
+		"\x02\x1cwe used our other secret key" +
+		"\x00" +
+		"\x02\x14account = 3735928559" +
+		"\x00" +
+		"\x01\x13http://auth.mybank/" +
+		"\x02'this was how we remind auth of key/pred" +
+		"\x04\x48\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xd3\x6e\xc5\x02\xe0\x58\x86\xd1\xf0\x27\x9f\x05\x5f\xa5\x25\x54\xd1\x6d\x16\xc1\xb1\x40\x74\xbb\xb8\x3f\xf0\xfd\xd7\x9d\xc2\xfe\x09\x8f\x0e\xd4\xa2\xb0\x91\x13\x0e\x6b\x5d\xb4\x6a\x20\xa8\x6b" +
+		"\x00" +
+		"\x00" +
+		"\x06\x20\xd2\x7d\xb2\xfd\x1f\x22\x76\x0e\x4c\x3d\xae\x81\x37\xe2\xd8\xfc\x1d\xf6\xc0\x74\x1c\x18\xae\xd4\xb9\x72\x56\xbf\x78\xd1\xf5\x5c")
+	var m0 macaroon.Macaroon
+	err := m0.UnmarshalBinary(data)
+	c.Assert(err, gc.IsNil)
+	c.Assert(m0.Version(), gc.Equals, macaroon.V2)
+
+	var m1 macaroon.Macaroon
+	err = json.Unmarshal([]byte(libmacaroonsThirdPartyJSON), &m1)
+	c.Assert(err, gc.IsNil)
+	assertEqualMacaroons(c, &m0, &m1)
+
+	err = m1.SetVersion(macaroon.V2)
+	c.Assert(err, gc.IsNil)
+	data1, err := m1.MarshalBinary()
+	c.Assert(err, gc.IsNil)
+	c.Assert(data1, gc.DeepEquals, data)
+}
+
+var unmarshalBinaryV2ErrorTests = []struct {
+	about     string
+	data      string
+	expectErr string
+}{{
+	about:     "no header",
+	data:      "\x02",
+	expectErr: "section extends past end of data",
+}, {
+	about:     "no identifier",
+	data:      "\x02\x01\x03loc\x00\x00\x06\x01s",
+	expectErr: "invalid macaroon header",
+}, {
+	about:     "fields out of order",
+	data:      "\x02\x02\x02id\x01\x03loc\x00\x00\x06\x01s",
+	expectErr: "fields out of order",
+}, {
+	about:     "caveat without identifier",
+	data:      "\x02\x02\x02id\x00\x01\x03loc\x00\x00\x06\x01s",
+	expectErr: "no identifier in caveat",
+}, {
+	about:     "unexpected field in caveat",
+	data:      "\x02\x02\x02id\x00\x02\x03cav\x06\x01s\x00\x00\x06\x01s",
+	expectErr: "unexpected field type 6 in caveat",
+}, {
+	about:     "no signature",
+	data:      "\x02\x02\x02id\x00\x00\x02\x01s",
+	expectErr: "unexpected field type 2; expected signature",
+}, {
+	about:     "truncated",
+	data:      "\x02\x02\x02id\x00\x02\x03cav",
+	expectErr: "section extends past end of data",
+}}
+
+func (*macaroonSuite) TestUnmarshalBinaryV2Error(c *gc.C) {
+	for i, test := range unmarshalBinaryV2ErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		var m macaroon.Macaroon
+		err := m.UnmarshalBinary([]byte(test.data))
+		c.Assert(err, gc.ErrorMatches, test.expectErr)
+	}
+}
+
+func (*macaroonSuite) TestSetVersion(c *gc.C) {
+	rootKey := []byte("secret")
+	m := MustNew(rootKey, "some id", "a location")
+	c.Assert(m.Version(), gc.Equals, macaroon.V1)
+	err := m.AddFirstPartyCaveat("a caveat")
+	c.Assert(err, gc.IsNil)
+	sig := m.Signature()
+
+	err = m.SetVersion(macaroon.V2)
+	c.Assert(err, gc.IsNil)
+	c.Assert(m.Version(), gc.Equals, macaroon.V2)
+	c.Assert(m.Signature(), gc.DeepEquals, sig)
+
+	// Fields that are too big for V1 can be added to a V2 macaroon.
+	bigId := strings.Repeat("x", macaroon.MaxPacketLen)
+	err = m.AddThirdPartyCaveat([]byte("shared root key"), bigId, "remote.com")
+	c.Assert(err, gc.IsNil)
+	err = m.Verify(rootKey, alwaysOK, []*macaroon.Macaroon{
+		boundDischarge(m, []byte("shared root key"), bigId),
+	})
+	c.Assert(err, gc.IsNil)
+
+	// ... but the macaroon cannot then be converted to V1.
+	m1 := m.Clone()
+	err = m1.SetVersion(macaroon.V1)
+	c.Assert(err, gc.ErrorMatches, "caveat identifier too big")
+	assertEqualMacaroons(c, m, m1)
+	c.Assert(m1.Version(), gc.Equals, macaroon.V2)
+
+	err = m.SetVersion(macaroon.Version(99))
+	c.Assert(err, gc.ErrorMatches, `unknown macaroon version v\?\(99\)`)
+}
+
+func (*macaroonSuite) TestUnmarshalJSONWithBigFields(c *gc.C) {
+	m0 := MustNew([]byte("secret"), "some id", "a location")
+	err := m0.SetVersion(macaroon.V2)
+	c.Assert(err, gc.IsNil)
+	err = m0.AddFirstPartyCaveat(strings.Repeat("x", macaroon.MaxPacketLen))
+	c.Assert(err, gc.IsNil)
+	data, err := json.Marshal(m0)
+	c.Assert(err, gc.IsNil)
+
+	var m1 macaroon.Macaroon
+	err = json.Unmarshal(data, &m1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(m1.Version(), gc.Equals, macaroon.V2)
+	assertEqualMacaroons(c, m0, &m1)
+
+	// Small macaroons are unmarshaled as V1.
+	data, err = json.Marshal(MustNew([]byte("secret"), "some id", "a location"))
+	c.Assert(err, gc.IsNil)
+	err = json.Unmarshal(data, &m1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(m1.Version(), gc.Equals, macaroon.V1)
+}
+
+func boundDischarge(m *macaroon.Macaroon, rootKey []byte, id string) *macaroon.Macaroon {
+	dm, err := macaroon.NewWithParams(macaroon.NewParams{
+		RootKey: rootKey,
+		Id:      []byte(id),
+		Version: m.Version(),
+	})
+	if err != nil {
+		panic(err)
+	}
+	dm.Bind(m.Signature())
+	return dm
+}
+
+func (*macaroonSuite) TestNewWithParams(c *gc.C) {
+	bigId := strings.Repeat("x", macaroon.MaxPacketLen)
+	m, err := macaroon.NewWithParams(macaroon.NewParams{
+		RootKey:  []byte("secret"),
+		Id:       []byte(bigId),
+		Location: "a location",
+		Scheme:   macaroon.SchemeLibmacaroons,
+		Version:  macaroon.V2,
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(m.Id(), gc.Equals, bigId)
+	c.Assert(m.Location(), gc.Equals, "a location")
+	c.Assert(m.Scheme(), gc.Equals, macaroon.SchemeLibmacaroons)
+	c.Assert(m.Version(), gc.Equals, macaroon.V2)
+	err = m.Verify([]byte("secret"), never, nil)
+	c.Assert(err, gc.IsNil)
+
+	_, err = macaroon.NewWithParams(macaroon.NewParams{
+		Id:      []byte(bigId),
+		Version: macaroon.V1,
+	})
+	c.Assert(err, gc.ErrorMatches, "macaroon identifier too big")
+
+	_, err = macaroon.NewWithParams(macaroon.NewParams{
+		Version: macaroon.Version(99),
+	})
+	c.Assert(err, gc.ErrorMatches, `unknown macaroon version v\?\(99\)`)
+}
+
+func (*macaroonSuite) TestSerializeRoundTrip(c *gc.C) {
+	for _, vers := range []macaroon.Version{macaroon.V1, macaroon.V2} {
+		c.Logf("version %v", vers)
+		m0, err := macaroon.NewWithParams(macaroon.NewParams{
+			RootKey:  []byte("secret"),
+			Id:       []byte("some id"),
+			Location: "a location",
+			Version:  vers,
+		})
+		c.Assert(err, gc.IsNil)
+		err = m0.AddFirstPartyCaveat("first caveat")
+		c.Assert(err, gc.IsNil)
+		err = m0.AddThirdPartyCaveat([]byte("shared root key"), "3rd party caveat", "remote.com")
+		c.Assert(err, gc.IsNil)
+
+		s, err := macaroon.Serialize(m0)
+		c.Assert(err, gc.IsNil)
+		c.Assert(strings.ContainsAny(s, "+/="), gc.Equals, false)
+
+		m1, err := macaroon.Deserialize(s)
+		c.Assert(err, gc.IsNil)
+		c.Assert(m1.Version(), gc.Equals, vers)
+		assertEqualMacaroons(c, m0, m1)
+	}
+}
+
+func (*macaroonSuite) TestDeserializeAllEncodings(c *gc.C) {
+	var m0 macaroon.Macaroon
+	err := json.Unmarshal([]byte(libmacaroonsThirdPartyJSON), &m0)
+	c.Assert(err, gc.IsNil)
+	v1data, err := m0.MarshalBinary()
+	c.Assert(err, gc.IsNil)
+	err = m0.SetVersion(macaroon.V2)
+	c.Assert(err, gc.IsNil)
+	v2data, err := m0.MarshalBinary()
+	c.Assert(err, gc.IsNil)
+
+	payloads := map[string][]byte{
+		"json": []byte(libmacaroonsThirdPartyJSON),
+		"v1":   v1data,
+		"v2":   v2data,
+	}
+	encodings := map[string]func([]byte) string{
+		"std": base64.StdEncoding.EncodeToString,
+		"url": base64.URLEncoding.EncodeToString,
+		"std-unpadded": func(data []byte) string {
+			return strings.TrimRight(base64.StdEncoding.EncodeToString(data), "=")
+		},
+		"url-unpadded": func(data []byte) string {
+			return strings.TrimRight(base64.URLEncoding.EncodeToString(data), "=")
+		},
+	}
+	for pname, payload := range payloads {
+		for ename, encode := range encodings {
+			c.Logf("payload %s, encoding %s", pname, ename)
+			m1, err := macaroon.Deserialize(encode(payload))
+			c.Assert(err, gc.IsNil)
+			assertEqualMacaroons(c, &m0, m1)
+		}
+	}
+
+	// Unencoded JSON is accepted too.
+	m1, err := macaroon.Deserialize(" " + libmacaroonsThirdPartyJSON + "\n")
+	c.Assert(err, gc.IsNil)
+	assertEqualMacaroons(c, &m0, m1)
+}
+
+var deserializeErrorTests = []struct {
+	about     string
+	data      string
+	expectErr string
+}{{
+	about:     "bad base64",
+	data:      "AB!C",
+	expectErr: `cannot base64-decode macaroon: illegal base64 data at input byte 2`,
+}, {
+	about:     "bad JSON",
+	data:      "{",
+	expectErr: `cannot unmarshal json data: unexpected end of JSON input`,
+}, {
+	about:     "bad base64-encoded JSON",
+	data:      base64.StdEncoding.EncodeToString([]byte("{")),
+	expectErr: `cannot unmarshal json data: unexpected end of JSON input`,
+}, {
+	about:     "bad binary data",
+	data:      "AgA",
+	expectErr: `invalid macaroon header`,
+}}
+
+func (*macaroonSuite) TestDeserializeError(c *gc.C) {
+	for i, test := range deserializeErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		m, err := macaroon.Deserialize(test.data)
+		c.Assert(err, gc.ErrorMatches, test.expectErr)
+		c.Assert(m, gc.IsNil)
+	}
+}
+
+var base64DecodeTests = []struct {
+	about     string
+	input     string
+	expect    string
+	expectErr string
+}{{
+	about:  "empty string",
+	input:  "",
+	expect: "",
+}, {
+	about:  "standard encoding, padded",
+	input:  "Z29+IH4=",
+	expect: "go~ ~",
+}, {
+	about:  "URL-safe encoding, padded",
+	input:  "Z29-IH4=",
+	expect: "go~ ~",
+}, {
+	about:  "standard encoding, unpadded",
+	input:  "Z29+IH4",
+	expect: "go~ ~",
+}, {
+	about:  "URL-safe encoding, unpadded",
+	input:  "Z29-IH4",
+	expect: "go~ ~",
+}, {
+	about:     "mixed alphabets",
+	input:     "Z29+IH4-",
+	expectErr: `illegal base64 data at input byte 3`,
+}, {
+	about:     "bad length",
+	input:     "Z",
+	expectErr: `illegal base64 data at input byte [0-9]+`,
+}}
+
+func (*macaroonSuite) TestBase64Decode(c *gc.C) {
+	for i, test := range base64DecodeTests {
+		c.Logf("test %d: %s", i, test.about)
+		data, err := macaroon.Base64Decode(test.input)
+		if test.expectErr != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectErr)
+			continue
+		}
+		c.Assert(err, gc.IsNil)
+		c.Assert(string(data), gc.Equals, test.expect)
+	}
+}
+
+func (*macaroonSuite) TestBinaryIds(c *gc.C) {
+	rootKey := []byte("secret")
+	id := []byte("\xff\x00binary id")
+	m, err := macaroon.NewWithParams(macaroon.NewParams{
+		RootKey: rootKey,
+		Id:      id,
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(m.IdBytes(), gc.DeepEquals, id)
+	c.Assert(m.Id(), gc.Equals, string(id))
+
+	// Check that IdBytes returns a copy.
+	m.IdBytes()[0] = 'x'
+	c.Assert(m.IdBytes(), gc.DeepEquals, id)
+
+	firstPartyId := []byte("\xfe first party")
+	err = m.AddFirstPartyCaveatBytes(firstPartyId)
+	c.Assert(err, gc.IsNil)
+	thirdPartyId := []byte("\xfd third party")
+	err = m.AddThirdPartyCaveatBytes([]byte("shared root key"), thirdPartyId, "remote.com")
+	c.Assert(err, gc.IsNil)
+	caveats := m.Caveats()
+	c.Assert(caveats, gc.HasLen, 2)
+	c.Assert(caveats[0].IdBytes(), gc.DeepEquals, firstPartyId)
+	c.Assert(caveats[1].IdBytes(), gc.DeepEquals, thirdPartyId)
+
+	dm, err := macaroon.NewWithParams(macaroon.NewParams{
+		RootKey: []byte("shared root key"),
+		Id:      thirdPartyId,
+	})
+	c.Assert(err, gc.IsNil)
+	dm.Bind(m.Signature())
+	check := func(cond string) error {
+		if cond != string(firstPartyId) {
+			return fmt.Errorf("unexpected condition %q", cond)
+		}
+		return nil
+	}
+	err = m.Verify(rootKey, check, []*macaroon.Macaroon{dm})
+	c.Assert(err, gc.IsNil)
+}
+
+func (*macaroonSuite) TestJSONBinaryIds(c *gc.C) {
+	m := MustNew([]byte("secret"), "\xff\x00id", "loc")
+	err := m.AddFirstPartyCaveat("text caveat")
+	c.Assert(err, gc.IsNil)
+	err = m.AddFirstPartyCaveat("\xfe binary caveat")
+	c.Assert(err, gc.IsNil)
+	data, err := json.Marshal(m)
+	c.Assert(err, gc.IsNil)
+
+	var fields map[string]interface{}
+	err = json.Unmarshal(data, &fields)
+	c.Assert(err, gc.IsNil)
+	c.Assert(fields["identifier"], gc.IsNil)
+	c.Assert(fields["identifier64"], gc.Equals, base64.StdEncoding.EncodeToString([]byte("\xff\x00id")))
+	c.Assert(fields["caveats"], gc.DeepEquals, []interface{}{
+		map[string]interface{}{
+			"cid": "text caveat",
+		},
+		map[string]interface{}{
+			"cid64": base64.StdEncoding.EncodeToString([]byte("\xfe binary caveat")),
+		},
+	})
+
+	var m1 macaroon.Macaroon
+	err = json.Unmarshal(data, &m1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(m1.Id(), gc.Equals, m.Id())
+	c.Assert(m1.Caveats(), gc.DeepEquals, m.Caveats())
+	c.Assert(m1.Signature(), gc.DeepEquals, m.Signature())
+}
+
+var unmarshalJSONBinaryIdErrorTests = []struct {
+	about     string
+	json      string
+	expectErr string
+}{{
+	about:     "both identifier fields",
+	json:      `{"identifier": "a", "identifier64": "YQ", "signature": ""}`,
+	expectErr: `both identifier and identifier64 fields found`,
+}, {
+	about:     "both cid fields",
+	json:      `{"identifier": "a", "signature": "", "caveats": [{"cid": "a", "cid64": "YQ"}]}`,
+	expectErr: `both cid and cid64 fields found`,
+}, {
+	about:     "bad base64 identifier",
+	json:      `{"identifier64": "!", "signature": ""}`,
+	expectErr: `cannot decode base64 identifier64 field: illegal base64 data at input byte 0`,
+}, {
+	about:     "bad base64 cid",
+	json:      `{"identifier": "a", "signature": "", "caveats": [{"cid64": "!"}]}`,
+	expectErr: `cannot decode base64 cid64 field: illegal base64 data at input byte 0`,
+}}
+
+func (*macaroonSuite) TestUnmarshalJSONBinaryIdError(c *gc.C) {
+	for i, test := range unmarshalJSONBinaryIdErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		var m macaroon.Macaroon
+		err := json.Unmarshal([]byte(test.json), &m)
+		c.Assert(err, gc.ErrorMatches, test.expectErr)
+	}
+}
+
+// libmacaroonsThirdPartyJSONV2 holds the same macaroon as
+// libmacaroonsThirdPartyJSON in the libmacaroons v2 JSON format.
+const libmacaroonsThirdPartyJSONV2 = `{"c":[{"i":"account = 3735928559"},{"i":"this was how we remind auth of key/pred","v64":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA027FAuBYhtHwJ58FX6UlVNFtFsGxQHS7uD_w_dedwv4Jjw7UorCREw5rXbRqIKhr","l":"http://auth.mybank/"}],"l":"http://mybank/","i":"we used our other secret key","s64":"0n2y_R8idg5MPa6BN-LY_B32wHQcGK7UuXJWv3jR9Vw"}`
+
+func (*macaroonSuite) TestJSONFormatV2(c *gc.C) {
+	var m0 macaroon.Macaroon
+	err := json.Unmarshal([]byte(libmacaroonsThirdPartyJSON), &m0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(m0.JSONFormat(), gc.Equals, macaroon.JSONFormatV1)
+	v1Data, err := json.Marshal(&m0)
+	c.Assert(err, gc.IsNil)
+
+	m0.SetJSONFormat(macaroon.JSONFormatV2)
+	data, err := json.Marshal(&m0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, libmacaroonsThirdPartyJSONV2)
+
+	var m1 macaroon.Macaroon
+	err = json.Unmarshal([]byte(libmacaroonsThirdPartyJSONV2), &m1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(m1.JSONFormat(), gc.Equals, macaroon.JSONFormatV2)
+	c.Assert(m1.Location(), gc.Equals, m0.Location())
+	c.Assert(m1.Id(), gc.Equals, m0.Id())
+	c.Assert(m1.Caveats(), gc.DeepEquals, m0.Caveats())
+	c.Assert(m1.Signature(), gc.DeepEquals, m0.Signature())
+
+	// The macaroon is marshaled in the format it was
+	// unmarshaled from.
+	data, err = json.Marshal(&m1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, libmacaroonsThirdPartyJSONV2)
+
+	m1.SetJSONFormat(macaroon.JSONFormatV1)
+	data, err = json.Marshal(&m1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, string(v1Data))
+}
+
+func (*macaroonSuite) TestJSONFormatV2BinaryFields(c *gc.C) {
+	m := MustNew([]byte("secret"), "\xff\x00id", "")
+	err := m.AddFirstPartyCaveat("\xfe binary caveat")
+	c.Assert(err, gc.IsNil)
+	m.SetJSONFormat(macaroon.JSONFormatV2)
+	data, err := json.Marshal(m)
+	c.Assert(err, gc.IsNil)
+
+	var fields map[string]interface{}
+	err = json.Unmarshal(data, &fields)
+	c.Assert(err, gc.IsNil)
+	c.Assert(fields, gc.DeepEquals, map[string]interface{}{
+		"i64": base64.RawURLEncoding.EncodeToString([]byte("\xff\x00id")),
+		"c": []interface{}{
+			map[string]interface{}{
+				"i64": base64.RawURLEncoding.EncodeToString([]byte("\xfe binary caveat")),
+			},
+		},
+		"s64": base64.RawURLEncoding.EncodeToString(m.Signature()),
+	})
+
+	var m1 macaroon.Macaroon
+	err = json.Unmarshal(data, &m1)
+	c.Assert(err, gc.IsNil)
+	assertEqualMacaroons(c, m, &m1)
+}
+
+func (*macaroonSuite) TestJSONFormatString(c *gc.C) {
+	c.Assert(macaroon.JSONFormatV1.String(), gc.Equals, "v1")
+	c.Assert(macaroon.JSONFormatV2.String(), gc.Equals, "v2")
+	c.Assert(macaroon.JSONFormat(5).String(), gc.Equals, "JSONFormat(5)")
+}
+
+var unmarshalJSONV2ErrorTests = []struct {
+	about     string
+	json      string
+	expectErr string
+}{{
+	about:     "both identifier fields",
+	json:      `{"i": "a", "i64": "YQ", "s64": ""}`,
+	expectErr: `both i and i64 fields found`,
+}, {
+	about:     "both signature fields",
+	json:      `{"i": "a", "s": "a", "s64": "YQ"}`,
+	expectErr: `both s and s64 fields found`,
+}, {
+	about:     "bad base64 signature",
+	json:      `{"i": "a", "s64": "!"}`,
+	expectErr: `cannot decode base64 s64 field: illegal base64 data at input byte 0`,
+}, {
+	about:     "bad base64 verification id",
+	json:      `{"i": "a", "s64": "YQ", "c": [{"i": "a", "v64": "!"}]}`,
+	expectErr: `cannot decode base64 v64 field: illegal base64 data at input byte 0`,
+}}
+
+func (*macaroonSuite) TestUnmarshalJSONV2Error(c *gc.C) {
+	for i, test := range unmarshalJSONV2ErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		var m macaroon.Macaroon
+		err := json.Unmarshal([]byte(test.json), &m)
+		c.Assert(err, gc.ErrorMatches, test.expectErr)
+	}
+}
+
+func (*macaroonSuite) TestConfidentialCaveat(c *gc.C) {
+	for _, scheme := range allSchemes {
+		c.Logf("scheme %v", scheme)
+		rootKey := []byte("secret")
+		m, err := macaroon.NewWithScheme(rootKey, "some id", "a location", scheme)
+		c.Assert(err, gc.IsNil)
+		err = m.AddConfidentialCaveat(rootKey, "user alice")
+		c.Assert(err, gc.IsNil)
+		err = m.AddThirdPartyCaveat([]byte("caveat key"), "3rd party caveat", "elsewhere")
+		c.Assert(err, gc.IsNil)
+
+		// The caveat in the discharge macaroon is encrypted
+		// with the caveat's root key.
+		dm, err := macaroon.NewWithScheme([]byte("caveat key"), "3rd party caveat", "elsewhere", scheme)
+		c.Assert(err, gc.IsNil)
+		err = dm.AddConfidentialCaveat([]byte("caveat key"), "account 1234")
+		c.Assert(err, gc.IsNil)
+		dm.Bind(m.Signature())
+
+		cavs := m.Caveats()
+		c.Assert(cavs[0].IsConfidential(), gc.Equals, true)
+		c.Assert(cavs[0].Id, gc.Not(gc.Matches), ".*alice.*")
+		c.Assert(cavs[1].IsConfidential(), gc.Equals, false)
+		c.Assert(dm.Caveats()[0].IsConfidential(), gc.Equals, true)
+
+		var checked []string
+		err = m.Verify(rootKey, func(cond string) error {
+			checked = append(checked, cond)
+			return nil
+		}, []*macaroon.Macaroon{dm})
+		c.Assert(err, gc.IsNil)
+		c.Assert(checked, gc.DeepEquals, []string{"user alice", "account 1234"})
+
+		conds, err := m.VerifySignature(rootKey, []*macaroon.Macaroon{dm})
+		c.Assert(err, gc.IsNil)
+		c.Assert(conds, gc.DeepEquals, []string{"user alice", "account 1234"})
+
+		// The decrypted condition is reported when the
+		// check fails.
+		err = m.Verify(rootKey, rejectCondition("account 1234"), []*macaroon.Macaroon{dm})
+		c.Assert(err, gc.ErrorMatches, `account 1234 rejected`)
+		verr := err.(*macaroon.VerificationError)
+		c.Assert(verr.Kind, gc.Equals, macaroon.CheckFailed)
+		c.Assert(verr.Condition, gc.Equals, "account 1234")
+	}
+}
+
+func (*macaroonSuite) TestConfidentialCaveatWrongKey(c *gc.C) {
+	rootKey := []byte("secret")
+	m := MustNew(rootKey, "some id", "a location")
+	err := m.AddConfidentialCaveat([]byte("other key"), "user alice")
+	c.Assert(err, gc.IsNil)
+	err = m.Verify(rootKey, alwaysOK, nil)
+	c.Assert(err, gc.ErrorMatches, `cannot decrypt confidential caveat 0: decryption failure`)
+	c.Assert(err.(*macaroon.VerificationError).Kind, gc.Equals, macaroon.BadSignature)
+}
+
+func (*macaroonSuite) TestFirstPartyCaveatWithReservedPrefix(c *gc.C) {
+	m := MustNew([]byte("secret"), "some id", "a location")
+	sig := m.Signature()
+	err := m.AddFirstPartyCaveatBytes([]byte("\x00 not confidential"))
+	c.Assert(err, gc.ErrorMatches, `first party caveat id must not start with a zero byte`)
+	err = m.AddFirstPartyCaveat("\x00 not confidential")
+	c.Assert(err, gc.ErrorMatches, `first party caveat id must not start with a zero byte`)
+	c.Assert(m.Caveats(), gc.HasLen, 0)
+	c.Assert(m.Signature(), gc.DeepEquals, sig)
+
+	// Other binary ids are allowed and are not
+	// mistaken for confidential caveats.
+	err = m.AddFirstPartyCaveatBytes([]byte("\x01\x00 binary"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(m.Caveats()[0].IsConfidential(), gc.Equals, false)
+	err = m.Verify([]byte("secret"), alwaysOK, nil)
+	c.Assert(err, gc.IsNil)
+}
+
+func (*macaroonSuite) TestConfidentialCaveatSerialization(c *gc.C) {
+	rootKey := []byte("secret")
+	m0 := MustNew(rootKey, "some id", "a location")
+	err := m0.AddConfidentialCaveatWithRand(rootKey, []byte("user alice"), zeroReader{})
+	c.Assert(err, gc.IsNil)
+	data, err := m0.MarshalBinary()
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Not(gc.Matches), "(?s).*alice.*")
+
+	var m1 macaroon.Macaroon
+	err = m1.UnmarshalBinary(data)
+	c.Assert(err, gc.IsNil)
+	err = m1.Verify(rootKey, func(cond string) error {
+		if cond != "user alice" {
+			return fmt.Errorf("unexpected condition %q", cond)
+		}
+		return nil
+	}, nil)
+	c.Assert(err, gc.IsNil)
+
+	// The same random bytes produce the same macaroon.
+	m2 := MustNew(rootKey, "some id", "a location")
+	err = m2.AddConfidentialCaveatWithRand(rootKey, []byte("user alice"), zeroReader{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(m2.Signature(), gc.DeepEquals, m0.Signature())
+}
@@ -5,6 +5,8 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"unicode/utf8"
 )
 
 // field names, as defined in libmacaroons
@@ -27,81 +29,343 @@ var (
 )
 
 // macaroonJSON defines the JSON format for macaroons.
+// Identifiers that are not valid UTF-8 are held
+// base64-encoded in the fields with a "64" suffix.
 type macaroonJSON struct {
-	Caveats    []caveatJSON `json:"caveats"`
-	Location   string       `json:"location"`
-	Identifier string       `json:"identifier"`
-	Signature  string       `json:"signature"` // hex-encoded
+	Caveats      []caveatJSON `json:"caveats"`
+	Location     string       `json:"location"`
+	Identifier   string       `json:"identifier,omitempty"`
+	Identifier64 string       `json:"identifier64,omitempty"`
+	Signature    string       `json:"signature"` // hex-encoded
 }
 
 // caveatJSON defines the JSON format for caveats within a macaroon.
 type caveatJSON struct {
-	CID      string `json:"cid"`
+	CID      string `json:"cid,omitempty"`
+	CID64    string `json:"cid64,omitempty"`
 	VID      string `json:"vid,omitempty"`
 	Location string `json:"cl,omitempty"`
 }
 
-// MarshalJSON implements json.Marshaler.
+// macaroonJSONV2 defines the compact JSON format for
+// macaroons used by libmacaroons and other macaroon
+// implementations. Fields that are not valid UTF-8 are
+// held base64-encoded in the fields with a "64" suffix.
+type macaroonJSONV2 struct {
+	Caveats      []caveatJSONV2 `json:"c,omitempty"`
+	Location     string         `json:"l,omitempty"`
+	Identifier   string         `json:"i,omitempty"`
+	Identifier64 string         `json:"i64,omitempty"`
+	Signature    string         `json:"s,omitempty"`
+	Signature64  string         `json:"s64,omitempty"`
+}
+
+// caveatJSONV2 defines the compact JSON format for caveats
+// within a macaroon.
+type caveatJSONV2 struct {
+	CID      string `json:"i,omitempty"`
+	CID64    string `json:"i64,omitempty"`
+	VID      string `json:"v,omitempty"`
+	VID64    string `json:"v64,omitempty"`
+	Location string `json:"l,omitempty"`
+}
+
+// anyMacaroonJSON holds the fields of both JSON formats
+// so that either may be unmarshaled.
+type anyMacaroonJSON struct {
+	macaroonJSON
+	macaroonJSONV2
+}
+
+// JSONFormat specifies the format used to marshal a
+// macaroon as JSON.
+type JSONFormat int
+
+const (
+	// JSONFormatV1 is the original JSON format used by this
+	// package, with long field names and a hex-encoded
+	// signature.
+	JSONFormatV1 JSONFormat = iota
+
+	// JSONFormatV2 is the compact JSON format used by
+	// libmacaroons and by the JavaScript and Python macaroon
+	// libraries. Binary fields are encoded as URL-safe
+	// base64 with no padding.
+	JSONFormatV2
+)
+
+var jsonFormatNames = []string{
+	JSONFormatV1: "v1",
+	JSONFormatV2: "v2",
+}
+
+// String implements fmt.Stringer.
+func (f JSONFormat) String() string {
+	if f >= 0 && int(f) < len(jsonFormatNames) {
+		return jsonFormatNames[f]
+	}
+	return fmt.Sprintf("JSONFormat(%d)", int(f))
+}
+
+// MarshalJSON implements json.Marshaler. The format
+// of the JSON is specified by m.JSONFormat.
 func (m *Macaroon) MarshalJSON() ([]byte, error) {
-	mjson := macaroonJSON{
-		Location:   m.Location(),
-		Identifier: m.dataStr(m.id),
-		Signature:  hex.EncodeToString(m.sig),
-		Caveats:    make([]caveatJSON, len(m.caveats)),
+	var mjson interface{}
+	switch m.jsonFormat {
+	case JSONFormatV1:
+		mjson = m.jsonV1()
+	case JSONFormatV2:
+		mjson = m.jsonV2()
+	default:
+		return nil, fmt.Errorf("unknown JSON format %v", m.jsonFormat)
+	}
+	data, err := json.Marshal(mjson)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal json data: %v", err)
 	}
+	return data, nil
+}
+
+// jsonV1 returns m in the JSONFormatV1 format.
+func (m *Macaroon) jsonV1() *macaroonJSON {
+	mjson := &macaroonJSON{
+		Location:  m.Location(),
+		Signature: hex.EncodeToString(m.sig),
+		Caveats:   make([]caveatJSON, len(m.caveats)),
+	}
+	mjson.Identifier, mjson.Identifier64 = jsonBytes(m.dataBytes(m.id))
 	for i, cav := range m.caveats {
-		mjson.Caveats[i] = caveatJSON{
+		cavJSON := caveatJSON{
 			Location: m.dataStr(cav.location),
-			CID:      m.dataStr(cav.caveatId),
 			VID:      base64.StdEncoding.EncodeToString(m.dataBytes(cav.verificationId)),
 		}
+		cavJSON.CID, cavJSON.CID64 = jsonBytes(m.dataBytes(cav.caveatId))
+		mjson.Caveats[i] = cavJSON
 	}
-	data, err := json.Marshal(mjson)
+	return mjson
+}
+
+// jsonV2 returns m in the JSONFormatV2 format.
+func (m *Macaroon) jsonV2() *macaroonJSONV2 {
+	mjson := &macaroonJSONV2{
+		Location:    m.Location(),
+		Signature64: base64URLEncode(m.sig),
+	}
+	mjson.Identifier, mjson.Identifier64 = jsonBytesV2(m.dataBytes(m.id))
+	if len(m.caveats) > 0 {
+		mjson.Caveats = make([]caveatJSONV2, len(m.caveats))
+	}
+	for i, cav := range m.caveats {
+		cavJSON := caveatJSONV2{
+			Location: m.dataStr(cav.location),
+		}
+		if vid := m.dataBytes(cav.verificationId); len(vid) > 0 {
+			cavJSON.VID64 = base64URLEncode(vid)
+		}
+		cavJSON.CID, cavJSON.CID64 = jsonBytesV2(m.dataBytes(cav.caveatId))
+		mjson.Caveats[i] = cavJSON
+	}
+	return mjson
+}
+
+// jsonBytes returns the JSON representation of a field
+// holding the given data. If the data is valid UTF-8, it's
+// returned as str; otherwise it's returned base64-encoded
+// as str64.
+func jsonBytes(data []byte) (str, str64 string) {
+	if utf8.Valid(data) {
+		return string(data), ""
+	}
+	return "", base64.StdEncoding.EncodeToString(data)
+}
+
+// jsonBytesV2 is like jsonBytes except that it
+// uses URL-safe base64 with no padding, as
+// JSONFormatV2 requires.
+func jsonBytesV2(data []byte) (str, str64 string) {
+	if utf8.Valid(data) {
+		return string(data), ""
+	}
+	return "", base64URLEncode(data)
+}
+
+// jsonBytesField returns the data held in a JSON field
+// represented by str and its base64-encoded equivalent str64.
+// The name parameter holds the name of the field.
+func jsonBytesField(name, str, str64 string) ([]byte, error) {
+	if str64 == "" {
+		return []byte(str), nil
+	}
+	if str != "" {
+		return nil, fmt.Errorf("both %s and %s64 fields found", name, name)
+	}
+	data, err := Base64Decode(str64)
 	if err != nil {
-		return nil, fmt.Errorf("cannot marshal json data: %v", err)
+		return nil, fmt.Errorf("cannot decode base64 %s64 field: %v", name, err)
 	}
 	return data, nil
 }
 
-// UnmarshalJSON implements json.Unmarshaler.
+// UnmarshalJSON implements json.Unmarshaler. It accepts
+// both JSONFormatV1 and JSONFormatV2, and sets the
+// JSON format of m to the one found.
+//
+// The resulting macaroon has version V1 unless
+// some of its fields are too big for that format,
+// in which case it has version V2.
 func (m *Macaroon) UnmarshalJSON(jsonData []byte) error {
-	var mjson macaroonJSON
+	var mjson anyMacaroonJSON
 	err := json.Unmarshal(jsonData, &mjson)
 	if err != nil {
 		return fmt.Errorf("cannot unmarshal json data: %v", err)
 	}
-	if err := m.init(mjson.Identifier, mjson.Location); err != nil {
+	initJSON := m.initJSON
+	format := JSONFormatV1
+	if mjson.isV2() {
+		initJSON = m.initJSONV2
+		format = JSONFormatV2
+	}
+	if err := initJSON(&mjson, V1); err != nil {
+		if err1 := initJSON(&mjson, V2); err1 != nil {
+			return err
+		}
+	}
+	m.jsonFormat = format
+	m.hasEncodedScheme = false
+	return nil
+}
+
+// isV2 reports whether mjson holds a macaroon
+// in JSONFormatV2. A macaroon is in that format when
+// it has an identifier or signature in that format and
+// none in JSONFormatV1.
+func (mjson *anyMacaroonJSON) isV2() bool {
+	v1 := mjson.macaroonJSON
+	v2 := mjson.macaroonJSONV2
+	if v1.Identifier != "" || v1.Identifier64 != "" || v1.Signature != "" {
+		return false
+	}
+	return v2.Identifier != "" || v2.Identifier64 != "" || v2.Signature != "" || v2.Signature64 != ""
+}
+
+// initJSONV2 initializes m from the given JSONFormatV2 data,
+// using the given binary format version.
+func (m *Macaroon) initJSONV2(mjson *anyMacaroonJSON, version Version) error {
+	v2 := &mjson.macaroonJSONV2
+	m.version = version
+	id, err := jsonBytesField("i", v2.Identifier, v2.Identifier64)
+	if err != nil {
+		return err
+	}
+	if err := m.init(id, v2.Location); err != nil {
+		return err
+	}
+	m.sig, err = jsonBytesField("s", v2.Signature, v2.Signature64)
+	if err != nil {
+		return err
+	}
+	for _, cav := range v2.Caveats {
+		cid, err := jsonBytesField("i", cav.CID, cav.CID64)
+		if err != nil {
+			return err
+		}
+		vid, err := jsonBytesField("v", cav.VID, cav.VID64)
+		if err != nil {
+			return err
+		}
+		if _, err := m.appendCaveat(cid, vid, cav.Location); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// initJSON initializes m from the given JSON data,
+// using the given binary format version.
+func (m *Macaroon) initJSON(anyJSON *anyMacaroonJSON, version Version) error {
+	mjson := &anyJSON.macaroonJSON
+	m.version = version
+	id, err := jsonBytesField(fieldIdentifier, mjson.Identifier, mjson.Identifier64)
+	if err != nil {
+		return err
+	}
+	if err := m.init(id, mjson.Location); err != nil {
 		return err
 	}
 	m.sig, err = hex.DecodeString(mjson.Signature)
 	if err != nil {
-		return fmt.Errorf("cannot decode macaroon signature %q: %v", m.sig, err)
+		return fmt.Errorf("cannot decode macaroon signature %q: %v", mjson.Signature, err)
 	}
-	m.caveats = m.caveats[:0]
 	for _, cav := range mjson.Caveats {
+		cid, err := jsonBytesField(fieldCaveatId, cav.CID, cav.CID64)
+		if err != nil {
+			return err
+		}
 		vid, err := base64.StdEncoding.DecodeString(cav.VID)
 		if err != nil {
 			return fmt.Errorf("cannot decode verification id %q: %v", cav.VID, err)
 		}
-		if _, err := m.appendCaveat(cav.CID, vid, cav.Location); err != nil {
+		if _, err := m.appendCaveat(cid, vid, cav.Location); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// Version specifies the binary format used to marshal a macaroon.
+// The JSON format is independent of the version - see JSONFormat.
+type Version uint16
+
+const (
+	// V1 is the original binary format, as used by libmacaroons.
+	// Each packet, including its header, may be at most
+	// 0xffff bytes long.
+	V1 Version = iota
+
+	// V2 is a more compact binary format in which fields
+	// are identified by a type byte and sized with a varint,
+	// so there is no practical limit on their size.
+	V2
+)
+
+var versionNames = []string{
+	V1: "v1",
+	V2: "v2",
+}
+
+// String implements fmt.Stringer.
+func (v Version) String() string {
+	if v.valid() {
+		return versionNames[v]
+	}
+	return fmt.Sprintf("v?(%d)", uint16(v))
+}
+
+// valid reports whether v is a known version.
+func (v Version) valid() bool {
+	return int(v) < len(versionNames)
+}
+
 // MarshalBinary implements encoding.BinaryMarshaler.
+// The data is encoded in the format specified by
+// the macaroon's version.
 func (m *Macaroon) MarshalBinary() ([]byte, error) {
-	data := make([]byte, len(m.data), len(m.data)+len(m.sig))
+	data := make([]byte, len(m.data), len(m.data)+len(m.sig)+16)
 	copy(data, m.data)
-	data, _, ok := rawAppendPacket(data, fieldSignature, m.sig)
+	var ok bool
+	if m.version == V2 {
+		data = append(data, fieldTypeEOS)
+		data, _, ok = rawAppendPacketV2(data, fieldTypeSignature, m.sig)
+	} else {
+		data, _, ok = rawAppendPacket(data, fieldSignature, m.sig)
+	}
 	if !ok {
 		panic("cannot append signature")
 	}
 	return data, nil
 }
 
-// The binary format of a macaroon is as follows.
+// The version 1 binary format of a macaroon is as follows.
 // Each identifier repesents a packet.
 //
 // location
@@ -112,27 +376,63 @@ func (m *Macaroon) MarshalBinary() ([]byte, error) {
 //	caveatLocation?
 // )*
 // signature
+//
+// See packetv2.go for a description of the version 2 format.
 
 // UnmarshalBinary implements encoding.BinaryUnmarshaler.
+// It accepts data in any of the binary format versions,
+// and sets the macaroon's version accordingly.
 func (m *Macaroon) UnmarshalBinary(data []byte) error {
-	m.data = append([]byte(nil), data...)
+	_, err := m.parseBinary(data)
+	return err
+}
+
+// parseBinary initializes m from the binary-encoded macaroon
+// at the start of data and returns the data that follows it.
+// The macaroon does not retain any reference to data.
+func (m *Macaroon) parseBinary(data []byte) ([]byte, error) {
+	m.data = data
+	m.caveats = nil
+	m.location = packet{}
+	m.hasEncodedScheme = false
+	var n int
+	var err error
+	if len(data) > 0 && data[0] == v2Marker {
+		m.version = V2
+		n, err = m.unmarshalBinaryV2()
+	} else {
+		m.version = V1
+		n, err = m.unmarshalBinaryV1()
+	}
+	if err != nil {
+		m.data = nil
+		return nil, err
+	}
+	// Copy the data so that adding caveats to m cannot
+	// overwrite anything that follows it.
+	m.data = append([]byte(nil), m.data...)
+	return data[n:], nil
+}
 
+// unmarshalBinaryV1 parses the version 1 encoded macaroon
+// in m.data and returns the length of its encoding.
+func (m *Macaroon) unmarshalBinaryV1() (int, error) {
 	var err error
 	var start int
 
 	start, m.location, err = m.expectPacket(0, fieldLocation)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	start, m.id, err = m.expectPacket(start, fieldIdentifier)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	var cav caveat
 	for {
 		p, err := m.parsePacket(start)
 		if err != nil {
-			return err
+			return 0, err
 		}
 		start += p.len()
 		switch field := string(m.fieldName(p)); field {
@@ -142,29 +442,119 @@ func (m *Macaroon) UnmarshalBinary(data []byte) error {
 				m.caveats = append(m.caveats, cav)
 			}
 			// Remove the signature from data.
-			m.data = m.data[0:p.start]
 			m.sig = append([]byte(nil), m.dataBytes(p)...)
-			return nil
+			m.data = m.data[0:p.start]
+			return start, nil
 		case fieldCaveatId:
 			if cav.caveatId.len() != 0 {
 				m.caveats = append(m.caveats, cav)
 			}
-			cav.caveatId = p
+			cav = caveat{
+				caveatId: p,
+			}
 		case fieldVerificationId:
 			if cav.verificationId.len() != 0 {
-				return fmt.Errorf("repeated field %q in caveat", fieldVerificationId)
+				return 0, fmt.Errorf("repeated field %q in caveat", fieldVerificationId)
 			}
 			cav.verificationId = p
 		case fieldCaveatLocation:
 			if cav.location.len() != 0 {
-				return fmt.Errorf("repeated field %q in caveat", fieldLocation)
+				return 0, fmt.Errorf("repeated field %q in caveat", fieldLocation)
 			}
 			cav.location = p
 		default:
-			return fmt.Errorf("unexpected field %q", field)
+			return 0, fmt.Errorf("unexpected field %q", field)
 		}
 	}
-	return nil
+}
+
+// unmarshalBinaryV2 parses the version 2 encoded macaroon
+// in m.data and returns the length of its encoding.
+func (m *Macaroon) unmarshalBinaryV2() (int, error) {
+	start, section, err := m.parseSectionV2(1)
+	if err != nil {
+		return 0, err
+	}
+	if len(section) > 0 && section[0].fieldType == fieldTypeLocation {
+		m.location = section[0].packet
+		section = section[1:]
+	}
+	if len(section) != 1 || section[0].fieldType != fieldTypeIdentifier {
+		return 0, fmt.Errorf("invalid macaroon header")
+	}
+	m.id = section[0].packet
+	var end int
+	for {
+		end = start
+		start, section, err = m.parseSectionV2(start)
+		if err != nil {
+			return 0, err
+		}
+		if len(section) == 0 {
+			// An empty section marks the end of the caveats.
+			break
+		}
+		var cav caveat
+		if section[0].fieldType == fieldTypeLocation {
+			cav.location = section[0].packet
+			section = section[1:]
+		}
+		if len(section) == 0 || section[0].fieldType != fieldTypeIdentifier {
+			return 0, fmt.Errorf("no identifier in caveat")
+		}
+		cav.caveatId = section[0].packet
+		section = section[1:]
+		if len(section) > 0 && section[0].fieldType == fieldTypeVerificationId {
+			cav.verificationId = section[0].packet
+			section = section[1:]
+		}
+		if len(section) > 0 {
+			return 0, fmt.Errorf("unexpected field type %d in caveat", section[0].fieldType)
+		}
+		m.caveats = append(m.caveats, cav)
+	}
+	p, ftype, err := m.parsePacketV2(start)
+	if err != nil {
+		return 0, err
+	}
+	if ftype != fieldTypeSignature {
+		return 0, fmt.Errorf("unexpected field type %d; expected signature", ftype)
+	}
+	m.sig = append([]byte(nil), m.dataBytes(p)...)
+	// Remove the final empty section and the signature from data.
+	m.data = m.data[0:end]
+	return start + p.len(), nil
+}
+
+// typedPacket holds a version 2 packet along with its field type.
+type typedPacket struct {
+	packet
+	fieldType int
+}
+
+// parseSectionV2 parses the version 2 section starting at the
+// given index into m.data. It returns the index of the start
+// of the next section and the packets in the section, not
+// including the end-of-section marker.
+func (m *Macaroon) parseSectionV2(start int) (int, []typedPacket, error) {
+	var section []typedPacket
+	for {
+		if start >= len(m.data) {
+			return 0, nil, fmt.Errorf("section extends past end of data")
+		}
+		p, ftype, err := m.parsePacketV2(start)
+		if err != nil {
+			return 0, nil, err
+		}
+		start += p.len()
+		if ftype == fieldTypeEOS {
+			return start, section, nil
+		}
+		if len(section) > 0 && ftype <= section[len(section)-1].fieldType {
+			return 0, nil, fmt.Errorf("fields out of order")
+		}
+		section = append(section, typedPacket{p, ftype})
+	}
 }
 
 func (m *Macaroon) expectPacket(start int, kind string) (int, packet, error) {
@@ -177,3 +567,66 @@ func (m *Macaroon) expectPacket(start int, kind string) (int, packet, error) {
 	}
 	return start + p.len(), p, nil
 }
+
+// Serialize returns m encoded in the form commonly used to exchange
+// macaroons between tools: the binary encoding of the macaroon,
+// encoded as URL-safe base64 with no padding.
+func Serialize(m *Macaroon) (string, error) {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return base64URLEncode(data), nil
+}
+
+// Deserialize decodes a macaroon from s. It accepts the
+// JSON or binary encoding of a macaroon, encoded as standard
+// or URL-safe base64 with or without padding. For convenience,
+// unencoded JSON is also accepted.
+func Deserialize(s string) (*Macaroon, error) {
+	s = strings.TrimSpace(s)
+	var m Macaroon
+	if strings.HasPrefix(s, "{") {
+		if err := m.UnmarshalJSON([]byte(s)); err != nil {
+			return nil, err
+		}
+		return &m, nil
+	}
+	data, err := Base64Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("cannot base64-decode macaroon: %v", err)
+	}
+	if err := m.unmarshalJSONOrBinary(data); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// unmarshalJSONOrBinary unmarshals m from data, which may
+// hold the JSON or binary encoding of a macaroon.
+func (m *Macaroon) unmarshalJSONOrBinary(data []byte) error {
+	if len(data) > 0 && data[0] == '{' {
+		return m.UnmarshalJSON(data)
+	}
+	return m.UnmarshalBinary(data)
+}
+
+// Base64Decode decodes s as base64, accepting both the standard and
+// URL-safe alphabets, with or without padding.
+func Base64Decode(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	enc := base64.StdEncoding
+	if strings.ContainsAny(s, "-_") {
+		enc = base64.URLEncoding
+	}
+	if n := len(s) % 4; n != 0 {
+		s += "==="[0 : 4-n]
+	}
+	return enc.DecodeString(s)
+}
+
+// base64URLEncode returns data encoded as URL-safe
+// base64 with no padding.
+func base64URLEncode(data []byte) string {
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(data), "=")
+}
@@ -24,7 +24,7 @@ import (
 // The packet struct below holds a reference into Macaroon.data.
 type packet struct {
 	start     int32
-	totalLen  uint16
+	totalLen  int32
 	headerLen uint16
 }
 
@@ -34,7 +34,7 @@ func (p packet) len() int {
 
 // dataBytes returns the data payload of the packet.
 func (m *Macaroon) dataBytes(p packet) []byte {
-	return m.data[p.start+int32(p.headerLen) : p.start+int32(p.totalLen)]
+	return m.data[p.start+int32(p.headerLen) : p.start+p.totalLen]
 }
 
 func (m *Macaroon) dataStr(p packet) string {
@@ -43,10 +43,11 @@ func (m *Macaroon) dataStr(p packet) string {
 
 // packetBytes returns the entire packet.
 func (m *Macaroon) packetBytes(p packet) []byte {
-	return m.data[p.start : p.start+int32(p.totalLen)]
+	return m.data[p.start : p.start+p.totalLen]
 }
 
 // fieldName returns the field name of the packet.
+// It is only valid for version 1 packets.
 func (m *Macaroon) fieldName(p packet) []byte {
 	if p.totalLen == 0 {
 		return nil
@@ -68,6 +69,9 @@ func (m *Macaroon) parsePacket(start int) (packet, error) {
 	if plen > len(data) {
 		return packet{}, fmt.Errorf("packet size too big")
 	}
+	if plen < 4 {
+		return packet{}, fmt.Errorf("packet size too small")
+	}
 	data = data[4:plen]
 	i := bytes.IndexByte(data, ' ')
 	if i <= 0 {
@@ -75,7 +79,7 @@ func (m *Macaroon) parsePacket(start int) (packet, error) {
 	}
 	return packet{
 		start:     int32(start),
-		totalLen:  uint16(plen),
+		totalLen:  int32(plen),
 		headerLen: uint16(4 + i + 1),
 	}, nil
 }
@@ -103,7 +107,7 @@ func rawAppendPacket(buf []byte, field string, data []byte) ([]byte, packet, boo
 	}
 	s := packet{
 		start:     int32(len(buf)),
-		totalLen:  uint16(plen),
+		totalLen:  int32(plen),
 		headerLen: uint16(4 + len(field) + 1),
 	}
 	buf = appendSize(buf, plen)
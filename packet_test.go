@@ -100,6 +100,10 @@ var parsePacketTests = []struct {
 	},
 	expectData:  "some data",
 	expectField: "field",
+}, {
+	data:      "0000000000000000",
+	start:     0,
+	expectErr: "packet size too small",
 }, {
 	data:      "0013fieldwithoutanyspaceordata",
 	start:     0,
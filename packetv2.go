@@ -0,0 +1,122 @@
+package macaroon
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The version 2 binary encoding is also made from a sequence
+// of packets, but each packet is encoded as:
+//
+// - a varint holding the field type.
+//
+// - a varint holding the length of the data (omitted for fieldTypeEOS).
+//
+// - the raw data.
+//
+// The packets are grouped into sections, each of which is
+// terminated by a packet of type fieldTypeEOS. Within a
+// section, fields must appear in increasing order of field type.
+// The encoding of a macaroon is:
+//
+// - a single byte holding the version (2).
+//
+// - a section holding the (optional) location and the identifier.
+//
+// - a section for each caveat holding the (optional) location,
+// the caveat id and the (optional) verification id.
+//
+// - an empty section.
+//
+// - the signature packet.
+//
+// Like version 1 packets, version 2 packets are stored
+// inside Macaroon.data and referred to by packet values.
+
+// v2Marker holds the first byte of a macaroon encoded
+// in the version 2 binary format. It can never start
+// a version 1 packet.
+const v2Marker = 2
+
+// Field types used in the version 2 binary encoding.
+const (
+	fieldTypeEOS            = 0
+	fieldTypeLocation       = 1
+	fieldTypeIdentifier     = 2
+	fieldTypeVerificationId = 4
+	fieldTypeSignature      = 6
+)
+
+// maxPacketLenV2 holds the maximum allowed total length of
+// a version 2 packet. It is limited only by the size of
+// the fields in the packet struct.
+const maxPacketLenV2 = 0x7fffffff
+
+// parsePacketV2 parses the version 2 packet starting at the
+// given index into m.data. It returns the packet and its
+// field type.
+func (m *Macaroon) parsePacketV2(start int) (packet, int, error) {
+	data := m.data[start:]
+	ftype, n := binary.Uvarint(data)
+	if n <= 0 {
+		return packet{}, 0, fmt.Errorf("cannot parse field type")
+	}
+	if ftype == fieldTypeEOS {
+		return packet{
+			start:     int32(start),
+			totalLen:  int32(n),
+			headerLen: uint16(n),
+		}, fieldTypeEOS, nil
+	}
+	size, n1 := binary.Uvarint(data[n:])
+	if n1 <= 0 {
+		return packet{}, 0, fmt.Errorf("cannot parse packet size")
+	}
+	headerLen := n + n1
+	if size > uint64(len(data)-headerLen) || size > maxPacketLenV2-uint64(headerLen) {
+		return packet{}, 0, fmt.Errorf("packet size too big")
+	}
+	return packet{
+		start:     int32(start),
+		totalLen:  int32(headerLen + int(size)),
+		headerLen: uint16(headerLen),
+	}, int(ftype), nil
+}
+
+// appendPacketV2 appends a version 2 packet with the given field
+// type and data to m.data, and returns the packet appended.
+//
+// It returns false (and a zero packet) if the packet was too big.
+func (m *Macaroon) appendPacketV2(ftype int, data []byte) (packet, bool) {
+	mdata, p, ok := rawAppendPacketV2(m.data, ftype, data)
+	if !ok {
+		return p, false
+	}
+	m.data = mdata
+	return p, true
+}
+
+// rawAppendPacketV2 appends a version 2 packet to the given byte slice.
+func rawAppendPacketV2(buf []byte, ftype int, data []byte) ([]byte, packet, bool) {
+	var hdr [2 * binary.MaxVarintLen64]byte
+	headerLen := binary.PutUvarint(hdr[:], uint64(ftype))
+	if ftype != fieldTypeEOS {
+		headerLen += binary.PutUvarint(hdr[headerLen:], uint64(len(data)))
+	}
+	if len(data) > maxPacketLenV2-headerLen {
+		return nil, packet{}, false
+	}
+	p := packet{
+		start:     int32(len(buf)),
+		totalLen:  int32(headerLen + len(data)),
+		headerLen: uint16(headerLen),
+	}
+	buf = append(buf, hdr[:headerLen]...)
+	buf = append(buf, data...)
+	return buf, p, true
+}
+
+// appendEOSV2 appends an end-of-section marker to m.data.
+func (m *Macaroon) appendEOSV2() {
+	m.data = append(m.data, fieldTypeEOS)
+}
@@ -0,0 +1,88 @@
+package macaroon
+
+import (
+	"strings"
+
+	gc "gopkg.in/check.v1"
+)
+
+type packetV2Suite struct{}
+
+var _ = gc.Suite(&packetV2Suite{})
+
+func (*packetV2Suite) TestAppendPacketV2(c *gc.C) {
+	var m Macaroon
+	p, ok := m.appendPacketV2(fieldTypeIdentifier, []byte("some data"))
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(string(m.data), gc.Equals, "\x02\x09some data")
+	c.Assert(p, gc.Equals, packet{
+		start:     0,
+		totalLen:  11,
+		headerLen: 2,
+	})
+	c.Assert(string(m.dataBytes(p)), gc.Equals, "some data")
+
+	m.appendEOSV2()
+	data := strings.Repeat("x", 200)
+	p, ok = m.appendPacketV2(fieldTypeVerificationId, []byte(data))
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(string(m.data), gc.Equals, "\x02\x09some data\x00\x04\xc8\x01"+data)
+	c.Assert(p, gc.Equals, packet{
+		start:     12,
+		totalLen:  203,
+		headerLen: 3,
+	})
+	c.Assert(string(m.dataBytes(p)), gc.Equals, data)
+}
+
+var parsePacketV2Tests = []struct {
+	data       string
+	start      int
+	expect     packet
+	expectType int
+	expectErr  string
+	expectData string
+}{{
+	expectErr: "cannot parse field type",
+}, {
+	data:       "\x02\x09some data",
+	expect:     packet{start: 0, totalLen: 11, headerLen: 2},
+	expectType: fieldTypeIdentifier,
+	expectData: "some data",
+}, {
+	data:       "\x02\x09some data\x00",
+	start:      11,
+	expect:     packet{start: 11, totalLen: 1, headerLen: 1},
+	expectType: fieldTypeEOS,
+}, {
+	data:      "\x02\x0asome data",
+	expectErr: "packet size too big",
+}, {
+	data:      "\x02",
+	expectErr: "cannot parse packet size",
+}, {
+	data:      "\x80",
+	expectErr: "cannot parse field type",
+}, {
+	data:      "\x02\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01",
+	expectErr: "packet size too big",
+}}
+
+func (*packetV2Suite) TestParsePacketV2(c *gc.C) {
+	for i, test := range parsePacketV2Tests {
+		c.Logf("test %d: %q", i, truncate(test.data))
+		m := Macaroon{
+			data: []byte(test.data),
+		}
+		p, ftype, err := m.parsePacketV2(test.start)
+		if test.expectErr != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectErr)
+			c.Assert(p, gc.Equals, packet{})
+			continue
+		}
+		c.Assert(err, gc.IsNil)
+		c.Assert(p, gc.Equals, test.expect)
+		c.Assert(ftype, gc.Equals, test.expectType)
+		c.Assert(string(m.dataBytes(p)), gc.Equals, test.expectData)
+	}
+}
@@ -0,0 +1,132 @@
+package macaroon
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Slice holds a collection of macaroons. By convention, the first
+// macaroon in the slice is the primary macaroon and the rest are
+// discharges for its third party caveats, so a Slice holds
+// everything needed to verify a request.
+//
+// The JSON encoding of a Slice is a JSON array holding
+// the JSON encoding of each macaroon. The binary encoding
+// is the concatenation of the binary encodings of each macaroon.
+type Slice []*Macaroon
+
+// Primary returns the primary macaroon in s, or nil
+// if s is empty.
+func (s Slice) Primary() *Macaroon {
+	if len(s) == 0 {
+		return nil
+	}
+	return s[0]
+}
+
+// Discharges returns the discharge macaroons in s.
+func (s Slice) Discharges() []*Macaroon {
+	if len(s) == 0 {
+		return nil
+	}
+	return s[1:]
+}
+
+// Bind binds all the discharge macaroons in s to
+// the primary macaroon. It should be called exactly
+// once, after all the discharges have been acquired
+// and before s is sent to the target service.
+func (s Slice) Bind() {
+	if len(s) == 0 {
+		return
+	}
+	rootSig := s[0].Signature()
+	for _, m := range s[1:] {
+		m.Bind(rootSig)
+	}
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+// Each macaroon is encoded in the format specified
+// by its version.
+func (s Slice) MarshalBinary() ([]byte, error) {
+	var data []byte
+	for i, m := range s {
+		mdata, err := m.MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf("cannot marshal macaroon %d: %v", i, err)
+		}
+		data = append(data, mdata...)
+	}
+	return data, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+// The macaroons need not all be encoded with the same
+// binary format version.
+func (s *Slice) UnmarshalBinary(data []byte) error {
+	ms := (*s)[:0]
+	for len(data) > 0 {
+		var m Macaroon
+		rest, err := m.parseBinary(data)
+		if err != nil {
+			return fmt.Errorf("cannot unmarshal macaroon %d: %v", len(ms), err)
+		}
+		ms = append(ms, &m)
+		data = rest
+	}
+	*s = ms
+	return nil
+}
+
+// SerializeSlice returns s encoded in the same way as Serialize:
+// the binary encoding of s as URL-safe base64 with no padding.
+func SerializeSlice(s Slice) (string, error) {
+	data, err := s.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return base64URLEncode(data), nil
+}
+
+// DeserializeSlice decodes a slice of macaroons from str. It
+// accepts the same encodings as Deserialize. The encoding
+// of a single macaroon is accepted as a slice of one.
+func DeserializeSlice(str string) (Slice, error) {
+	str = strings.TrimSpace(str)
+	var data []byte
+	if strings.HasPrefix(str, "{") || strings.HasPrefix(str, "[") {
+		data = []byte(str)
+	} else {
+		var err error
+		data, err = Base64Decode(str)
+		if err != nil {
+			return nil, fmt.Errorf("cannot base64-decode macaroons: %v", err)
+		}
+	}
+	if len(data) > 0 && data[0] == '[' {
+		var s Slice
+		if err := json.Unmarshal(data, &s); err != nil {
+			return nil, fmt.Errorf("cannot unmarshal json data: %v", err)
+		}
+		for i, m := range s {
+			if m == nil {
+				return nil, fmt.Errorf("null macaroon at index %d", i)
+			}
+		}
+		return s, nil
+	}
+	if len(data) > 0 && data[0] == '{' {
+		var m Macaroon
+		if err := m.UnmarshalJSON(data); err != nil {
+			return nil, err
+		}
+		return Slice{&m}, nil
+	}
+	var s Slice
+	if err := s.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
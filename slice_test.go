@@ -0,0 +1,169 @@
+package macaroon_test
+
+import (
+	"encoding/json"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/rogpeppe/macaroon"
+)
+
+type sliceSuite struct{}
+
+var _ = gc.Suite(&sliceSuite{})
+
+// newDischargedSlice returns a slice holding a primary macaroon
+// with two third party caveats and the (unbound) discharges for
+// them. The primary macaroon uses the given version and the
+// discharges use the other version.
+func newDischargedSlice(c *gc.C, vers macaroon.Version) (rootKey []byte, s macaroon.Slice) {
+	otherVers := macaroon.V2
+	if vers == macaroon.V2 {
+		otherVers = macaroon.V1
+	}
+	rootKey = []byte("root key")
+	primary, err := macaroon.NewWithParams(macaroon.NewParams{
+		RootKey:  rootKey,
+		Id:       []byte("primary id"),
+		Location: "primary location",
+		Version:  vers,
+	})
+	c.Assert(err, gc.IsNil)
+	err = primary.AddFirstPartyCaveat("first caveat")
+	c.Assert(err, gc.IsNil)
+	s = macaroon.Slice{primary}
+	for _, id := range []string{"bob-is-great", "alice-is-great"} {
+		dischargeRootKey := []byte(id + " key")
+		err = primary.AddThirdPartyCaveat(dischargeRootKey, id, id+" location")
+		c.Assert(err, gc.IsNil)
+		dm, err := macaroon.NewWithParams(macaroon.NewParams{
+			RootKey:  dischargeRootKey,
+			Id:       []byte(id),
+			Location: id + " location",
+			Version:  otherVers,
+		})
+		c.Assert(err, gc.IsNil)
+		err = dm.AddFirstPartyCaveat(id + " caveat")
+		c.Assert(err, gc.IsNil)
+		s = append(s, dm)
+	}
+	return rootKey, s
+}
+
+func (*sliceSuite) TestPrimaryAndDischarges(c *gc.C) {
+	var s macaroon.Slice
+	c.Assert(s.Primary(), gc.IsNil)
+	c.Assert(s.Discharges(), gc.HasLen, 0)
+	s.Bind()
+
+	_, s = newDischargedSlice(c, macaroon.V1)
+	c.Assert(s.Primary(), gc.Equals, s[0])
+	c.Assert(s.Discharges(), gc.DeepEquals, []*macaroon.Macaroon(s[1:]))
+}
+
+func (*sliceSuite) TestBind(c *gc.C) {
+	rootKey, s := newDischargedSlice(c, macaroon.V1)
+	err := s.Primary().Verify(rootKey, alwaysOK, s.Discharges())
+	c.Assert(err, gc.ErrorMatches, `signature mismatch after caveat verification`)
+
+	s.Bind()
+	err = s.Primary().Verify(rootKey, alwaysOK, s.Discharges())
+	c.Assert(err, gc.IsNil)
+}
+
+func (*sliceSuite) TestBinaryRoundTrip(c *gc.C) {
+	for _, vers := range []macaroon.Version{macaroon.V1, macaroon.V2} {
+		c.Logf("version %v", vers)
+		rootKey, s0 := newDischargedSlice(c, vers)
+		s0.Bind()
+		data, err := s0.MarshalBinary()
+		c.Assert(err, gc.IsNil)
+
+		var s1 macaroon.Slice
+		err = s1.UnmarshalBinary(data)
+		c.Assert(err, gc.IsNil)
+		assertEqualSlices(c, s0, s1)
+		for i := range s0 {
+			c.Assert(s1[i].Version(), gc.Equals, s0[i].Version())
+		}
+		err = s1.Primary().Verify(rootKey, alwaysOK, s1.Discharges())
+		c.Assert(err, gc.IsNil)
+
+		// Adding a caveat to one of the unmarshaled macaroons
+		// must not affect the others.
+		err = s1[0].AddFirstPartyCaveat("another caveat")
+		c.Assert(err, gc.IsNil)
+		assertEqualMacaroons(c, s1[1], s0[1])
+	}
+}
+
+func (*sliceSuite) TestJSONRoundTrip(c *gc.C) {
+	rootKey, s0 := newDischargedSlice(c, macaroon.V1)
+	s0.Bind()
+	data, err := json.Marshal(s0)
+	c.Assert(err, gc.IsNil)
+
+	var s1 macaroon.Slice
+	err = json.Unmarshal(data, &s1)
+	c.Assert(err, gc.IsNil)
+	assertEqualSlices(c, s0, s1)
+	err = s1.Primary().Verify(rootKey, alwaysOK, s1.Discharges())
+	c.Assert(err, gc.IsNil)
+}
+
+func (*sliceSuite) TestUnmarshalBinaryError(c *gc.C) {
+	_, s := newDischargedSlice(c, macaroon.V2)
+	data, err := s.MarshalBinary()
+	c.Assert(err, gc.IsNil)
+	var s1 macaroon.Slice
+	err = s1.UnmarshalBinary(data[0 : len(data)-1])
+	c.Assert(err, gc.ErrorMatches, `cannot unmarshal macaroon 2: packet size too big`)
+}
+
+func (*sliceSuite) TestSerializeRoundTrip(c *gc.C) {
+	_, s0 := newDischargedSlice(c, macaroon.V2)
+	str, err := macaroon.SerializeSlice(s0)
+	c.Assert(err, gc.IsNil)
+	s1, err := macaroon.DeserializeSlice(str)
+	c.Assert(err, gc.IsNil)
+	assertEqualSlices(c, s0, s1)
+}
+
+func (*sliceSuite) TestDeserializeSliceJSON(c *gc.C) {
+	_, s0 := newDischargedSlice(c, macaroon.V1)
+	data, err := json.Marshal(s0)
+	c.Assert(err, gc.IsNil)
+	s1, err := macaroon.DeserializeSlice(string(data))
+	c.Assert(err, gc.IsNil)
+	assertEqualSlices(c, s0, s1)
+}
+
+func (*sliceSuite) TestDeserializeSliceSingleMacaroon(c *gc.C) {
+	_, s := newDischargedSlice(c, macaroon.V1)
+	for i, m := range s {
+		c.Logf("macaroon %d", i)
+		str, err := macaroon.Serialize(m)
+		c.Assert(err, gc.IsNil)
+		s1, err := macaroon.DeserializeSlice(str)
+		c.Assert(err, gc.IsNil)
+		assertEqualSlices(c, macaroon.Slice{m}, s1)
+
+		data, err := m.MarshalJSON()
+		c.Assert(err, gc.IsNil)
+		s1, err = macaroon.DeserializeSlice(string(data))
+		c.Assert(err, gc.IsNil)
+		assertEqualSlices(c, macaroon.Slice{m}, s1)
+	}
+}
+
+func (*sliceSuite) TestDeserializeSliceNullMacaroon(c *gc.C) {
+	_, err := macaroon.DeserializeSlice("[null]")
+	c.Assert(err, gc.ErrorMatches, `null macaroon at index 0`)
+}
+
+func assertEqualSlices(c *gc.C, s0, s1 macaroon.Slice) {
+	c.Assert(s1, gc.HasLen, len(s0))
+	for i := range s0 {
+		assertEqualMacaroons(c, s0[i], s1[i])
+	}
+}
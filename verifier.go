@@ -0,0 +1,675 @@
+package macaroon
+
+import (
+	"crypto/hmac"
+	"fmt"
+)
+
+// Verifier is implemented by values that can verify macaroons.
+type Verifier interface {
+	// Verify verifies that m was minted with the given
+	// root key and that all its caveats are satisfied.
+	// It returns nil if the verification succeeds.
+	Verify(m *Macaroon, rootKey []byte) error
+}
+
+// VerifierParams holds the parameters for a NewVerifier call.
+type VerifierParams struct {
+	// Check is called to verify each first-party caveat - it
+	// should return an error if the condition is not met.
+	// If it is nil, all first-party caveats will be rejected.
+	Check func(caveat string) error
+
+	// Scheme holds the scheme used to verify the macaroon
+	// and all its discharges. The scheme of the macaroons
+	// themselves is ignored; if a macaroon was decoded from
+	// an encoding that records a scheme other than this one,
+	// verification fails.
+	Scheme Scheme
+
+	// Discharges holds the macaroons that may be used to
+	// discharge third party caveats. They must have been
+	// bound to the macaroon being verified.
+	Discharges []*Macaroon
+
+	// MaxCaveats holds the maximum number of caveats that
+	// will be checked by a single Verify call, including
+	// caveats in discharge macaroons and in discharges that
+	// were tried but could not be used, so it bounds the total
+	// work done by the call. If it is zero, DefaultMaxCaveats
+	// will be used; if it is negative, there is no limit.
+	MaxCaveats int
+
+	// MaxDischargeDepth holds the maximum depth of the
+	// discharge tree: discharges of the primary macaroon's
+	// caveats are at depth 1, discharges of their caveats are at
+	// depth 2, and so on. If it is zero or negative,
+	// DefaultMaxDischargeDepth will be used.
+	MaxDischargeDepth int
+
+	// RejectUnusedDischarges specifies that verification
+	// will fail if any of the discharge macaroons
+	// is not used to discharge a caveat.
+	RejectUnusedDischarges bool
+
+	// SignatureFirst specifies that Verify should authenticate
+	// the macaroon and all its discharges (see SignatureVerifier)
+	// before calling Check for any first-party caveat, so that a
+	// forged macaroon never causes Check to be called.
+	//
+	// In this mode, when there is more than one discharge
+	// with the id of a third party caveat, the first one that
+	// is authentic is used, even if its first party caveats
+	// are not satisfied.
+	SignatureFirst bool
+}
+
+// SignatureVerifier is implemented by Verifiers that can
+// authenticate a macaroon without checking its first party
+// caveats. The Verifier returned by NewVerifier
+// implements SignatureVerifier.
+type SignatureVerifier interface {
+	Verifier
+
+	// VerifySignature verifies that m was minted with the
+	// given root key and that it and all the discharges required
+	// by its third party caveats have valid signatures. It returns
+	// the first party caveat conditions of all those macaroons,
+	// which must all be satisfied for m to be valid.
+	VerifySignature(m *Macaroon, rootKey []byte) ([]string, error)
+}
+
+// DefaultMaxDischargeDepth holds the maximum depth of
+// the discharge tree used when VerifierParams.MaxDischargeDepth
+// is zero.
+const DefaultMaxDischargeDepth = 16
+
+// DefaultMaxCaveats holds the maximum number of caveats
+// checked by a single verification when VerifierParams.MaxCaveats
+// is zero. It is larger than the number of caveats in any set
+// of macaroons allowed by DefaultDecodeLimits.
+const DefaultMaxCaveats = 32 * 1024
+
+// NewVerifier returns a Verifier that verifies macaroons
+// using the given parameters. The returned Verifier may be
+// used to verify any number of macaroons, concurrently
+// if desired.
+//
+// Each discharge macaroon may be used to discharge at most
+// one caveat in any given verification, which means that
+// discharges that refer to each other in a cycle cannot
+// be used to cause unbounded work. A discharge that fails
+// to verify with a given key is not tried with that key
+// again in the same verification, so that many discharges
+// with the same id cannot cause an exponential search.
+func NewVerifier(p VerifierParams) Verifier {
+	return newVerifier(p)
+}
+
+func newVerifier(p VerifierParams) *verifier {
+	if p.MaxDischargeDepth <= 0 {
+		p.MaxDischargeDepth = DefaultMaxDischargeDepth
+	}
+	if p.MaxCaveats == 0 {
+		p.MaxCaveats = DefaultMaxCaveats
+	}
+	return &verifier{p}
+}
+
+// verifier is the Verifier implementation returned by NewVerifier.
+type verifier struct {
+	params VerifierParams
+}
+
+// Verify implements Verifier.Verify. The macaroon and all the
+// discharge macaroons are verified using the scheme in the
+// verifier's parameters.
+func (v *verifier) Verify(m *Macaroon, rootKey []byte) error {
+	if !v.params.SignatureFirst {
+		return v.newContext(m, false).run(m, rootKey)
+	}
+	vctxt := v.newContext(m, true)
+	if err := vctxt.run(m, rootKey); err != nil {
+		return err
+	}
+	for _, cond := range vctxt.conditions {
+		if err := v.check(cond.condition); err != nil {
+			return cond.checkError(err)
+		}
+	}
+	return nil
+}
+
+// VerifySignature implements SignatureVerifier.VerifySignature.
+func (v *verifier) VerifySignature(m *Macaroon, rootKey []byte) ([]string, error) {
+	vctxt := v.newContext(m, true)
+	if err := vctxt.run(m, rootKey); err != nil {
+		return nil, err
+	}
+	conditions := make([]string, len(vctxt.conditions))
+	for i, cond := range vctxt.conditions {
+		conditions[i] = cond.condition
+	}
+	return conditions, nil
+}
+
+// check checks the given first-party caveat condition.
+func (v *verifier) check(cond string) error {
+	if v.params.Check == nil {
+		return fmt.Errorf("caveat %q not satisfied: no first party caveat checker", cond)
+	}
+	return v.params.Check(cond)
+}
+
+// newContext returns a new context for verifying m.
+// If signatureOnly is true, first party caveats will
+// be collected rather than checked.
+func (v *verifier) newContext(m *Macaroon, signatureOnly bool) *verifyContext {
+	discharges := v.params.Discharges
+	vctxt := &verifyContext{
+		verifier:      v,
+		scheme:        v.params.Scheme,
+		signatureOnly: signatureOnly,
+		hasher:        v.params.Scheme.newHasher(),
+		sigs:          make([][maxHashSize]byte, v.params.MaxDischargeDepth+1),
+		used:          make([]bool, len(discharges)),
+		index:         make(map[string]int, len(discharges)),
+		next:          make([]int, len(discharges)),
+	}
+	// Build the index backwards so that discharges
+	// with the same id are tried in the order that
+	// they were provided.
+	for i := len(discharges) - 1; i >= 0; i-- {
+		id := string(discharges[i].dataBytes(discharges[i].id))
+		if j, ok := vctxt.index[id]; ok {
+			vctxt.next[i] = j
+		} else {
+			vctxt.next[i] = -1
+		}
+		vctxt.index[id] = i
+	}
+	// The primary macaroon may be among the discharges (for example
+	// when the client has sent a set of macaroons without
+	// distinguishing between them), in which case it cannot be used
+	// to discharge one of its own caveats.
+	for i, dm := range discharges {
+		if dm == m {
+			vctxt.use(i)
+		}
+	}
+	return vctxt
+}
+
+// lookup returns the index of the first discharge
+// with the given id, or -1 if there is none. The
+// next discharge with the same id can be found
+// with vctxt.next.
+func (vctxt *verifyContext) lookup(id []byte) int {
+	// Note: the compiler avoids allocating
+	// for the string conversion here.
+	if i, ok := vctxt.index[string(id)]; ok {
+		return i
+	}
+	return -1
+}
+
+// verifyContext holds the state for a single Verify call.
+type verifyContext struct {
+	*verifier
+
+	// scheme holds the scheme used for all the macaroons.
+	scheme Scheme
+
+	// signatureOnly holds whether first party caveats
+	// are collected in conditions rather than checked.
+	signatureOnly bool
+
+	// conditions holds the first party caveat conditions
+	// collected so far when signatureOnly is true.
+	conditions []collectedCondition
+
+	// hasher is used to calculate all the signatures.
+	hasher *hasher
+
+	// sigs holds a signature buffer for each level
+	// of the discharge tree, so that signatures can be
+	// calculated without allocation. Verification never
+	// goes deeper than params.MaxDischargeDepth.
+	sigs [][maxHashSize]byte
+
+	// index maps from discharge macaroon id to the index
+	// in params.Discharges of the first discharge with
+	// that id.
+	index map[string]int
+
+	// next holds, for each discharge, the index of the
+	// next discharge with the same id, or -1 if there
+	// is none.
+	next []int
+
+	// caveatCount holds the number of caveats checked so far.
+	caveatCount int
+
+	// used records which discharges are currently in use.
+	// It is indexed by position in params.Discharges.
+	used []bool
+
+	// usedStack holds the indexes of all the discharges
+	// in use, in the order they were used, so that a failed
+	// verification can relinquish all the discharges used
+	// by it.
+	usedStack []int
+
+	// failed records the error from each discharge that
+	// has failed to verify with a given key. It is only
+	// allocated when a discharge fails.
+	failed map[failedDischarge]error
+}
+
+// failedDischarge identifies a discharge that failed to
+// verify with a given caveat key.
+type failedDischarge struct {
+	index int
+	key   string
+}
+
+// collectedCondition holds a first party caveat
+// condition collected by VerifySignature.
+type collectedCondition struct {
+	condition string
+	pos       caveatPos
+}
+
+// checkError returns the error to be returned
+// when the condition has been rejected by the checker
+// with the given error.
+func (cond collectedCondition) checkError(err error) error {
+	return cond.pos.checkError(cond.condition, err)
+}
+
+// caveatPos identifies a caveat in the discharge tree.
+type caveatPos struct {
+	// m holds the macaroon containing the caveat.
+	m *Macaroon
+
+	// discharge holds the index of m in the discharges,
+	// or -1 if m is the primary macaroon.
+	discharge int
+
+	// caveat holds the index of the caveat in m, or -1
+	// if the position refers to m as a whole.
+	caveat int
+}
+
+// checkError returns the error to be returned when the
+// first party caveat at pos, with the given condition,
+// has been rejected by the checker with the given error.
+func (pos caveatPos) checkError(cond string, err error) *VerificationError {
+	kind := CheckFailed
+	if IsFatal(err) {
+		kind = CheckDenied
+	}
+	verr := pos.errorf(kind, err, "%s", err)
+	verr.Condition = cond
+	return verr
+}
+
+// errorf returns a VerificationError of the given kind
+// for the caveat at pos, with the given underlying error
+// and message.
+func (pos caveatPos) errorf(kind FailureKind, err error, f string, a ...interface{}) *VerificationError {
+	verr := &VerificationError{
+		Kind:           kind,
+		Macaroon:       pos.m,
+		DischargeIndex: pos.discharge,
+		CaveatIndex:    pos.caveat,
+		Err:            err,
+		message:        fmt.Sprintf(f, a...),
+	}
+	if pos.caveat >= 0 {
+		verr.Condition = string(pos.m.dataBytes(pos.m.caveats[pos.caveat].caveatId))
+	}
+	return verr
+}
+
+// overLimit reports whether the verification has
+// checked more caveats than allowed.
+func (vctxt *verifyContext) overLimit() bool {
+	max := vctxt.params.MaxCaveats
+	return max > 0 && vctxt.caveatCount > max
+}
+
+// use marks the discharge with the given index as used.
+func (vctxt *verifyContext) use(i int) {
+	vctxt.used[i] = true
+	vctxt.usedStack = append(vctxt.usedStack, i)
+}
+
+// unuseFrom marks all the discharges used since the
+// usedStack had length n as unused.
+func (vctxt *verifyContext) unuseFrom(n int) {
+	for _, i := range vctxt.usedStack[n:] {
+		vctxt.used[i] = false
+	}
+	vctxt.usedStack = vctxt.usedStack[0:n]
+}
+
+// run verifies the primary macaroon m.
+func (vctxt *verifyContext) run(m *Macaroon, rootKey []byte) error {
+	if !vctxt.scheme.valid() {
+		return fmt.Errorf("unknown signature scheme %v", vctxt.scheme)
+	}
+	if err := vctxt.verify(m, -1, m.sig, vctxt.scheme.deriveKey(rootKey), 0); err != nil {
+		return err
+	}
+	if vctxt.params.RejectUnusedDischarges {
+		for i, dm := range vctxt.params.Discharges {
+			if !vctxt.used[i] {
+				pos := caveatPos{m: dm, discharge: i, caveat: -1}
+				return pos.errorf(UnusedDischarge, nil, "discharge macaroon %q was not used", dm.dataBytes(dm.id))
+			}
+		}
+	}
+	return nil
+}
+
+// verify verifies m, which is at the given depth in the discharge
+// tree and has the given index in the discharges (-1 for the
+// primary macaroon). The rootSig argument holds the signature
+// of the primary macaroon and key holds the derived root key
+// of m.
+func (vctxt *verifyContext) verify(m *Macaroon, dischargeIndex int, rootSig []byte, key []byte, depth int) error {
+	scheme, h := vctxt.scheme, vctxt.hasher
+	if m.hasEncodedScheme && m.encodedScheme != scheme {
+		pos := caveatPos{m: m, discharge: dischargeIndex, caveat: -1}
+		return pos.errorf(BadSignature, nil, "macaroon encoded with scheme %v, not %v", m.encodedScheme, scheme)
+	}
+	caveatSig := vctxt.sigs[depth][0:h.size]
+	copy(caveatSig, h.keyedHash(key, m.dataBytes(m.id), nil))
+	// confKey holds the key for decrypting confidential
+	// caveats. It is only calculated when needed.
+	var confKey []byte
+	for i, cav := range m.caveats {
+		vctxt.caveatCount++
+		if vctxt.overLimit() {
+			pos := caveatPos{m: m, discharge: dischargeIndex, caveat: i}
+			return pos.errorf(LimitExceeded, nil, "too many caveats (max %d)", vctxt.params.MaxCaveats)
+		}
+		caveatId := m.dataBytes(cav.caveatId)
+		if cav.isThirdParty() {
+			if err := vctxt.verifyThirdParty(m, dischargeIndex, i, caveatSig, rootSig, depth); err != nil {
+				return err
+			}
+		} else {
+			pos := caveatPos{m: m, discharge: dischargeIndex, caveat: i}
+			cond := caveatId
+			if isConfidential(caveatId) {
+				if confKey == nil {
+					confKey = scheme.confidentialKey(key)
+				}
+				var err error
+				cond, err = scheme.decryptCondition(confKey, caveatId)
+				if err != nil {
+					return pos.errorf(BadSignature, err, "cannot decrypt confidential caveat %d: %v", i, err)
+				}
+			}
+			if vctxt.signatureOnly {
+				vctxt.conditions = append(vctxt.conditions, collectedCondition{
+					condition: string(cond),
+					pos:       pos,
+				})
+			} else if err := vctxt.check(string(cond)); err != nil {
+				return pos.checkError(string(cond), err)
+			}
+		}
+		// Note: the verification of discharge macaroons
+		// above uses other signature buffers, so
+		// caveatSig is still intact.
+		copy(caveatSig, h.caveatSig(scheme, caveatSig, caveatId, m.dataBytes(cav.verificationId)))
+	}
+	// Note that the signature is only checked after
+	// all the caveats have been checked. Use
+	// VerifierParams.SignatureFirst to avoid that.
+	if !hmac.Equal(h.bind(scheme, rootSig, caveatSig), m.sig) {
+		pos := caveatPos{m: m, discharge: dischargeIndex, caveat: -1}
+		return pos.errorf(BadSignature, nil, "signature mismatch after caveat verification")
+	}
+	return nil
+}
+
+// verifyThirdParty verifies the third party caveat with the
+// given index in m by finding and verifying a discharge
+// macaroon for it. The caveatSig argument holds the signature
+// of m before the caveat was added.
+func (vctxt *verifyContext) verifyThirdParty(m *Macaroon, dischargeIndex, caveatIndex int, caveatSig, rootSig []byte, depth int) error {
+	cav := &m.caveats[caveatIndex]
+	pos := caveatPos{m: m, discharge: dischargeIndex, caveat: caveatIndex}
+	cavKey, err := vctxt.scheme.decryptKey(caveatSig, m.dataBytes(cav.verificationId))
+	if err != nil {
+		return pos.errorf(BadSignature, err, "failed to decrypt caveat %d signature: %v", caveatIndex, err)
+	}
+	if depth >= vctxt.params.MaxDischargeDepth {
+		return pos.errorf(LimitExceeded, nil, "cannot verify caveat %q: discharge macaroons nested too deeply (max depth %d)", m.dataBytes(cav.caveatId), vctxt.params.MaxDischargeDepth)
+	}
+	// An any-of caveat may be discharged by a discharge
+	// macaroon with the id of any of its alternatives,
+	// which are tried in order.
+	caveatId := m.dataBytes(cav.caveatId)
+	alts := decodeAlternatives(caveatId)
+	nids := 1
+	if alts != nil {
+		nids = len(alts)
+	}
+	// We choose an arbitrary error from one of the
+	// possible discharge macaroon verifications
+	// if there's more than one discharge macaroon
+	// with the required id.
+	var verifyErr error
+	found, foundUsed := false, false
+	for a := 0; a < nids; a++ {
+		id := caveatId
+		if alts != nil {
+			id = alts[a].Id
+		}
+		for j := vctxt.lookup(id); j >= 0; j = vctxt.next[j] {
+			if vctxt.used[j] {
+				foundUsed = true
+				continue
+			}
+			found = true
+			fd := failedDischarge{j, string(cavKey)}
+			if err := vctxt.failed[fd]; err != nil {
+				// The discharge has already failed with
+				// this key. Trying it again could only
+				// succeed through a different choice of
+				// discharges for its own caveats, and
+				// searching for one can take exponential time.
+				verifyErr = err
+				continue
+			}
+			n, ncond := len(vctxt.usedStack), len(vctxt.conditions)
+			vctxt.use(j)
+			err := vctxt.verify(vctxt.params.Discharges[j], j, rootSig, cavKey, depth+1)
+			if err == nil {
+				return nil
+			}
+			if verr, ok := err.(*VerificationError); ok && verr.Kind == LimitExceeded && vctxt.overLimit() {
+				// The work limit applies to the whole
+				// verification, so there is no point
+				// trying other discharges.
+				return err
+			}
+			verifyErr = err
+			if vctxt.failed == nil {
+				vctxt.failed = make(map[failedDischarge]error)
+			}
+			vctxt.failed[fd] = err
+			vctxt.unuseFrom(n)
+			vctxt.conditions = vctxt.conditions[0:ncond]
+		}
+	}
+	if !found {
+		if alts != nil {
+			ids := make([]string, len(alts))
+			for i, alt := range alts {
+				ids[i] = string(alt.Id)
+			}
+			if foundUsed {
+				return pos.errorf(MissingDischarge, nil, "discharge macaroon for any of caveats %q is already in use", ids)
+			}
+			return pos.errorf(MissingDischarge, nil, "cannot find discharge macaroon for any of caveats %q", ids)
+		}
+		if foundUsed {
+			return pos.errorf(MissingDischarge, nil, "discharge macaroon for caveat %q is already in use", caveatId)
+		}
+		return pos.errorf(MissingDischarge, nil, "cannot find discharge macaroon for caveat %q", caveatId)
+	}
+	return verifyErr
+}
+
+// FailureKind classifies the reason that a macaroon
+// failed verification.
+type FailureKind int
+
+const (
+	// MissingDischarge means that no discharge macaroon
+	// could be found for a third party caveat.
+	MissingDischarge FailureKind = iota + 1
+
+	// CheckFailed means that a first party caveat
+	// was rejected by the checker. The failure is
+	// remediable: a new macaroon may succeed.
+	CheckFailed
+
+	// BadSignature means that a macaroon did not have
+	// the expected signature, so it has been tampered
+	// with, was minted with a different root key, or
+	// (for a discharge macaroon) was not bound to the
+	// primary macaroon.
+	BadSignature
+
+	// LimitExceeded means that verification would
+	// exceed one of the limits in VerifierParams.
+	LimitExceeded
+
+	// UnusedDischarge means that a discharge macaroon
+	// was not used when VerifierParams.RejectUnusedDischarges
+	// was set.
+	UnusedDischarge
+
+	// CheckDenied means that a first party caveat was
+	// rejected by the checker with an error marked as
+	// fatal (see Fatal), so a new macaroon would not help.
+	CheckDenied
+)
+
+var failureKindNames = []string{
+	MissingDischarge: "missing discharge",
+	CheckFailed:      "check failed",
+	BadSignature:     "bad signature",
+	LimitExceeded:    "limit exceeded",
+	UnusedDischarge:  "unused discharge",
+	CheckDenied:      "check denied",
+}
+
+// String implements fmt.Stringer.
+func (k FailureKind) String() string {
+	if k > 0 && int(k) < len(failureKindNames) {
+		return failureKindNames[k]
+	}
+	return fmt.Sprintf("FailureKind(%d)", int(k))
+}
+
+// VerificationError is the type of the error returned
+// by the Verifier returned by NewVerifier, and
+// hence by Macaroon.Verify, when a macaroon fails
+// verification.
+type VerificationError struct {
+	// Kind holds the kind of failure.
+	Kind FailureKind
+
+	// Macaroon holds the macaroon in which the failure
+	// occurred - either the primary macaroon or one
+	// of the discharges.
+	Macaroon *Macaroon
+
+	// DischargeIndex holds the index of Macaroon in
+	// the discharges, or -1 if it is the primary macaroon.
+	DischargeIndex int
+
+	// CaveatIndex holds the index of the failing caveat
+	// in Macaroon, or -1 if the failure does not relate
+	// to a particular caveat (for example, when
+	// the macaroon's final signature is wrong).
+	CaveatIndex int
+
+	// Condition holds the id of the failing caveat, which
+	// is the condition for a first party caveat. When Kind
+	// is CheckFailed or CheckDenied and the caveat is
+	// confidential, it holds the decrypted condition. It is
+	// empty when CaveatIndex is -1.
+	Condition string
+
+	// Err holds the underlying error, if any. When Kind
+	// is CheckFailed or CheckDenied, it holds the error
+	// returned by the checker.
+	Err error
+
+	message string
+}
+
+// Error implements the error interface.
+func (e *VerificationError) Error() string {
+	return e.message
+}
+
+// Fatal implements the Fatal method used by IsFatal.
+// It reports whether e.Kind is CheckDenied.
+func (e *VerificationError) Fatal() bool {
+	return e.Kind == CheckDenied
+}
+
+// Fatal returns an error that has the same message as err
+// but is marked as fatal. A first party caveat checker
+// should return such an error when the request can never
+// be allowed, so that obtaining a new macaroon will not
+// help - for example when the client is not permitted to
+// perform the operation at all. Errors returned by checkers
+// that are not marked as fatal are considered remediable:
+// for example, an expired macaroon can be replaced by a
+// new one.
+//
+// Fatal returns nil if err is nil.
+func Fatal(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &fatalError{err}
+}
+
+// fatalError is the type of the error returned by Fatal.
+type fatalError struct {
+	err error
+}
+
+// Error implements the error interface.
+func (e *fatalError) Error() string {
+	return e.err.Error()
+}
+
+// Fatal implements the Fatal method used by IsFatal.
+func (e *fatalError) Fatal() bool {
+	return true
+}
+
+// IsFatal reports whether err is marked as fatal.
+// An error is marked as fatal if it implements a
+// Fatal method that returns true. This includes
+// errors returned by Fatal and VerificationErrors
+// with a Kind of CheckDenied.
+func IsFatal(err error) bool {
+	f, ok := err.(interface {
+		Fatal() bool
+	})
+	return ok && f.Fatal()
+}
@@ -0,0 +1,535 @@
+package macaroon_test
+
+import (
+	"fmt"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/rogpeppe/macaroon"
+)
+
+type verifierSuite struct{}
+
+var _ = gc.Suite(&verifierSuite{})
+
+func (*verifierSuite) TestVerifierReuse(c *gc.C) {
+	// Check that a single verifier can verify several
+	// macaroons, each with its own discharges. The discharges
+	// for each primary macaroon have the same ids.
+	var discharges []*macaroon.Macaroon
+	var primaries []*macaroon.Macaroon
+	var rootKeys [][]byte
+	for i := 0; i < 3; i++ {
+		rootKey, s := newDischargedSlice(c, macaroon.V1)
+		rootKey = append(rootKey, byte(i))
+		m := MustNew(rootKey, fmt.Sprintf("primary %d", i), "")
+		err := m.AddFirstPartyCaveat("first caveat")
+		c.Assert(err, gc.IsNil)
+		for _, dm := range s.Discharges() {
+			err := m.AddThirdPartyCaveat([]byte(dm.Id()+" key"), dm.Id(), dm.Location())
+			c.Assert(err, gc.IsNil)
+		}
+		s[0] = m
+		s.Bind()
+		primaries = append(primaries, m)
+		rootKeys = append(rootKeys, rootKey)
+		discharges = append(discharges, s.Discharges()...)
+	}
+	v := macaroon.NewVerifier(macaroon.VerifierParams{
+		Check:      alwaysOK,
+		Discharges: discharges,
+	})
+	for i, m := range primaries {
+		c.Logf("primary %d", i)
+		err := v.Verify(m, rootKeys[i])
+		c.Assert(err, gc.IsNil)
+	}
+	err := v.Verify(primaries[0], rootKeys[1])
+	c.Assert(err, gc.ErrorMatches, `failed to decrypt caveat 1 signature: decryption failure`)
+}
+
+func (*verifierSuite) TestVerifierWithNilCheck(c *gc.C) {
+	rootKey := []byte("secret")
+	m := MustNew(rootKey, "some id", "")
+	v := macaroon.NewVerifier(macaroon.VerifierParams{})
+	err := v.Verify(m, rootKey)
+	c.Assert(err, gc.IsNil)
+
+	err = m.AddFirstPartyCaveat("a caveat")
+	c.Assert(err, gc.IsNil)
+	err = v.Verify(m, rootKey)
+	c.Assert(err, gc.ErrorMatches, `caveat "a caveat" not satisfied: no first party caveat checker`)
+}
+
+var maxCaveatsTests = []struct {
+	maxCaveats int
+	expectErr  string
+}{{
+	maxCaveats: 0,
+}, {
+	maxCaveats: 5,
+}, {
+	maxCaveats: 4,
+	expectErr:  `too many caveats \(max 4\)`,
+}, {
+	maxCaveats: 1,
+	expectErr:  `too many caveats \(max 1\)`,
+}}
+
+func (*verifierSuite) TestMaxCaveats(c *gc.C) {
+	// The primary macaroon has three caveats and
+	// each discharge has one.
+	rootKey, s := newDischargedSlice(c, macaroon.V1)
+	s.Bind()
+	for i, test := range maxCaveatsTests {
+		c.Logf("test %d: max %d", i, test.maxCaveats)
+		v := macaroon.NewVerifier(macaroon.VerifierParams{
+			Check:      alwaysOK,
+			Discharges: s.Discharges(),
+			MaxCaveats: test.maxCaveats,
+		})
+		err := v.Verify(s.Primary(), rootKey)
+		if test.expectErr != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectErr)
+		} else {
+			c.Assert(err, gc.IsNil)
+		}
+	}
+}
+
+// dischargeChain returns a primary macaroon with a third party
+// caveat discharged by a chain of n discharge macaroons, each
+// with a third party caveat discharged by the next.
+func dischargeChain(n int) (rootKey []byte, s macaroon.Slice) {
+	var specs []macaroonSpec
+	specs = append(specs, macaroonSpec{
+		rootKey: "root-key",
+		id:      "root-id",
+	})
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("discharge-%d", i)
+		specs[i].caveats = append(specs[i].caveats, caveat{
+			condition: id,
+			location:  "somewhere",
+			rootKey:   id + "-key",
+		})
+		specs = append(specs, macaroonSpec{
+			location: "somewhere",
+			rootKey:  id + "-key",
+			id:       id,
+		})
+	}
+	rootKey, primary, discharges := makeMacaroons(specs)
+	return rootKey, append(macaroon.Slice{primary}, discharges...)
+}
+
+var maxDischargeDepthTests = []struct {
+	chainLen  int
+	maxDepth  int
+	expectErr string
+}{{
+	chainLen: 3,
+	maxDepth: 3,
+}, {
+	chainLen:  3,
+	maxDepth:  2,
+	expectErr: `cannot verify caveat "discharge-2": discharge macaroons nested too deeply \(max depth 2\)`,
+}, {
+	chainLen: macaroon.DefaultMaxDischargeDepth,
+	maxDepth: 0,
+}, {
+	chainLen:  macaroon.DefaultMaxDischargeDepth + 1,
+	maxDepth:  0,
+	expectErr: `cannot verify caveat "discharge-16": discharge macaroons nested too deeply \(max depth 16\)`,
+}}
+
+func (*verifierSuite) TestMaxDischargeDepth(c *gc.C) {
+	for i, test := range maxDischargeDepthTests {
+		c.Logf("test %d: chain %d; max depth %d", i, test.chainLen, test.maxDepth)
+		rootKey, s := dischargeChain(test.chainLen)
+		v := macaroon.NewVerifier(macaroon.VerifierParams{
+			Discharges:        s.Discharges(),
+			MaxDischargeDepth: test.maxDepth,
+		})
+		err := v.Verify(s.Primary(), rootKey)
+		if test.expectErr != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectErr)
+		} else {
+			c.Assert(err, gc.IsNil)
+		}
+	}
+}
+
+func (*verifierSuite) TestRejectUnusedDischarges(c *gc.C) {
+	rootKey, s := dischargeChain(2)
+	extra := MustNew([]byte("extra-key"), "extra", "")
+	extra.Bind(s.Primary().Signature())
+	discharges := append(s.Discharges(), extra)
+
+	v := macaroon.NewVerifier(macaroon.VerifierParams{
+		Discharges: discharges,
+	})
+	err := v.Verify(s.Primary(), rootKey)
+	c.Assert(err, gc.IsNil)
+
+	v = macaroon.NewVerifier(macaroon.VerifierParams{
+		Discharges:             discharges,
+		RejectUnusedDischarges: true,
+	})
+	err = v.Verify(s.Primary(), rootKey)
+	c.Assert(err, gc.ErrorMatches, `discharge macaroon "extra" was not used`)
+
+	v = macaroon.NewVerifier(macaroon.VerifierParams{
+		Discharges:             s.Discharges(),
+		RejectUnusedDischarges: true,
+	})
+	err = v.Verify(s.Primary(), rootKey)
+	c.Assert(err, gc.IsNil)
+
+	// The primary macaroon itself counts as used.
+	v = macaroon.NewVerifier(macaroon.VerifierParams{
+		Discharges:             s,
+		RejectUnusedDischarges: true,
+	})
+	err = v.Verify(s.Primary(), rootKey)
+	c.Assert(err, gc.IsNil)
+}
+
+func (*verifierSuite) TestManyDischargesWithSameId(c *gc.C) {
+	// A client can attenuate a genuine discharge macaroon with
+	// a third party caveat under a key of their choosing and
+	// supply many discharges for it, each of which has the same
+	// caveat. Trying every ordering of those discharges takes
+	// exponential time.
+	for _, n := range []int{9, 64} {
+		c.Logf("%d discharges", n)
+		rootKey := []byte("root-key")
+		primary := MustNew(rootKey, "root-id", "")
+		err := primary.AddThirdPartyCaveat([]byte("bob-key"), "bob", "bob")
+		c.Assert(err, gc.IsNil)
+		dm := MustNew([]byte("bob-key"), "bob", "bob")
+		err = dm.AddThirdPartyCaveat([]byte("attacker-key"), "x", "attacker")
+		c.Assert(err, gc.IsNil)
+		discharges := []*macaroon.Macaroon{dm}
+		for i := 0; i < n; i++ {
+			xm := MustNew([]byte("attacker-key"), "x", "attacker")
+			err := xm.AddFirstPartyCaveat("count")
+			c.Assert(err, gc.IsNil)
+			err = xm.AddThirdPartyCaveat([]byte("attacker-key"), "x", "attacker")
+			c.Assert(err, gc.IsNil)
+			discharges = append(discharges, xm)
+		}
+		for _, m := range discharges {
+			m.Bind(primary.Signature())
+		}
+		checks := 0
+		v := macaroon.NewVerifier(macaroon.VerifierParams{
+			Check: func(string) error {
+				checks++
+				return nil
+			},
+			Discharges: discharges,
+		})
+		err = v.Verify(primary, rootKey)
+		c.Assert(err, gc.NotNil)
+		c.Assert(checks <= n*n, gc.Equals, true, gc.Commentf("%d checks", checks))
+	}
+}
+
+func (*verifierSuite) TestNegativeMaxDischargeDepth(c *gc.C) {
+	rootKey, s := dischargeChain(3)
+	v := macaroon.NewVerifier(macaroon.VerifierParams{
+		Discharges:        s.Discharges(),
+		MaxDischargeDepth: -1,
+	})
+	err := v.Verify(s.Primary(), rootKey)
+	c.Assert(err, gc.IsNil)
+}
+
+func (*verifierSuite) TestDefaultMaxCaveats(c *gc.C) {
+	rootKey := []byte("root-key")
+	m := MustNew(rootKey, "root-id", "")
+	for i := 0; i <= macaroon.DefaultMaxCaveats; i++ {
+		m.AddFirstPartyCaveat("x")
+	}
+	err := m.Verify(rootKey, alwaysOK, nil)
+	c.Assert(err, gc.ErrorMatches, fmt.Sprintf(`too many caveats \(max %d\)`, macaroon.DefaultMaxCaveats))
+
+	v := macaroon.NewVerifier(macaroon.VerifierParams{
+		Check:      alwaysOK,
+		MaxCaveats: -1,
+	})
+	err = v.Verify(m, rootKey)
+	c.Assert(err, gc.IsNil)
+}
+
+func (*verifierSuite) TestCycleThroughPrimary(c *gc.C) {
+	// Make a discharge macaroon with a caveat that
+	// refers back to the primary macaroon.
+	rootKey := []byte("root-key")
+	primary := MustNew(rootKey, "root-id", "")
+	err := primary.AddThirdPartyCaveat([]byte("bob-key"), "bob-is-great", "bob")
+	c.Assert(err, gc.IsNil)
+	dm := MustNew([]byte("bob-key"), "bob-is-great", "bob")
+	err = dm.AddThirdPartyCaveat(rootKey, "root-id", "")
+	c.Assert(err, gc.IsNil)
+	dm.Bind(primary.Signature())
+
+	v := macaroon.NewVerifier(macaroon.VerifierParams{
+		Discharges: []*macaroon.Macaroon{primary, dm},
+	})
+	err = v.Verify(primary, rootKey)
+	c.Assert(err, gc.ErrorMatches, `discharge macaroon for caveat "root-id" is already in use`)
+}
+
+func (*verifierSuite) TestVerifySignature(c *gc.C) {
+	rootKey, primary, discharges := makeMacaroons(recursiveThirdPartyCaveatMacaroons)
+	conditions, err := primary.VerifySignature(rootKey, discharges)
+	c.Assert(err, gc.IsNil)
+	c.Assert(conditions, gc.DeepEquals, []string{
+		"wonderful",
+		"splendid",
+		"spiffing",
+		"splendid",
+		"high-fiving",
+	})
+
+	conditions, err = primary.VerifySignature([]byte("wrong key"), discharges)
+	c.Assert(err, gc.ErrorMatches, `failed to decrypt caveat 1 signature: decryption failure`)
+	c.Assert(conditions, gc.IsNil)
+
+	conditions, err = primary.VerifySignature(rootKey, discharges[1:])
+	c.Assert(err, gc.ErrorMatches, `cannot find discharge macaroon for caveat "bob-is-great"`)
+	c.Assert(conditions, gc.IsNil)
+}
+
+func (*verifierSuite) TestVerifySignatureSkipsForgedDischarge(c *gc.C) {
+	rootKey, s := newDischargedSlice(c, macaroon.V1)
+	s.Bind()
+	// Add a forged discharge with the same id as a genuine one
+	// in front of it.
+	forged := MustNew([]byte("wrong key"), s[1].Id(), "")
+	err := forged.AddFirstPartyCaveat("forged caveat")
+	c.Assert(err, gc.IsNil)
+	forged.Bind(s.Primary().Signature())
+	discharges := append([]*macaroon.Macaroon{forged}, s.Discharges()...)
+
+	conditions, err := s.Primary().VerifySignature(rootKey, discharges)
+	c.Assert(err, gc.IsNil)
+	c.Assert(conditions, gc.DeepEquals, []string{
+		"first caveat",
+		"bob-is-great caveat",
+		"alice-is-great caveat",
+	})
+}
+
+func (*verifierSuite) TestSignatureFirst(c *gc.C) {
+	rootKey, s := newDischargedSlice(c, macaroon.V1)
+	s.Bind()
+	var checked []string
+	check := func(cond string) error {
+		checked = append(checked, cond)
+		if cond == "alice-is-great caveat" {
+			return fmt.Errorf("alice is not great")
+		}
+		return nil
+	}
+	v := macaroon.NewVerifier(macaroon.VerifierParams{
+		Check:          check,
+		Discharges:     s.Discharges(),
+		SignatureFirst: true,
+	})
+	err := v.Verify(s.Primary(), rootKey)
+	c.Assert(err, gc.ErrorMatches, `alice is not great`)
+	c.Assert(checked, gc.DeepEquals, []string{
+		"first caveat",
+		"bob-is-great caveat",
+		"alice-is-great caveat",
+	})
+
+	// Check that the checker is not called at all when
+	// the macaroon has been tampered with.
+	checked = nil
+	err = s.Primary().AddFirstPartyCaveat("another caveat")
+	c.Assert(err, gc.IsNil)
+	err = v.Verify(s.Primary(), rootKey)
+	c.Assert(err, gc.ErrorMatches, `signature mismatch after caveat verification`)
+	c.Assert(checked, gc.HasLen, 0)
+
+	// In contrast, the default mode checks caveats before
+	// the signature.
+	v = macaroon.NewVerifier(macaroon.VerifierParams{
+		Check:      check,
+		Discharges: s.Discharges(),
+	})
+	err = v.Verify(s.Primary(), rootKey)
+	c.Assert(err, gc.ErrorMatches, `signature mismatch after caveat verification`)
+	c.Assert(checked, gc.Not(gc.HasLen), 0)
+}
+
+func (*verifierSuite) TestNewVerifierImplementsSignatureVerifier(c *gc.C) {
+	v := macaroon.NewVerifier(macaroon.VerifierParams{})
+	_, ok := v.(macaroon.SignatureVerifier)
+	c.Assert(ok, gc.Equals, true)
+}
+
+var verificationErrorTests = []struct {
+	about          string
+	params         macaroon.VerifierParams
+	unbound        bool
+	expectErr      string
+	expectKind     macaroon.FailureKind
+	expectIndex    int
+	expectCaveat   int
+	expectCond     string
+	expectCheckErr bool
+}{{
+	about:          "primary caveat rejected",
+	params:         macaroon.VerifierParams{Check: rejectCondition("first caveat")},
+	expectErr:      `first caveat rejected`,
+	expectKind:     macaroon.CheckFailed,
+	expectIndex:    -1,
+	expectCaveat:   0,
+	expectCond:     "first caveat",
+	expectCheckErr: true,
+}, {
+	about:          "discharge caveat rejected",
+	params:         macaroon.VerifierParams{Check: rejectCondition("alice-is-great caveat")},
+	expectErr:      `alice-is-great caveat rejected`,
+	expectKind:     macaroon.CheckFailed,
+	expectIndex:    1,
+	expectCaveat:   0,
+	expectCond:     "alice-is-great caveat",
+	expectCheckErr: true,
+}, {
+	about: "discharge caveat rejected after signature check",
+	params: macaroon.VerifierParams{
+		Check:          rejectCondition("alice-is-great caveat"),
+		SignatureFirst: true,
+	},
+	expectErr:      `alice-is-great caveat rejected`,
+	expectKind:     macaroon.CheckFailed,
+	expectIndex:    1,
+	expectCaveat:   0,
+	expectCond:     "alice-is-great caveat",
+	expectCheckErr: true,
+}, {
+	about:        "unbound discharge",
+	params:       macaroon.VerifierParams{Check: alwaysOK},
+	unbound:      true,
+	expectErr:    `signature mismatch after caveat verification`,
+	expectKind:   macaroon.BadSignature,
+	expectIndex:  0,
+	expectCaveat: -1,
+}, {
+	about:        "too many caveats",
+	params:       macaroon.VerifierParams{Check: alwaysOK, MaxCaveats: 2},
+	expectErr:    `too many caveats \(max 2\)`,
+	expectKind:   macaroon.LimitExceeded,
+	expectIndex:  0,
+	expectCaveat: 0,
+	expectCond:   "bob-is-great caveat",
+}}
+
+func rejectCondition(reject string) func(string) error {
+	return func(cond string) error {
+		if cond == reject {
+			return fmt.Errorf("%s rejected", cond)
+		}
+		return nil
+	}
+}
+
+func (*verifierSuite) TestVerificationError(c *gc.C) {
+	for i, test := range verificationErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		rootKey, s := newDischargedSlice(c, macaroon.V1)
+		if !test.unbound {
+			s.Bind()
+		}
+		params := test.params
+		params.Discharges = s.Discharges()
+		err := macaroon.NewVerifier(params).Verify(s.Primary(), rootKey)
+		c.Assert(err, gc.ErrorMatches, test.expectErr)
+		verr, ok := err.(*macaroon.VerificationError)
+		c.Assert(ok, gc.Equals, true)
+		c.Assert(verr.Kind, gc.Equals, test.expectKind)
+		c.Assert(verr.DischargeIndex, gc.Equals, test.expectIndex)
+		if test.expectIndex == -1 {
+			c.Assert(verr.Macaroon, gc.Equals, s.Primary())
+		} else {
+			c.Assert(verr.Macaroon, gc.Equals, s.Discharges()[test.expectIndex])
+		}
+		c.Assert(verr.CaveatIndex, gc.Equals, test.expectCaveat)
+		c.Assert(verr.Condition, gc.Equals, test.expectCond)
+		if test.expectCheckErr {
+			c.Assert(verr.Err, gc.ErrorMatches, test.expectErr)
+		}
+	}
+}
+
+func (*verifierSuite) TestVerificationErrorMissingDischarge(c *gc.C) {
+	rootKey, s := newDischargedSlice(c, macaroon.V1)
+	s.Bind()
+	err := s.Primary().Verify(rootKey, alwaysOK, s.Discharges()[0:1])
+	c.Assert(err, gc.ErrorMatches, `cannot find discharge macaroon for caveat "alice-is-great"`)
+	verr := err.(*macaroon.VerificationError)
+	c.Assert(verr.Kind, gc.Equals, macaroon.MissingDischarge)
+	c.Assert(verr.Macaroon, gc.Equals, s.Primary())
+	c.Assert(verr.DischargeIndex, gc.Equals, -1)
+	c.Assert(verr.CaveatIndex, gc.Equals, 2)
+	c.Assert(verr.Condition, gc.Equals, "alice-is-great")
+	c.Assert(verr.Err, gc.IsNil)
+}
+
+func (*verifierSuite) TestFailureKindString(c *gc.C) {
+	c.Assert(macaroon.MissingDischarge.String(), gc.Equals, "missing discharge")
+	c.Assert(macaroon.UnusedDischarge.String(), gc.Equals, "unused discharge")
+	c.Assert(macaroon.FailureKind(0).String(), gc.Equals, "FailureKind(0)")
+}
+
+func (*verifierSuite) TestFatalCheckError(c *gc.C) {
+	for _, signatureFirst := range []bool{false, true} {
+		c.Logf("signature first %v", signatureFirst)
+		rootKey, s := newDischargedSlice(c, macaroon.V1)
+		s.Bind()
+		checkErr := macaroon.Fatal(fmt.Errorf("alice is banned"))
+		v := macaroon.NewVerifier(macaroon.VerifierParams{
+			Check: func(cond string) error {
+				if cond == "alice-is-great caveat" {
+					return checkErr
+				}
+				return nil
+			},
+			Discharges:     s.Discharges(),
+			SignatureFirst: signatureFirst,
+		})
+		err := v.Verify(s.Primary(), rootKey)
+		c.Assert(err, gc.ErrorMatches, `alice is banned`)
+		c.Assert(macaroon.IsFatal(err), gc.Equals, true)
+		verr := err.(*macaroon.VerificationError)
+		c.Assert(verr.Kind, gc.Equals, macaroon.CheckDenied)
+		c.Assert(verr.Err, gc.Equals, checkErr)
+		c.Assert(verr.Condition, gc.Equals, "alice-is-great caveat")
+	}
+}
+
+func (*verifierSuite) TestIsFatal(c *gc.C) {
+	c.Assert(macaroon.Fatal(nil), gc.IsNil)
+	c.Assert(macaroon.IsFatal(nil), gc.Equals, false)
+	c.Assert(macaroon.IsFatal(fmt.Errorf("remediable")), gc.Equals, false)
+	err := macaroon.Fatal(fmt.Errorf("fatal"))
+	c.Assert(err, gc.ErrorMatches, "fatal")
+	c.Assert(macaroon.IsFatal(err), gc.Equals, true)
+
+	// Remediable check failures are not fatal.
+	rootKey := []byte("secret")
+	m := MustNew(rootKey, "some id", "a location")
+	err = m.AddFirstPartyCaveat("a caveat")
+	c.Assert(err, gc.IsNil)
+	err = m.Verify(rootKey, func(string) error {
+		return fmt.Errorf("expired")
+	}, nil)
+	c.Assert(err.(*macaroon.VerificationError).Kind, gc.Equals, macaroon.CheckFailed)
+	c.Assert(macaroon.IsFatal(err), gc.Equals, false)
+}